@@ -130,6 +130,11 @@ func runServer() error {
 	if err := fs.CreateRootDirs(); err != nil {
 		return fmt.Errorf("failed to create dirs under %s: %w", cfg.DataDir, err)
 	}
+	fs.CopyStrategy, err = fs.ResolveCopyStrategy(store.CopyStrategy(cfg.CacheCopyStrategy))
+	if err != nil {
+		return fmt.Errorf("failed to resolve cache copy strategy: %w", err)
+	}
+	slog.Info("Resolved cache copy strategy", slog.String("strategy", string(fs.CopyStrategy)))
 
 	var githubApp *github.GitHubApp
 	if cfg.GitHub != nil {
@@ -155,7 +160,7 @@ func runServer() error {
 	go processor.Run(ctx)
 
 	staticFileDir := path.Join(*libDir, "ui/static/")
-	handler := web.Handler(cfg, userAuth, &db, &fs, tmpl, staticFileDir)
+	handler := web.Handler(cfg, userAuth, &db, &fs, processor, tmpl, staticFileDir)
 	err = web.RunServer(ctx, handler, 8000)
 	if err != nil {
 		return fmt.Errorf("error during web server execution: %w", err)
@@ -4,11 +4,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"maps"
 	"os"
 	"os/exec"
 	"path"
+	"strings"
+	"time"
 
+	"github.com/ctbur/ci-server/v2/internal/config"
 	"github.com/ctbur/ci-server/v2/internal/store"
 )
 
@@ -21,7 +26,18 @@ type Builder struct {
 
 type builderFSStore interface {
 	CreateBuildDir(buildID uint64, cacheID *uint64, checkoutDir string) (string, error)
+	RestoreCache(
+		owner, name string, refs []string, key string, restoreKeys []string, absBuildDir string,
+	) (*store.CacheEntry, error)
+	SaveCache(owner, name, ref, key string, absBuildDir string, paths []string) (*store.CacheEntry, error)
+	EvictCaches(maxSize int64) ([]store.CacheEntry, error)
 	WriteExitCode(buildID uint64, exitCode int) error
+	WriteTimeout(buildID uint64) error
+	WriteBuildSteps(buildID uint64, steps []store.BuildStep) error
+	AppendBuildLog(buildID uint64, text string) error
+	StoreArtifact(buildID uint64, name, srcPath string) (store.Artifact, error)
+	WriteArtifactList(buildID uint64, artifacts []store.Artifact) error
+	WriteTestResults(buildID uint64, results []store.TestResult) error
 }
 
 type git interface {
@@ -29,37 +45,76 @@ type git interface {
 }
 
 type cmdRunner interface {
-	Run(buildID uint64, absSandboxDir, workDir string, cmd []string, env []string) (int, error)
+	Run(
+		buildID uint64,
+		step int,
+		absSandboxDir, workDir string,
+		cmd []string,
+		env []string,
+		timeout time.Duration,
+	) (int, error)
 }
 
 func githubRepoURL(owner, name string) string {
 	return fmt.Sprintf("https://github.com/%s/%s.git", owner, name)
 }
 
-func RunBuilder() error {
-	paramsJSON := os.Getenv("CI_BUILDER_PARAMS")
-	if paramsJSON == "" {
-		return errors.New("missing CI_BUILDER_PARAMS for builder")
-	}
+// builderParamsFD is the file descriptor of the pipe through which the builder
+// receives its params, see BuilderController.Start.
+const builderParamsFD = 3
 
-	p := BuilderParams{}
-	if err := json.Unmarshal([]byte(paramsJSON), &p); err != nil {
-		return fmt.Errorf("failed to unmarshal build params JSON '%s': %w", paramsJSON, err)
+func RunBuilder() error {
+	p, err := readBuilderParams()
+	if err != nil {
+		return err
 	}
 
-	fs := &store.FSStore{RootDir: p.DataDir}
+	fs := &store.FSStore{RootDir: p.DataDir, CopyStrategy: p.CopyStrategy}
 	br := Builder{
 		FS:               fs,
 		Git:              &Git{},
 		RepoURLFormatter: githubRepoURL,
-		Cmd:              &CmdRunner{fs},
+		Cmd: &CmdRunner{
+			FS:     fs,
+			Masker: newSecretMasker(p.secrets()...),
+		},
 	}
 
 	return br.run(slog.Default(), p)
 }
 
+// readBuilderParams reads the params that BuilderController.Start passes to the
+// builder process.
+func readBuilderParams() (BuilderParams, error) {
+	paramsFile := os.NewFile(builderParamsFD, "builder-params")
+	if paramsFile == nil {
+		return BuilderParams{}, errors.New("missing params pipe for builder")
+	}
+
+	paramsJSON, err := io.ReadAll(paramsFile)
+	// Close the pipe, so that it is not inherited by the build commands
+	_ = paramsFile.Close()
+	if err != nil {
+		return BuilderParams{}, fmt.Errorf("failed to read build params: %w", err)
+	}
+
+	p := BuilderParams{}
+	// The params contain secrets, so don't include them in the error
+	if err := json.Unmarshal(paramsJSON, &p); err != nil {
+		return BuilderParams{}, fmt.Errorf("failed to unmarshal build params JSON: %w", err)
+	}
+	return p, nil
+}
+
 func (br *Builder) run(log *slog.Logger, p BuilderParams) error {
 	exitCode, err := br.runBuild(log, p)
+	if errors.Is(err, ErrCmdTimeout) {
+		if err := br.FS.WriteTimeout(p.BuildID); err != nil {
+			return fmt.Errorf("failed to write timeout: %w", err)
+		}
+		log.Info("Build timed out")
+		return nil
+	}
 	if err != nil {
 		return fmt.Errorf("build failed: %w", err)
 	}
@@ -96,38 +151,223 @@ func (br *Builder) runBuild(log *slog.Logger, p BuilderParams) (int, error) {
 		return 0, err
 	}
 
-	// Run build command
-	log.Info("Starting build...", slog.Any("command", p.BuildCmd))
-	buildEnv := buildCmdEnv(absBuildDir, p.PathEnvVar, p.EnvVars, p.BuildSecrets)
-	exitCode, err := br.Cmd.Run(p.BuildID, absBuildDir, absCheckoutDir, p.BuildCmd, buildEnv)
+	caches, err := br.restoreCaches(log, p, absBuildDir, absCheckoutDir)
 	if err != nil {
 		return 0, err
 	}
-	log.Info("Finished build command", slog.Int("exit_code", exitCode))
 
-	// Don't run deploy if there is no command
-	if len(p.DeployCmd) == 0 {
-		slog.Info("No deploy command provided")
-		return exitCode, nil
+	exitCode, err := br.runCommands(log, p, absBuildDir, absCheckoutDir)
+	if err != nil {
+		return 0, err
 	}
-	// Don't run deploy if build failed
-	if exitCode != 0 {
-		slog.Info("Deploy command provided, but build command failed")
-		return exitCode, nil
+
+	// Caches of failed builds could contain what made them fail
+	if exitCode == 0 {
+		if err := br.saveCaches(log, p, absBuildDir, caches); err != nil {
+			return 0, err
+		}
 	}
 
-	// Run deploy command
-	log.Info("Starting deploy...", slog.Any("command", p.DeployCmd))
-	deployEnv := buildCmdEnv(absBuildDir, p.PathEnvVar, p.EnvVars, p.DeploySecrets)
-	exitCode, err = br.Cmd.Run(p.BuildID, absBuildDir, absCheckoutDir, p.DeployCmd, deployEnv)
-	if err != nil {
+	// Artifacts and test results are also kept for failed builds, which is
+	// when they are needed the most
+	if err := br.collectArtifacts(log, p.BuildID, absCheckoutDir, p.Artifacts); err != nil {
+		return 0, err
+	}
+	if err := br.collectTestResults(log, p.BuildID, absCheckoutDir, p.TestReports); err != nil {
 		return 0, err
 	}
-	log.Info("Finished deploy command", slog.Int("exit_code", exitCode))
 
 	return exitCode, nil
 }
 
+// runCommands runs the steps of the pipeline file if enabled and present, and
+// the build and deploy steps otherwise.
+func (br *Builder) runCommands(
+	log *slog.Logger, p BuilderParams, absBuildDir, absCheckoutDir string,
+) (int, error) {
+	if p.PipelineEnabled {
+		pipelineFile := path.Join(absCheckoutDir, config.PipelineFile)
+		_, err := os.Stat(pipelineFile)
+		if err == nil {
+			return br.runPipeline(log, p, absBuildDir, absCheckoutDir, pipelineFile)
+		} else if !os.IsNotExist(err) {
+			return 0, fmt.Errorf("failed to check for pipeline file: %w", err)
+		}
+		log.Info("No pipeline file found, falling back to build steps")
+	}
+
+	steps := make([]plannedStep, len(p.Steps))
+	for i, step := range p.Steps {
+		steps[i] = plannedStep{
+			name:    step.Name,
+			cmd:     step.Cmd,
+			env:     buildCmdEnv(absBuildDir, p.PathEnvVar, p.EnvVars, step.Secrets),
+			timeout: step.Timeout,
+		}
+	}
+
+	return br.runSteps(log, p.BuildID, absBuildDir, absCheckoutDir, steps, time.Time{})
+}
+
+func (br *Builder) runPipeline(
+	log *slog.Logger, p BuilderParams, absBuildDir, absCheckoutDir, pipelineFile string,
+) (int, error) {
+	pipeline, err := config.LoadPipeline(pipelineFile)
+	if err != nil {
+		// The pipeline file is part of the commit, so this is a build failure
+		return 1, br.logCI(p.BuildID, "%s", err)
+	}
+
+	// Builds that are not of a branch, e.g. tags, only run unconditional steps
+	branch, ok := strings.CutPrefix(p.Ref, "refs/heads/")
+	if !ok {
+		branch = ""
+	}
+
+	steps := make([]plannedStep, len(pipeline.Steps))
+	for i, step := range pipeline.Steps {
+		if !step.When.Matches(branch) {
+			steps[i] = plannedStep{name: step.Name, skip: true}
+			continue
+		}
+
+		// Check the secrets of all steps that run before running any of them
+		secrets := make(map[string]string)
+		for _, name := range step.Secrets {
+			value, ok := p.PipelineSecrets[name]
+			if !ok {
+				return 1, br.logCI(
+					p.BuildID, "Step '%s' requests secret '%s', which is not available to this build",
+					step.Name, name,
+				)
+			}
+			secrets[name] = value
+		}
+
+		envVars := maps.Clone(p.EnvVars)
+		if envVars == nil {
+			envVars = make(map[string]string)
+		}
+		maps.Copy(envVars, pipeline.Env)
+		maps.Copy(envVars, step.Env)
+
+		steps[i] = plannedStep{
+			name:    step.Name,
+			cmd:     step.Command,
+			env:     buildCmdEnv(absBuildDir, p.PathEnvVar, envVars, secrets),
+			timeout: step.Timeout,
+		}
+	}
+
+	// The build timeout applies to the pipeline as a whole
+	var deadline time.Time
+	if p.PipelineTimeout > 0 {
+		deadline = time.Now().Add(p.PipelineTimeout)
+	}
+
+	return br.runSteps(log, p.BuildID, absBuildDir, absCheckoutDir, steps, deadline)
+}
+
+// plannedStep is a step that is ready to be run by the builder.
+type plannedStep struct {
+	name    string
+	cmd     []string
+	env     []string
+	timeout time.Duration
+	skip    bool
+}
+
+// runSteps runs steps in order until one of them fails, and keeps track of
+// their state for the UI. If deadline is set, all steps together must finish
+// before it. It returns the exit code of the last step that ran.
+func (br *Builder) runSteps(
+	log *slog.Logger,
+	buildID uint64,
+	absBuildDir, absCheckoutDir string,
+	steps []plannedStep,
+	deadline time.Time,
+) (int, error) {
+	state := make([]store.BuildStep, len(steps))
+	for i, step := range steps {
+		state[i] = store.BuildStep{Index: i, Name: step.name, Skipped: step.skip}
+	}
+	writeState := func() error {
+		if err := br.FS.WriteBuildSteps(buildID, state); err != nil {
+			return fmt.Errorf("failed to write build steps: %w", err)
+		}
+		return nil
+	}
+	if err := writeState(); err != nil {
+		return 0, err
+	}
+	skipFrom := func(first int) {
+		for i := first; i < len(state); i++ {
+			state[i].Skipped = state[i].Started == nil
+		}
+	}
+
+	exitCode := 0
+	for i, step := range steps {
+		if step.skip {
+			continue
+		}
+		if exitCode != 0 {
+			// Don't run the remaining steps after a step failed
+			skipFrom(i)
+			break
+		}
+
+		timeout := step.timeout
+		if !deadline.IsZero() {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				skipFrom(i)
+				return 0, errors.Join(ErrCmdTimeout, writeState(), br.logCI(buildID, "Build timed out"))
+			}
+			if timeout == 0 || remaining < timeout {
+				timeout = remaining
+			}
+		}
+
+		started := time.Now()
+		state[i].Started = &started
+		if err := writeState(); err != nil {
+			return 0, err
+		}
+
+		log.Info("Starting step...", slog.String("step", step.name), slog.Any("command", step.cmd))
+		var err error
+		exitCode, err = br.Cmd.Run(buildID, i, absBuildDir, absCheckoutDir, step.cmd, step.env, timeout)
+
+		finished := time.Now()
+		state[i].Finished = &finished
+		if errors.Is(err, ErrCmdTimeout) {
+			state[i].TimedOut = true
+			skipFrom(i + 1)
+			return 0, errors.Join(err, writeState())
+		}
+		if err != nil {
+			return 0, err
+		}
+		state[i].ExitCode = &exitCode
+		if err := writeState(); err != nil {
+			return 0, err
+		}
+		log.Info("Finished step", slog.String("step", step.name), slog.Int("exit_code", exitCode))
+	}
+
+	return exitCode, writeState()
+}
+
+// logCI writes a line to the build logs to let the user follow the progress of
+// the build.
+func (br *Builder) logCI(buildID uint64, format string, args ...any) error {
+	if err := br.FS.AppendBuildLog(buildID, fmt.Sprintf(format, args...)); err != nil {
+		return fmt.Errorf("failed to write build log: %w", err)
+	}
+	return nil
+}
+
 func buildCmdEnv(absBuildDir string, pathEnvVar string, envVars map[string]string, secrets map[string]string) []string {
 	var env []string
 
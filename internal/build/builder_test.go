@@ -2,6 +2,8 @@ package build
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
@@ -11,8 +13,10 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/ctbur/ci-server/v2/internal/assert"
+	"github.com/ctbur/ci-server/v2/internal/config"
 	"github.com/ctbur/ci-server/v2/internal/store"
 	"github.com/ctbur/ci-server/v2/internal/test"
 )
@@ -61,12 +65,14 @@ func createDummyGitRepo(targetDir string, files map[string]string) (string, erro
 
 func (r *MockCmdRunner) Run(
 	buildID uint64,
+	step int,
 	absSandboxDir, workDir string,
 	cmd []string,
 	env []string,
+	timeout time.Duration,
 ) (int, error) {
 	r.Calls = append(r.Calls, CmdRunnerCall{
-		buildID, absSandboxDir, workDir, cmd, env,
+		buildID, step, absSandboxDir, workDir, cmd, env, timeout,
 	})
 	res := r.MockResults[0]
 	r.MockResults = r.MockResults[1:]
@@ -127,19 +133,23 @@ func TestBuilderE2E(t *testing.T) {
 			"ENV_VAR_A": "env A",
 			"ENV_VAR_B": "env B",
 		},
-		BuildCmd: []string{
-			"sh", "-c", "printenv > build.env",
-		},
-		BuildSecrets: map[string]string{
-			"BUILD_SECRET_A": "build A",
-			"BUILD_SECRET_B": "build B",
-		},
-		DeployCmd: []string{
-			"sh", "-c", "printenv > deploy.env",
-		},
-		DeploySecrets: map[string]string{
-			"DEPLOY_SECRET_A": "deploy A",
-			"DEPLOY_SECRET_B": "deploy B",
+		Steps: []StepParams{
+			{
+				Name: "build",
+				Cmd:  []string{"sh", "-c", "printenv > build.env"},
+				Secrets: map[string]string{
+					"BUILD_SECRET_A": "build A",
+					"BUILD_SECRET_B": "build B",
+				},
+			},
+			{
+				Name: "deploy",
+				Cmd:  []string{"sh", "-c", "printenv > deploy.env"},
+				Secrets: map[string]string{
+					"DEPLOY_SECRET_A": "deploy A",
+					"DEPLOY_SECRET_B": "deploy B",
+				},
+			},
 		},
 	}
 
@@ -157,7 +167,7 @@ func TestBuilderE2E(t *testing.T) {
 	assert.NoError(t, err, "Failed to run builder").Fatal()
 
 	// Check exit code correct
-	exitCode, err := dataDir.ReadAndCleanExitCode(buildID)
+	exitCode, err := dataDir.ReadExitCode(buildID)
 	assert.NoError(t, err, "Failed to read exit code")
 	assert.Equal(t, exitCode, 0, "Incorrect exit code written")
 
@@ -218,14 +228,38 @@ func checkEnv(t *testing.T, envData []byte, contains []string, notContains []str
 
 func NewMockDataDir() MockDataDir {
 	return MockDataDir{
+		RootDir:   "/mockdir",
 		BuildDirs: make(map[uint64]MockBuildDir),
 		ExitCodes: make(map[uint64]int),
+		Timeouts:  make(map[uint64]bool),
+		Steps:     make(map[uint64][]store.BuildStep),
+		Logs:      make(map[uint64][]string),
+		Artifacts: make(map[uint64][]store.Artifact),
+		Tests:     make(map[uint64][]store.TestResult),
 	}
 }
 
+// MockCacheCall is a call to save or restore a cache entry.
+type MockCacheCall struct {
+	Refs  []string
+	Key   string
+	Paths []string
+}
+
 type MockDataDir struct {
+	RootDir   string
 	BuildDirs map[uint64]MockBuildDir
 	ExitCodes map[uint64]int
+	Timeouts  map[uint64]bool
+	Steps     map[uint64][]store.BuildStep
+	Logs      map[uint64][]string
+	Artifacts map[uint64][]store.Artifact
+	Tests     map[uint64][]store.TestResult
+	// Keys of the existing cache entries
+	CacheKeys     []string
+	RestoredCache []MockCacheCall
+	SavedCache    []MockCacheCall
+	Evicted       bool
 }
 
 type MockBuildDir struct {
@@ -239,7 +273,7 @@ func (d *MockDataDir) CreateBuildDir(buildID uint64, cacheID *uint64, checkoutDi
 	}
 
 	d.BuildDirs[buildID] = MockBuildDir{CacheID: cacheID, CheckoutDir: checkoutDir}
-	return fmt.Sprintf("/mockdir/%d", buildID), nil
+	return fmt.Sprintf("%s/%d", d.RootDir, buildID), nil
 }
 
 func (d *MockDataDir) WriteExitCode(buildID uint64, exitCode int) error {
@@ -251,6 +285,69 @@ func (d *MockDataDir) WriteExitCode(buildID uint64, exitCode int) error {
 	return nil
 }
 
+func (d *MockDataDir) WriteTimeout(buildID uint64) error {
+	if _, exists := d.ExitCodes[buildID]; exists {
+		return errors.New("exit code already written")
+	}
+
+	d.Timeouts[buildID] = true
+	return nil
+}
+
+func (d *MockDataDir) WriteBuildSteps(buildID uint64, steps []store.BuildStep) error {
+	d.Steps[buildID] = slices.Clone(steps)
+	return nil
+}
+
+func (d *MockDataDir) AppendBuildLog(buildID uint64, text string) error {
+	d.Logs[buildID] = append(d.Logs[buildID], text)
+	return nil
+}
+
+func (d *MockDataDir) StoreArtifact(buildID uint64, name, srcPath string) (store.Artifact, error) {
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return store.Artifact{}, err
+	}
+	return store.Artifact{Name: name, Size: info.Size()}, nil
+}
+
+func (d *MockDataDir) WriteArtifactList(buildID uint64, artifacts []store.Artifact) error {
+	d.Artifacts[buildID] = slices.Clone(artifacts)
+	return nil
+}
+
+func (d *MockDataDir) RestoreCache(
+	owner, name string, refs []string, key string, restoreKeys []string, absBuildDir string,
+) (*store.CacheEntry, error) {
+	d.RestoredCache = append(d.RestoredCache, MockCacheCall{Refs: refs, Key: key})
+	for _, prefix := range append([]string{key}, restoreKeys...) {
+		for _, k := range d.CacheKeys {
+			if strings.HasPrefix(k, prefix) {
+				return &store.CacheEntry{Key: k}, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (d *MockDataDir) SaveCache(
+	owner, name, ref, key string, absBuildDir string, paths []string,
+) (*store.CacheEntry, error) {
+	d.SavedCache = append(d.SavedCache, MockCacheCall{Refs: []string{ref}, Key: key, Paths: paths})
+	return &store.CacheEntry{Key: key, Ref: ref}, nil
+}
+
+func (d *MockDataDir) EvictCaches(maxSize int64) ([]store.CacheEntry, error) {
+	d.Evicted = true
+	return nil, nil
+}
+
+func (d *MockDataDir) WriteTestResults(buildID uint64, results []store.TestResult) error {
+	d.Tests[buildID] = slices.Clone(results)
+	return nil
+}
+
 type MockCmdRunner struct {
 	MockResults []MockCmdResult
 	Calls       []CmdRunnerCall
@@ -263,22 +360,33 @@ type MockCmdResult struct {
 
 type CmdRunnerCall struct {
 	buildID                uint64
+	step                   int
 	absSandboxDir, workDir string
 	cmd                    []string
 	env                    []string
+	timeout                time.Duration
 }
 
 type MockGit struct {
 	RepoURL   string
 	CommitSHA string
 	TargetDir string
+	// Files written to the target dir on checkout
+	Files map[string]string
 }
 
 func (g *MockGit) Checkout(repoURL, commitSHA, targetDir string) error {
 	g.RepoURL = repoURL
 	g.CommitSHA = commitSHA
 	g.TargetDir = targetDir
-	return nil
+
+	if len(g.Files) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(targetDir, 0o700); err != nil {
+		return err
+	}
+	return writeToDir(targetDir, g.Files)
 }
 
 func TestBuilder(t *testing.T) {
@@ -291,6 +399,7 @@ func TestBuilder(t *testing.T) {
 		deployCmd    []string
 		cmdResults   []MockCmdResult
 		wantExitCode int
+		wantTimeout  bool
 		shouldDeploy bool
 	}{
 		{
@@ -365,6 +474,31 @@ func TestBuilder(t *testing.T) {
 			wantExitCode: 3,
 			shouldDeploy: true,
 		},
+		{
+			desc:      "Build times out",
+			buildID:   101,
+			cacheID:   &cacheID,
+			buildCmd:  []string{"make", "lint", "test"},
+			deployCmd: []string{"make", "install"},
+			cmdResults: []MockCmdResult{
+				{exitCode: -1, err: ErrCmdTimeout},
+			},
+			wantTimeout:  true,
+			shouldDeploy: false,
+		},
+		{
+			desc:      "Build and deploy, but deploy times out",
+			buildID:   101,
+			cacheID:   &cacheID,
+			buildCmd:  []string{"make", "lint", "test"},
+			deployCmd: []string{"make", "install"},
+			cmdResults: []MockCmdResult{
+				{exitCode: 0, err: nil},
+				{exitCode: -1, err: ErrCmdTimeout},
+			},
+			wantTimeout:  true,
+			shouldDeploy: true,
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.desc, func(t *testing.T) {
@@ -381,17 +515,29 @@ func TestBuilder(t *testing.T) {
 					"ENV_VAR_A": "env A",
 					"ENV_VAR_B": "env B",
 				},
-				BuildCmd: tc.buildCmd,
-				BuildSecrets: map[string]string{
-					"BUILD_SECRET_A": "build A",
-					"BUILD_SECRET_B": "build B",
-				},
-				DeployCmd: tc.deployCmd,
-				DeploySecrets: map[string]string{
-					"DEPLOY_SECRET_A": "deploy A",
-					"DEPLOY_SECRET_B": "deploy B",
+				Steps: []StepParams{
+					{
+						Name: "build",
+						Cmd:  tc.buildCmd,
+						Secrets: map[string]string{
+							"BUILD_SECRET_A": "build A",
+							"BUILD_SECRET_B": "build B",
+						},
+						Timeout: 30 * time.Minute,
+					},
 				},
 			}
+			if tc.deployCmd != nil {
+				p.Steps = append(p.Steps, StepParams{
+					Name: "deploy",
+					Cmd:  tc.deployCmd,
+					Secrets: map[string]string{
+						"DEPLOY_SECRET_A": "deploy A",
+						"DEPLOY_SECRET_B": "deploy B",
+					},
+					Timeout: 5 * time.Minute,
+				})
+			}
 
 			// Run builder
 			dataDir := NewMockDataDir()
@@ -414,6 +560,7 @@ func TestBuilder(t *testing.T) {
 			assert.Equal(t, dataDir.BuildDirs[tc.buildID].CacheID, tc.cacheID, "Incorrect cache ID")
 			assert.Equal(t, dataDir.BuildDirs[tc.buildID].CheckoutDir, "owner/repo", "Incorrect checkout dir")
 			assert.Equal(t, dataDir.ExitCodes[tc.buildID], tc.wantExitCode, "Incorrect exit code")
+			assert.Equal(t, dataDir.Timeouts[tc.buildID], tc.wantTimeout, "Incorrect timeout")
 
 			// Check git
 			assert.Equal(t, git.RepoURL, "https://github.com/owner/repo.git", "Incorrect repo URL")
@@ -421,6 +568,16 @@ func TestBuilder(t *testing.T) {
 			wantCheckoutDir := fmt.Sprintf("/mockdir/%d/owner/repo", tc.buildID)
 			assert.Equal(t, git.TargetDir, wantCheckoutDir, "Incorrect repo dir")
 
+			// Check recorded steps
+			steps := dataDir.Steps[tc.buildID]
+			assert.Equal(t, len(steps), len(p.Steps), "Incorrect number of recorded steps").Fatal()
+			assert.Equal(t, steps[0].Started != nil, true, "Build step was not started")
+			if len(steps) > 1 {
+				assert.Equal(t, steps[1].Skipped, !tc.shouldDeploy, "Incorrect deploy step skipped")
+			}
+			lastStep := steps[len(cmdRunner.Calls)-1]
+			assert.Equal(t, lastStep.TimedOut, tc.wantTimeout, "Incorrect step timeout")
+
 			// Check cmd runner
 			if tc.shouldDeploy {
 				assert.Equal(t, len(cmdRunner.Calls), 2, "Incorrect number of commands executed")
@@ -430,10 +587,12 @@ func TestBuilder(t *testing.T) {
 
 			// Check build cmd
 			assert.Equal(t, cmdRunner.Calls[0].buildID, tc.buildID, "Incorrect build ID")
+			assert.Equal(t, cmdRunner.Calls[0].step, 0, "Incorrect build step")
 			wantSandboxDir := fmt.Sprintf("/mockdir/%d", tc.buildID)
 			assert.Equal(t, cmdRunner.Calls[0].absSandboxDir, wantSandboxDir, "Incorrect sandbox dir")
 			assert.Equal(t, cmdRunner.Calls[0].workDir, wantCheckoutDir, "Incorrect work dir")
 			assert.DeepEqual(t, cmdRunner.Calls[0].cmd, tc.buildCmd, "Incorrect build command")
+			assert.Equal(t, cmdRunner.Calls[0].timeout, 30*time.Minute, "Incorrect build timeout")
 			assert.ElementsMatch(t,
 				cmdRunner.Calls[0].env,
 				[]string{
@@ -451,9 +610,11 @@ func TestBuilder(t *testing.T) {
 			if tc.shouldDeploy {
 				// Check deploy cmd
 				assert.Equal(t, cmdRunner.Calls[1].buildID, tc.buildID, "Incorrect build ID")
+				assert.Equal(t, cmdRunner.Calls[1].step, 1, "Incorrect deploy step")
 				assert.Equal(t, cmdRunner.Calls[1].absSandboxDir, wantSandboxDir, "Incorrect sandbox dir")
 				assert.Equal(t, cmdRunner.Calls[1].workDir, wantCheckoutDir, "Incorrect work dir")
 				assert.DeepEqual(t, cmdRunner.Calls[1].cmd, tc.deployCmd, "Incorrect deploy command")
+				assert.Equal(t, cmdRunner.Calls[1].timeout, 5*time.Minute, "Incorrect deploy timeout")
 				assert.ElementsMatch(t,
 					cmdRunner.Calls[1].env,
 					[]string{
@@ -471,3 +632,556 @@ func TestBuilder(t *testing.T) {
 		})
 	}
 }
+
+func TestBuilderPipeline(t *testing.T) {
+	pipelineFile := `
+[env]
+PIPELINE_VAR = "pipeline"
+
+[[steps]]
+name = "test"
+command = ["make", "test"]
+env = { STEP_VAR = "test" }
+
+[[steps]]
+name = "deploy"
+command = ["make", "deploy"]
+secrets = ["DEPLOY_SECRET"]
+timeout = "1m"
+when = { branches = ["main"] }
+`
+
+	testCases := []struct {
+		desc         string
+		ref          string
+		pipelineFile string
+		secrets      map[string]string
+		cmdResults   []MockCmdResult
+		wantCmds     [][]string
+		wantExitCode int
+		wantSkipped  []bool
+		wantLogs     []string
+	}{
+		{
+			desc:         "Run all steps on default branch",
+			ref:          "refs/heads/main",
+			pipelineFile: pipelineFile,
+			secrets:      map[string]string{"DEPLOY_SECRET": "deploy"},
+			cmdResults: []MockCmdResult{
+				{exitCode: 0, err: nil},
+				{exitCode: 0, err: nil},
+			},
+			wantCmds:     [][]string{{"make", "test"}, {"make", "deploy"}},
+			wantExitCode: 0,
+			wantSkipped:  []bool{false, false},
+		},
+		{
+			desc:         "Skip steps with unmatched condition",
+			ref:          "refs/heads/feature",
+			pipelineFile: pipelineFile,
+			// Deploy secrets are not available to builds of other branches
+			secrets: map[string]string{},
+			cmdResults: []MockCmdResult{
+				{exitCode: 0, err: nil},
+			},
+			wantCmds:     [][]string{{"make", "test"}},
+			wantExitCode: 0,
+			wantSkipped:  []bool{false, true},
+		},
+		{
+			desc:         "Stop after failed step",
+			ref:          "refs/heads/main",
+			pipelineFile: pipelineFile,
+			secrets:      map[string]string{"DEPLOY_SECRET": "deploy"},
+			cmdResults: []MockCmdResult{
+				{exitCode: 2, err: nil},
+			},
+			wantCmds:     [][]string{{"make", "test"}},
+			wantExitCode: 2,
+			wantSkipped:  []bool{false, true},
+		},
+		{
+			desc:         "Fail if a secret is not available",
+			ref:          "refs/heads/main",
+			pipelineFile: pipelineFile,
+			secrets:      map[string]string{},
+			wantCmds:     nil,
+			wantExitCode: 1,
+			wantLogs: []string{
+				"Step 'deploy' requests secret 'DEPLOY_SECRET', which is not available to this build",
+			},
+		},
+		{
+			desc:         "Fail on invalid pipeline file",
+			ref:          "refs/heads/main",
+			pipelineFile: "[[steps]]\nname = \"test\"\n",
+			wantCmds:     nil,
+			wantExitCode: 1,
+			wantLogs:     []string{"invalid pipeline file: step 'test' has no command"},
+		},
+		{
+			desc: "Fall back to build command without pipeline file",
+			ref:  "refs/heads/main",
+			cmdResults: []MockCmdResult{
+				{exitCode: 0, err: nil},
+			},
+			wantCmds:     [][]string{{"make", "build"}},
+			wantExitCode: 0,
+			wantSkipped:  []bool{false},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			buildID := uint64(7)
+			p := BuilderParams{
+				BuildID:         buildID,
+				RepoOwner:       "owner",
+				RepoName:        "repo",
+				Ref:             tc.ref,
+				PathEnvVar:      "/usr/bin",
+				EnvVars:         map[string]string{"REPO_VAR": "repo"},
+				Steps:           []StepParams{{Name: "build", Cmd: []string{"make", "build"}}},
+				PipelineTimeout: 30 * time.Minute,
+				PipelineEnabled: true,
+				PipelineSecrets: tc.secrets,
+			}
+
+			dataDir := NewMockDataDir()
+			dataDir.RootDir = t.TempDir()
+			git := MockGit{}
+			if tc.pipelineFile != "" {
+				git.Files = map[string]string{".ci.toml": tc.pipelineFile}
+			}
+			cmdRunner := MockCmdRunner{
+				MockResults: tc.cmdResults,
+			}
+			br := Builder{
+				FS:               &dataDir,
+				Git:              &git,
+				RepoURLFormatter: githubRepoURL,
+				Cmd:              &cmdRunner,
+			}
+
+			err := br.run(test.Logger(t), p)
+			assert.NoError(t, err, "Failed to run builder").Fatal()
+
+			assert.Equal(t, dataDir.ExitCodes[buildID], tc.wantExitCode, "Incorrect exit code")
+			assert.DeepEqual(t, dataDir.Logs[buildID], tc.wantLogs, "Incorrect build logs")
+
+			var skipped []bool
+			for i, step := range dataDir.Steps[buildID] {
+				assert.Equal(t, step.Index, i, "Incorrect step index")
+				skipped = append(skipped, step.Skipped)
+			}
+			assert.DeepEqual(t, skipped, tc.wantSkipped, "Incorrect skipped steps")
+
+			var cmds [][]string
+			for _, call := range cmdRunner.Calls {
+				cmds = append(cmds, call.cmd)
+			}
+			assert.DeepEqual(t, cmds, tc.wantCmds, "Incorrect commands executed")
+
+			if tc.pipelineFile == "" || len(cmdRunner.Calls) == 0 {
+				return
+			}
+			assert.ElementsMatch(t,
+				cmdRunner.Calls[0].env,
+				[]string{
+					"CI=true",
+					fmt.Sprintf("HOME=%s/%d", dataDir.RootDir, buildID),
+					"PATH=/usr/bin",
+					"REPO_VAR=repo",
+					"PIPELINE_VAR=pipeline",
+					"STEP_VAR=test",
+				},
+				"Incorrect step env",
+			)
+			if len(cmdRunner.Calls) > 1 {
+				assert.Equal(t, cmdRunner.Calls[1].timeout, time.Minute, "Incorrect step timeout")
+				assert.Equal(t,
+					slices.Contains(cmdRunner.Calls[1].env, "DEPLOY_SECRET=deploy"), true,
+					"Missing requested secret",
+				)
+			}
+		})
+	}
+}
+
+func TestBuilderArtifacts(t *testing.T) {
+	buildID := uint64(7)
+	p := BuilderParams{
+		BuildID:    buildID,
+		RepoOwner:  "owner",
+		RepoName:   "repo",
+		PathEnvVar: "/usr/bin",
+		Steps:      []StepParams{{Name: "build", Cmd: []string{"make", "build"}}},
+		Artifacts:  []string{"dist/*", "*.md", "../*", "missing/*", "deep/*/*/*/*/*"},
+	}
+
+	dataDir := NewMockDataDir()
+	dataDir.RootDir = t.TempDir()
+	checkoutDir := fmt.Sprintf("%s/%d/owner/repo", dataDir.RootDir, buildID)
+	err := os.MkdirAll(path.Join(checkoutDir, "dist", "sub"), 0o700)
+	assert.NoError(t, err, "Failed to create checkout dir").Fatal()
+	// Paths that are too long to be stored are skipped
+	longName := strings.Repeat("d", 250)
+	deepDir := path.Join("deep", longName, longName, longName, longName)
+	deepFile := path.Join(deepDir, longName)
+	err = os.MkdirAll(path.Join(checkoutDir, deepDir), 0o700)
+	assert.NoError(t, err, "Failed to create deep dir").Fatal()
+	// Files outside of the checkout dir must not be collected
+	secretFile := path.Join(dataDir.RootDir, "secret")
+	err = os.WriteFile(secretFile, []byte("secret"), 0o600)
+	assert.NoError(t, err, "Failed to write secret file").Fatal()
+	err = os.Symlink(secretFile, path.Join(checkoutDir, "dist", "link"))
+	assert.NoError(t, err, "Failed to create symlink").Fatal()
+
+	git := MockGit{Files: map[string]string{
+		"dist/app.tar.gz": "app",
+		"dist/sub/nested": "nested",
+		"README.md":       "readme",
+		"main.go":         "package main",
+		deepFile:          "deep",
+	}}
+	br := Builder{
+		FS:               &dataDir,
+		Git:              &git,
+		RepoURLFormatter: githubRepoURL,
+		Cmd: &MockCmdRunner{
+			MockResults: []MockCmdResult{{exitCode: 1, err: nil}},
+		},
+	}
+
+	err = br.run(test.Logger(t), p)
+	assert.NoError(t, err, "Failed to run builder").Fatal()
+
+	// Artifacts are also collected for failed builds
+	assert.Equal(t, dataDir.ExitCodes[buildID], 1, "Incorrect exit code")
+	assert.DeepEqual(t,
+		dataDir.Artifacts[buildID],
+		[]store.Artifact{
+			{Name: "dist/app.tar.gz", Size: 3},
+			{Name: "README.md", Size: 6},
+		},
+		"Incorrect artifacts",
+	)
+	assert.DeepEqual(t,
+		dataDir.Logs[buildID],
+		[]string{
+			"Skipping artifact 'dist/link', which is not a file within the checkout dir",
+			"Skipping artifact pattern '../*', which is not within the checkout dir",
+			"No artifacts match 'missing/*'",
+			fmt.Sprintf("Skipping artifact '%s', whose path is longer than 1024 bytes", deepFile),
+			"No artifacts match 'deep/*/*/*/*/*'",
+			"Collected 2 artifact(s)",
+		},
+		"Incorrect build logs",
+	)
+}
+
+func TestBuilderTestResults(t *testing.T) {
+	buildID := uint64(8)
+	p := BuilderParams{
+		BuildID:     buildID,
+		RepoOwner:   "owner",
+		RepoName:    "repo",
+		PathEnvVar:  "/usr/bin",
+		Steps:       []StepParams{{Name: "test", Cmd: []string{"make", "test"}}},
+		TestReports: []string{"reports/*", "missing.xml"},
+	}
+
+	dataDir := NewMockDataDir()
+	dataDir.RootDir = t.TempDir()
+	checkoutDir := fmt.Sprintf("%s/%d/owner/repo", dataDir.RootDir, buildID)
+	err := os.MkdirAll(path.Join(checkoutDir, "reports"), 0o700)
+	assert.NoError(t, err, "Failed to create checkout dir").Fatal()
+
+	git := MockGit{Files: map[string]string{
+		"reports/junit.xml": `<testsuite name="unit"><testcase classname="pkg" name="TestA" time="0.5"/></testsuite>`,
+		"reports/cli.tap":   "1..2\nok 1 - runs\nnot ok 2 - exits\n",
+		"reports/broken":    "<testsuite",
+	}}
+	br := Builder{
+		FS:               &dataDir,
+		Git:              &git,
+		RepoURLFormatter: githubRepoURL,
+		Cmd: &MockCmdRunner{
+			MockResults: []MockCmdResult{{exitCode: 1, err: nil}},
+		},
+	}
+
+	err = br.run(test.Logger(t), p)
+	assert.NoError(t, err, "Failed to run builder").Fatal()
+
+	// Test results are also collected for failed builds
+	assert.DeepEqual(t,
+		dataDir.Tests[buildID],
+		[]store.TestResult{
+			{Suite: "cli", Name: "runs", Status: store.TestStatusPassed},
+			{Suite: "cli", Name: "exits", Status: store.TestStatusFailed},
+			{Suite: "pkg", Name: "TestA", Status: store.TestStatusPassed, Duration: 500 * time.Millisecond},
+		},
+		"Incorrect test results",
+	)
+	assert.DeepEqual(t,
+		dataDir.Logs[buildID],
+		[]string{
+			"No test reports match 'missing.xml'",
+			"Failed to read test report 'reports/broken': invalid JUnit XML: XML syntax error on line 1: unexpected EOF",
+			"Collected 3 test result(s), 1 failed",
+		},
+		"Incorrect build logs",
+	)
+}
+
+func TestBuilderCaches(t *testing.T) {
+	// Hash of the go.sum file in the checkout
+	goKey := "go-4478051f13a5d232"
+
+	testCases := []struct {
+		desc         string
+		ref          string
+		cacheKeys    []string
+		exitCode     int
+		wantSaved    bool
+		wantEvicted  bool
+		wantLogs     []string
+		maxCacheSize int64
+	}{
+		{
+			desc:         "Save cache after miss",
+			ref:          "refs/heads/feature",
+			exitCode:     0,
+			maxCacheSize: 1024,
+			wantSaved:    true,
+			wantEvicted:  true,
+			wantLogs: []string{
+				"Skipping cache path '../../../outside', which is not within the build dir",
+				"No cache found for '" + goKey + "'",
+				"Saved cache '" + goKey + "'",
+			},
+		},
+		{
+			desc:      "Don't save cache after hit",
+			ref:       "refs/heads/main",
+			cacheKeys: []string{goKey},
+			exitCode:  0,
+			wantLogs: []string{
+				"Skipping cache path '../../../outside', which is not within the build dir",
+				"Restored cache '" + goKey + "'",
+			},
+		},
+		{
+			desc:      "Save cache after restoring by restore key",
+			ref:       "refs/heads/main",
+			cacheKeys: []string{"go-0000000000000000"},
+			exitCode:  0,
+			wantSaved: true,
+			wantLogs: []string{
+				"Skipping cache path '../../../outside', which is not within the build dir",
+				"Restored cache 'go-0000000000000000'",
+				"Saved cache '" + goKey + "'",
+			},
+		},
+		{
+			desc:     "Don't save cache of failed build",
+			ref:      "refs/heads/main",
+			exitCode: 1,
+			wantLogs: []string{
+				"Skipping cache path '../../../outside', which is not within the build dir",
+				"No cache found for '" + goKey + "'",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			buildID := uint64(9)
+			p := BuilderParams{
+				BuildID:       buildID,
+				RepoOwner:     "owner",
+				RepoName:      "repo",
+				Ref:           tc.ref,
+				DefaultBranch: "main",
+				PathEnvVar:    "/usr/bin",
+				Steps:         []StepParams{{Name: "build", Cmd: []string{"make", "build"}}},
+				Caches: []config.CacheConfig{{
+					Name:        "go",
+					Paths:       []string{"~/go/pkg/mod", "vendor", "../../../outside"},
+					KeyFiles:    []string{"go.sum"},
+					RestoreKeys: []string{"go-"},
+				}},
+				MaxCacheSize: tc.maxCacheSize,
+			}
+
+			dataDir := NewMockDataDir()
+			dataDir.RootDir = t.TempDir()
+			dataDir.CacheKeys = tc.cacheKeys
+			checkoutDir := fmt.Sprintf("%s/%d/owner/repo", dataDir.RootDir, buildID)
+			err := os.MkdirAll(checkoutDir, 0o700)
+			assert.NoError(t, err, "Failed to create checkout dir").Fatal()
+
+			git := MockGit{Files: map[string]string{"go.sum": "example.com/mod v1.0.0 h1:abc="}}
+			br := Builder{
+				FS:               &dataDir,
+				Git:              &git,
+				RepoURLFormatter: githubRepoURL,
+				Cmd: &MockCmdRunner{
+					MockResults: []MockCmdResult{{exitCode: tc.exitCode, err: nil}},
+				},
+			}
+
+			err = br.run(test.Logger(t), p)
+			assert.NoError(t, err, "Failed to run builder").Fatal()
+
+			// Builds of other branches also restore from the default branch
+			wantRefs := []string{tc.ref}
+			if tc.ref != "refs/heads/main" {
+				wantRefs = append(wantRefs, "refs/heads/main")
+			}
+			assert.DeepEqual(t,
+				dataDir.RestoredCache,
+				[]MockCacheCall{{Refs: wantRefs, Key: goKey}},
+				"Incorrect restored caches",
+			)
+
+			var wantSaved []MockCacheCall
+			if tc.wantSaved {
+				wantSaved = []MockCacheCall{{
+					Refs:  []string{tc.ref},
+					Key:   goKey,
+					Paths: []string{"go/pkg/mod", "owner/repo/vendor"},
+				}}
+			}
+			assert.DeepEqual(t, dataDir.SavedCache, wantSaved, "Incorrect saved caches")
+			assert.Equal(t, dataDir.Evicted, tc.wantEvicted, "Incorrect eviction")
+			assert.DeepEqual(t, dataDir.Logs[buildID], tc.wantLogs, "Incorrect build logs")
+		})
+	}
+}
+
+// MockLogWriter encodes log entries like the build logs.
+type MockLogWriter struct {
+	bytes.Buffer
+}
+
+func (w *MockLogWriter) WriteEntry(entry store.LogEntry) error {
+	return json.NewEncoder(&w.Buffer).Encode(&entry)
+}
+
+func TestRunAndLogTimeout(t *testing.T) {
+	// The background process keeps the output pipes open, so the command only
+	// returns quickly if the whole process group is killed
+	cmd := exec.Command("sh", "-c", "sleep 10 & echo started; sleep 10")
+
+	var logs MockLogWriter
+	start := time.Now()
+	_, err := runAndLog(cmd, &logs, nil, 100*time.Millisecond, nil)
+	assert.ErrorIs(t, err, ErrCmdTimeout, "Incorrect error for timed out command")
+
+	elapsed := time.Since(start)
+	assert.Equal(t, elapsed < 5*time.Second, true, "Command was not killed after timeout")
+
+	assert.Equal(t, strings.Contains(logs.String(), `"text":"started"`), true, "Missing command output")
+	assert.Equal(
+		t,
+		strings.Contains(logs.String(), `"text":"Command timed out after 100ms"`), true,
+		"Missing timeout message",
+	)
+}
+
+func TestScanLogLinesMasksSecrets(t *testing.T) {
+	const secret = "s3cr3t-value"
+	longSecret := strings.Repeat("0123456789", 8)
+
+	testCases := []struct {
+		desc      string
+		secrets   map[string]string
+		output    string
+		wantLines []string
+	}{
+		{
+			desc:      "Plain secret",
+			secrets:   map[string]string{"A": secret},
+			output:    "token=" + secret + "\nsecond " + secret + " " + secret + "\n",
+			wantLines: []string{"token=***", "second *** ***"},
+		},
+		{
+			desc:    "Base64 encoded secret",
+			secrets: map[string]string{"A": secret},
+			output: base64.StdEncoding.EncodeToString([]byte(secret)) + "\n" +
+				base64.RawURLEncoding.EncodeToString([]byte(secret)),
+			wantLines: []string{"***", "***"},
+		},
+		{
+			desc:    "Wrapped base64 encoded secret",
+			secrets: map[string]string{"A": longSecret},
+			output: base64.StdEncoding.EncodeToString([]byte(longSecret))[:76] + "\n" +
+				base64.StdEncoding.EncodeToString([]byte(longSecret))[76:] + "\n",
+			wantLines: []string{"***", "***"},
+		},
+		{
+			desc:      "Multi-line secret",
+			secrets:   map[string]string{"A": "-----BEGIN KEY-----\nabcdefgh\n-----END KEY-----\n"},
+			output:    "-----BEGIN KEY-----\nabcdefgh\n-----END KEY-----\ndone\n",
+			wantLines: []string{"***", "***", "***", "done"},
+		},
+		{
+			desc:      "Short values are not masked",
+			secrets:   map[string]string{"A": "abc", "B": ""},
+			output:    "abc\n",
+			wantLines: []string{"abc"},
+		},
+		{
+			desc:      "Carriage returns are trimmed",
+			secrets:   map[string]string{"A": secret},
+			output:    secret + "\r\nlast line without newline",
+			wantLines: []string{"***", "last line without newline"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var lines []string
+			err := scanLogLines(
+				strings.NewReader(tc.output), maxLogLineLength, newSecretMasker(tc.secrets),
+				func(line string) { lines = append(lines, line) },
+			)
+			assert.NoError(t, err, "Failed to scan log lines").Fatal()
+
+			assert.DeepEqual(t, lines, tc.wantLines, "Incorrect log lines")
+		})
+	}
+}
+
+func TestScanLogLinesSplitsLongLines(t *testing.T) {
+	const secret = "s3cr3t-value"
+	output := strings.Repeat("0123456789"+secret, 10) + "\nshort line\n"
+
+	var lines []string
+	err := scanLogLines(
+		strings.NewReader(output), 16, newSecretMasker(map[string]string{"A": secret}),
+		func(line string) { lines = append(lines, line) },
+	)
+	assert.NoError(t, err, "Failed to scan log lines").Fatal()
+
+	assert.Equal(t, len(lines) > 2, true, "Long line was not split")
+	assert.Equal(t, lines[len(lines)-1], "short line", "Incorrect last line")
+	assert.Equal(
+		t,
+		strings.Join(lines[:len(lines)-1], ""), strings.Repeat("0123456789***", 10),
+		"Secret spanning a split was not masked",
+	)
+}
+
+func TestRunAndLogMasksSecrets(t *testing.T) {
+	cmd := exec.Command("sh", "-c", `echo "$SECRET"; echo "$SECRET" >&2; printf %s "$SECRET" | base64`)
+	cmd.Env = []string{"SECRET=hunter2-secret"}
+
+	var logs MockLogWriter
+	masker := newSecretMasker(map[string]string{"SECRET": "hunter2-secret"})
+	_, err := runAndLog(cmd, &logs, nil, 0, masker)
+	assert.NoError(t, err, "Failed to run command").Fatal()
+
+	assert.Equal(t, strings.Contains(logs.String(), "hunter2"), false, "Secret not masked in logs")
+	assert.Equal(t, strings.Count(logs.String(), `"text":"***"`), 3, "Missing masked lines")
+}
@@ -0,0 +1,178 @@
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ctbur/ci-server/v2/internal/config"
+)
+
+// plannedCache is a cache of a build with its key computed from the checkout.
+type plannedCache struct {
+	key string
+	// Paths relative to the build dir
+	paths []string
+	// Set if an entry with the exact key was restored, which is not saved again
+	hit bool
+}
+
+// restoreCaches computes the keys of the caches of a build and restores the
+// best matching entries into the build dir. Failing to restore a cache does not
+// fail the build, which then starts without it.
+func (br *Builder) restoreCaches(
+	log *slog.Logger, p BuilderParams, absBuildDir, absCheckoutDir string,
+) ([]plannedCache, error) {
+	// Entries of other branches are not restored, so that builds of the
+	// default branch only use what was built on the default branch
+	refs := []string{p.Ref}
+	if defaultRef := fmt.Sprintf("refs/heads/%s", p.DefaultBranch); defaultRef != p.Ref {
+		refs = append(refs, defaultRef)
+	}
+
+	caches := make([]plannedCache, len(p.Caches))
+	for i, cacheCfg := range p.Caches {
+		key, err := br.cacheKey(p.BuildID, absCheckoutDir, cacheCfg)
+		if err != nil {
+			return nil, err
+		}
+		paths, err := br.cachePaths(p.BuildID, path.Join(p.RepoOwner, p.RepoName), cacheCfg.Paths)
+		if err != nil {
+			return nil, err
+		}
+		caches[i] = plannedCache{key: key, paths: paths}
+
+		entry, err := br.FS.RestoreCache(p.RepoOwner, p.RepoName, refs, key, cacheCfg.RestoreKeys, absBuildDir)
+		if err != nil {
+			log.Error("Failed to restore cache", slog.String("key", key), slog.Any("error", err))
+			if err := br.logCI(p.BuildID, "Failed to restore cache '%s': %s", key, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if entry == nil {
+			if err := br.logCI(p.BuildID, "No cache found for '%s'", key); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		caches[i].hit = entry.Key == key
+		log.Info("Restored cache", slog.String("key", entry.Key), slog.String("ref", entry.Ref))
+		if err := br.logCI(p.BuildID, "Restored cache '%s'", entry.Key); err != nil {
+			return nil, err
+		}
+	}
+
+	return caches, nil
+}
+
+// saveCaches saves the caches of a build that were not restored by their exact
+// key, and evicts the least recently used entries beyond the maximum size.
+func (br *Builder) saveCaches(
+	log *slog.Logger, p BuilderParams, absBuildDir string, caches []plannedCache,
+) error {
+	saved := false
+	for _, cache := range caches {
+		if cache.hit {
+			continue
+		}
+
+		entry, err := br.FS.SaveCache(p.RepoOwner, p.RepoName, p.Ref, cache.key, absBuildDir, cache.paths)
+		if err != nil {
+			log.Error("Failed to save cache", slog.String("key", cache.key), slog.Any("error", err))
+			if err := br.logCI(p.BuildID, "Failed to save cache '%s': %s", cache.key, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if entry == nil {
+			// Saved by another build of the same ref in the meantime
+			continue
+		}
+
+		saved = true
+		log.Info("Saved cache", slog.String("key", entry.Key), slog.Int64("size", entry.Size))
+		if err := br.logCI(p.BuildID, "Saved cache '%s'", entry.Key); err != nil {
+			return err
+		}
+	}
+
+	if saved && p.MaxCacheSize > 0 {
+		// Evicted entries can be of other repos, so they are not mentioned in
+		// the build logs
+		evicted, err := br.FS.EvictCaches(p.MaxCacheSize)
+		if err != nil {
+			log.Error("Failed to evict caches", slog.Any("error", err))
+		}
+		for _, entry := range evicted {
+			log.Info("Evicted cache", slog.String("key", entry.Key), slog.String("ref", entry.Ref))
+		}
+	}
+
+	return nil
+}
+
+// cacheKey returns the key of a cache, which is its name followed by a hash of
+// the names and content of its key files.
+func (br *Builder) cacheKey(buildID uint64, absCheckoutDir string, cacheCfg config.CacheConfig) (string, error) {
+	files, err := br.matchCheckoutFiles(buildID, absCheckoutDir, cacheCfg.KeyFiles, "cache key file")
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	for _, f := range files {
+		_, _ = fmt.Fprintf(h, "%s\x00", f.name)
+		if err := hashFile(h, f.realPath); err != nil {
+			return "", fmt.Errorf("failed to hash cache key file '%s': %w", f.name, err)
+		}
+	}
+
+	return fmt.Sprintf("%s-%s", cacheCfg.Name, hex.EncodeToString(h.Sum(nil))[:16]), nil
+}
+
+func hashFile(w io.Writer, filePath string) error {
+	// sec: Path is checked to be within the checkout dir
+	f, err := os.Open(filePath) // #nosec G304
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Hash the content separately, so that the boundary between files is
+	// unambiguous
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	_, err = w.Write(h.Sum(nil))
+	return err
+}
+
+// cachePaths returns the paths of a cache relative to the build dir. Paths are
+// relative to the checkout dir, unless they are prefixed with "~/".
+func (br *Builder) cachePaths(buildID uint64, checkoutDir string, paths []string) ([]string, error) {
+	var buildDirPaths []string
+	for _, p := range paths {
+		buildDirPath, ok := strings.CutPrefix(p, "~/")
+		if !ok {
+			buildDirPath = path.Join(checkoutDir, p)
+		}
+
+		if !filepath.IsLocal(buildDirPath) {
+			if err := br.logCI(buildID, "Skipping cache path '%s', which is not within the build dir", p); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		buildDirPaths = append(buildDirPaths, buildDirPath)
+	}
+	return buildDirPaths, nil
+}
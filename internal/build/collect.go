@@ -0,0 +1,174 @@
+package build
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/ctbur/ci-server/v2/internal/store"
+)
+
+// Maximum length in bytes of the path of a matched file, which is the limit of
+// the names of artifacts in the database
+const maxCheckoutFileNameLength = 1024
+
+// checkoutFile is a file in the checkout dir that matched a pattern.
+type checkoutFile struct {
+	// Path relative to the checkout dir
+	name string
+	// Absolute path with symlinks resolved
+	realPath string
+}
+
+// matchCheckoutFiles returns the files that match any of the patterns in the
+// checkout dir. Files outside of the checkout dir, e.g. through symlinks, are
+// not matched. Problems with the patterns are pointed out in the build logs,
+// using kind to refer to the files.
+func (br *Builder) matchCheckoutFiles(
+	buildID uint64, absCheckoutDir string, patterns []string, kind string,
+) ([]checkoutFile, error) {
+	realCheckoutDir, err := filepath.EvalSymlinks(absCheckoutDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve checkout dir: %w", err)
+	}
+
+	var files []checkoutFile
+	for _, pattern := range patterns {
+		if !filepath.IsLocal(pattern) {
+			if err := br.logCI(buildID, "Skipping %s pattern '%s', which is not within the checkout dir", kind, pattern); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		matches, err := filepath.Glob(filepath.Join(absCheckoutDir, pattern))
+		if err != nil {
+			if err := br.logCI(buildID, "Invalid %s pattern '%s': %s", kind, pattern, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		matched := 0
+		for _, match := range matches {
+			name, err := filepath.Rel(absCheckoutDir, match)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get %s name: %w", kind, err)
+			}
+			if len(name) > maxCheckoutFileNameLength {
+				if err := br.logCI(buildID, "Skipping %s '%s', whose path is longer than %d bytes", kind, name, maxCheckoutFileNameLength); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if slices.ContainsFunc(files, func(f checkoutFile) bool { return f.name == name }) {
+				matched++
+				continue
+			}
+
+			realPath, err := filepath.EvalSymlinks(match)
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve %s '%s': %w", kind, name, err)
+			}
+			info, err := os.Stat(realPath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to stat %s '%s': %w", kind, name, err)
+			}
+			rel, err := filepath.Rel(realCheckoutDir, realPath)
+			if err != nil || !filepath.IsLocal(rel) || !info.Mode().IsRegular() {
+				// Directories are matched by patterns like "dist/*" and are skipped
+				// silently, anything else is pointed out to the user
+				if !info.IsDir() {
+					if err := br.logCI(buildID, "Skipping %s '%s', which is not a file within the checkout dir", kind, name); err != nil {
+						return nil, err
+					}
+				}
+				continue
+			}
+
+			files = append(files, checkoutFile{name: name, realPath: realPath})
+			matched++
+		}
+
+		if matched == 0 {
+			if err := br.logCI(buildID, "No %ss match '%s'", kind, pattern); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return files, nil
+}
+
+// collectArtifacts copies the files that match any of the patterns from the
+// checkout dir into the artifacts of the build.
+func (br *Builder) collectArtifacts(
+	log *slog.Logger, buildID uint64, absCheckoutDir string, patterns []string,
+) error {
+	if len(patterns) == 0 {
+		return nil
+	}
+
+	files, err := br.matchCheckoutFiles(buildID, absCheckoutDir, patterns, "artifact")
+	if err != nil {
+		return err
+	}
+
+	var artifacts []store.Artifact
+	for _, f := range files {
+		artifact, err := br.FS.StoreArtifact(buildID, f.name, f.realPath)
+		if err != nil {
+			return fmt.Errorf("failed to store artifact '%s': %w", f.name, err)
+		}
+		artifacts = append(artifacts, artifact)
+	}
+
+	if err := br.FS.WriteArtifactList(buildID, artifacts); err != nil {
+		return fmt.Errorf("failed to write artifact list: %w", err)
+	}
+	log.Info("Collected artifacts", slog.Int("count", len(artifacts)))
+	return br.logCI(buildID, "Collected %d artifact(s)", len(artifacts))
+}
+
+// collectTestResults reads the JUnit XML and TAP test reports that match any of
+// the patterns in the checkout dir. Reports that can't be parsed are pointed
+// out in the build logs, but don't fail the build.
+func (br *Builder) collectTestResults(
+	log *slog.Logger, buildID uint64, absCheckoutDir string, patterns []string,
+) error {
+	if len(patterns) == 0 {
+		return nil
+	}
+
+	files, err := br.matchCheckoutFiles(buildID, absCheckoutDir, patterns, "test report")
+	if err != nil {
+		return err
+	}
+
+	var results []store.TestResult
+	for _, f := range files {
+		reportResults, err := readTestReport(f.realPath)
+		if err != nil {
+			if err := br.logCI(buildID, "Failed to read test report '%s': %s", f.name, err); err != nil {
+				return err
+			}
+			continue
+		}
+		results = append(results, reportResults...)
+	}
+
+	if err := br.FS.WriteTestResults(buildID, results); err != nil {
+		return fmt.Errorf("failed to write test results: %w", err)
+	}
+
+	failed := 0
+	for _, r := range results {
+		if r.Status == store.TestStatusFailed {
+			failed++
+		}
+	}
+	log.Info("Collected test results", slog.Int("count", len(results)), slog.Int("failed", failed))
+	return br.logCI(buildID, "Collected %d test result(s), %d failed", len(results), failed)
+}
@@ -3,11 +3,13 @@ package build
 import (
 	"encoding/json"
 	"fmt"
+	"maps"
 	"os"
 	"os/exec"
 	"slices"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/ctbur/ci-server/v2/internal/config"
 	"github.com/ctbur/ci-server/v2/internal/store"
@@ -15,6 +17,18 @@ import (
 
 type BuilderController struct {
 	FS *store.FSStore
+	// Maximum total size of the keyed caches, 0 means no limit
+	MaxCacheSize int64
+	// Receives a value whenever a builder started by this controller exits
+	exited chan struct{}
+}
+
+func NewBuilderController(fs *store.FSStore, maxCacheSize int64) *BuilderController {
+	return &BuilderController{
+		FS:           fs,
+		MaxCacheSize: maxCacheSize,
+		exited:       make(chan struct{}, 1),
+	}
 }
 
 type BuilderParams struct {
@@ -23,12 +37,75 @@ type BuilderParams struct {
 	CacheID             *uint64
 	RepoOwner, RepoName string
 	CommitSHA           string
+	Ref                 string
+	DefaultBranch       string
 	PathEnvVar          string
 	EnvVars             map[string]string
-	BuildCmd            []string
-	BuildSecrets        map[string]string
-	DeployCmd           []string
-	DeploySecrets       map[string]string
+	// Steps run in order until one of them fails
+	Steps           []StepParams
+	PipelineEnabled bool
+	// Secrets that pipeline steps may request
+	PipelineSecrets map[string]string
+	// Limits how long the steps of the pipeline file may run in total
+	PipelineTimeout time.Duration
+	// Glob patterns of the files to keep after the steps ran
+	Artifacts []string
+	// Glob patterns of the test reports to read after the steps ran
+	TestReports []string
+	// Caches to restore before and save after the steps ran
+	Caches       []config.CacheConfig
+	MaxCacheSize int64
+	CopyStrategy store.CopyStrategy
+}
+
+type StepParams struct {
+	Name    string
+	Cmd     []string
+	Secrets map[string]string
+	Timeout time.Duration
+}
+
+// secrets returns all secrets that the builder passes to commands.
+func (p *BuilderParams) secrets() []map[string]string {
+	secrets := []map[string]string{p.PipelineSecrets}
+	for _, step := range p.Steps {
+		secrets = append(secrets, step.Secrets)
+	}
+	return secrets
+}
+
+// jobEnvVars returns the env vars of a build, where the values of a job of a
+// build matrix take precedence over the ones configured for the repo.
+func jobEnvVars(repoEnv, jobEnv map[string]string) map[string]string {
+	if len(jobEnv) == 0 {
+		return repoEnv
+	}
+	envVars := maps.Clone(repoEnv)
+	if envVars == nil {
+		envVars = make(map[string]string)
+	}
+	maps.Copy(envVars, jobEnv)
+	return envVars
+}
+
+// Env vars that make tools print colors although their output is not a
+// terminal
+var forceColorEnvVars = map[string]string{
+	"FORCE_COLOR":    "1",
+	"CLICOLOR_FORCE": "1",
+}
+
+// buildEnvVars returns the env vars of a build. The env vars to force colors
+// are only set if the repo doesn't set them itself.
+func buildEnvVars(repo config.RepoConfig, jobEnv map[string]string) map[string]string {
+	envVars := jobEnvVars(repo.EnvVars, jobEnv)
+	if !repo.ForceColor {
+		return envVars
+	}
+
+	colorEnvVars := maps.Clone(forceColorEnvVars)
+	maps.Copy(colorEnvVars, envVars)
+	return colorEnvVars
 }
 
 // Create a new builder process by starting the same executable as the current
@@ -38,21 +115,48 @@ func (c *BuilderController) Start(
 ) (int, error) {
 
 	params := BuilderParams{
-		DataDir:      c.FS.RootDir,
-		BuildID:      build.ID,
-		CacheID:      build.CacheID,
-		RepoOwner:    repo.Owner,
-		RepoName:     repo.Name,
-		CommitSHA:    build.CommitSHA,
-		PathEnvVar:   os.Getenv("PATH"),
-		EnvVars:      repo.EnvVars,
-		BuildCmd:     repo.BuildCmd,
-		BuildSecrets: repo.BuildSecrets,
+		DataDir:       c.FS.RootDir,
+		BuildID:       build.ID,
+		CacheID:       build.CacheID,
+		RepoOwner:     repo.Owner,
+		RepoName:      repo.Name,
+		CommitSHA:     build.CommitSHA,
+		Ref:           build.Ref,
+		DefaultBranch: repo.DefaultBranch,
+		PathEnvVar:    os.Getenv("PATH"),
+		EnvVars:       buildEnvVars(repo, build.JobEnv),
+		Steps: []StepParams{
+			{
+				Name:    "build",
+				Cmd:     repo.BuildCmd,
+				Secrets: repo.BuildSecrets,
+				Timeout: repo.Timeout.Build,
+			},
+		},
+		PipelineEnabled: repo.Pipeline.Enabled,
+		PipelineTimeout: repo.Timeout.Build,
+		Artifacts:       repo.Artifacts,
+		TestReports:     repo.TestReports,
+		Caches:          repo.Caches,
+		MaxCacheSize:    c.MaxCacheSize,
+		CopyStrategy:    c.FS.CopyStrategy,
 	}
 
+	var deploySecrets map[string]string
 	if runDeploy {
-		params.DeployCmd = repo.DeployCmd
-		params.DeploySecrets = repo.DeploySecrets
+		deploySecrets = repo.DeploySecrets
+		if len(repo.DeployCmd) > 0 {
+			params.Steps = append(params.Steps, StepParams{
+				Name:    "deploy",
+				Cmd:     repo.DeployCmd,
+				Secrets: repo.DeploySecrets,
+				Timeout: repo.Timeout.Deploy,
+			})
+		}
+	}
+
+	if repo.Pipeline.Enabled {
+		params.PipelineSecrets = pipelineSecrets(repo.Pipeline.AllowedSecrets, repo.BuildSecrets, deploySecrets)
 	}
 
 	paramsJSON, err := json.Marshal(&params)
@@ -66,16 +170,23 @@ func (c *BuilderController) Start(
 	}
 
 	// sec: exe is not user defined
-	builderCmd := exec.Command(exe, "builder") // #nosec G204
+	builderCmd := exec.Command(exe, "builder", builderBuildIDArg(build.ID)) // #nosec G204
 	builderCmd.Env = []string{
 		// Pass along PATH variable
 		fmt.Sprintf("PATH=%s", os.Getenv("PATH")),
-		// Add builder params to env var
-		fmt.Sprintf("CI_BUILDER_PARAMS=%s", paramsJSON),
-		// Set build ID separately as it helps with identification of the builder process
-		fmt.Sprintf("CI_BUILDER_BUILD_ID=%d", build.ID),
 	}
 
+	// The params contain secrets, so they are passed through a pipe instead of
+	// the environment, which can be read from /proc/<pid>/environ
+	paramsReader, paramsWriter, err := os.Pipe()
+	if err != nil {
+		return 0, fmt.Errorf("failed to create params pipe: %w", err)
+	}
+	defer paramsReader.Close()
+	defer paramsWriter.Close()
+	// ExtraFiles[0] becomes builderParamsFD in the builder
+	builderCmd.ExtraFiles = []*os.File{paramsReader}
+
 	// Keep builder running independently of server
 	builderCmd.SysProcAttr = &syscall.SysProcAttr{
 		Setpgid: true,
@@ -89,15 +200,69 @@ func (c *BuilderController) Start(
 	builderCmd.Stderr = logWriter
 
 	if err := builderCmd.Start(); err != nil {
+		_ = logWriter.Close()
 		return 0, fmt.Errorf("failed to start builder process: %w", err)
 	}
+	_ = paramsReader.Close()
+
+	_, err = paramsWriter.Write(paramsJSON)
+	if err == nil {
+		err = paramsWriter.Close()
+	}
+	if err != nil {
+		// The builder cannot do anything without its params
+		_ = builderCmd.Process.Kill()
+		_ = builderCmd.Wait()
+		_ = logWriter.Close()
+		return 0, fmt.Errorf("failed to pass params to builder: %w", err)
+	}
+
+	// Reap the builder once it exits and wake up the processor. Builders
+	// started before a server restart are not our children, and are only
+	// noticed by the processor's periodic sweep.
+	go func() {
+		_ = builderCmd.Wait()
+		_ = logWriter.Close()
+
+		select {
+		case c.exited <- struct{}{}:
+		default:
+		}
+	}()
 
 	return builderCmd.Process.Pid, nil
 }
 
-// isBuilderRunning checks if a builder process is still running. The process is
-// identified using PID and build ID in env. This is to protect against PID
-// reuse.
+// pipelineSecrets returns the allowed secrets out of the build and deploy
+// secrets of a build. Deploy secrets are only set for builds that may deploy.
+func pipelineSecrets(allowed []string, buildSecrets, deploySecrets map[string]string) map[string]string {
+	secrets := make(map[string]string)
+	for _, name := range allowed {
+		if value, ok := buildSecrets[name]; ok {
+			secrets[name] = value
+		}
+		if value, ok := deploySecrets[name]; ok {
+			secrets[name] = value
+		}
+	}
+	return secrets
+}
+
+// Exited returns a channel that receives a value whenever a builder started by
+// this controller exits.
+func (c *BuilderController) Exited() <-chan struct{} {
+	return c.exited
+}
+
+// builderBuildIDArg returns the command line argument that identifies the
+// builder process of a build. Unlike the params, it is not secret.
+func builderBuildIDArg(buildID uint64) string {
+	return fmt.Sprintf("--build-id=%d", buildID)
+}
+
+// IsRunning checks if a builder process is still running. The process is
+// identified using PID and build ID in its command line. This is to protect
+// against PID reuse.
 func (c *BuilderController) IsRunning(pid int, buildID uint64) bool {
 	// Check if the process is running
 	process, err := os.FindProcess(pid)
@@ -111,19 +276,24 @@ func (c *BuilderController) IsRunning(pid int, buildID uint64) bool {
 		return false
 	}
 
-	// Check if the BUILD_ID environment variable matches
-	envPath := fmt.Sprintf("/proc/%d/environ", pid)
+	// Check if the build ID argument matches
+	cmdlinePath := fmt.Sprintf("/proc/%d/cmdline", pid)
 	// sec: Path is restricted
-	data, err := os.ReadFile(envPath) // #nosec G304
+	data, err := os.ReadFile(cmdlinePath) // #nosec G304
 	if err != nil {
 		return false
 	}
 
-	envVars := strings.Split(string(data), "\000")
-	buildEnvVar := fmt.Sprintf("CI_BUILDER_BUILD_ID=%d", buildID)
-	if !slices.Contains(envVars, buildEnvVar) {
-		return false
-	}
+	args := strings.Split(string(data), "\000")
+	return slices.Contains(args, builderBuildIDArg(buildID))
+}
 
-	return true
+// Stop kills a builder process together with all processes in its process
+// group. The commands of the build steps run in process groups of their own,
+// see runAndLog, but bwrap runs them with --die-with-parent in a PID namespace,
+// so they are killed once the builder is. The caller must ensure that pid
+// belongs to a builder using IsRunning.
+func (c *BuilderController) Stop(pid int) error {
+	// The builder is the leader of its process group, see Start
+	return syscall.Kill(-pid, syscall.SIGKILL)
 }
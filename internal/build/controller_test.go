@@ -0,0 +1,97 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ctbur/ci-server/v2/internal/assert"
+	"github.com/ctbur/ci-server/v2/internal/config"
+	"github.com/ctbur/ci-server/v2/internal/store"
+)
+
+// TestMain lets the test binary stand in for the builder process, which
+// BuilderController.Start runs as "<executable> builder --build-id=<ID>". The
+// fake builder writes the params it received to its logs.
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == "builder" {
+		p, err := readBuilderParams()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if err := json.NewEncoder(os.Stdout).Encode(&p); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestBuilderControllerPassesParams(t *testing.T) {
+	fs := &store.FSStore{RootDir: t.TempDir()}
+	err := fs.CreateRootDirs()
+	assert.NoError(t, err, "Failed to create root dirs").Fatal()
+
+	// The params are larger than the buffer of the pipe, so they can only be
+	// passed if the builder reads them while they are written
+	largeSecret := strings.Repeat("s", 1<<20)
+	repo := config.RepoConfig{
+		Owner:         "owner",
+		Name:          "repo",
+		DefaultBranch: "main",
+		BuildCmd:      []string{"make"},
+		BuildSecrets:  map[string]string{"TOKEN": largeSecret},
+	}
+	build := store.PendingBuild{ID: 5, Repo: store.Repo{Owner: "owner", Name: "repo"}}
+
+	c := NewBuilderController(fs, 0)
+	pid, err := c.Start(repo, build, false)
+	assert.NoError(t, err, "Failed to start builder").Fatal()
+
+	select {
+	case <-c.Exited():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Builder did not exit")
+	}
+
+	logs, err := fs.ReadBuilderLogs(build.ID)
+	assert.NoError(t, err, "Failed to open builder logs").Fatal()
+	defer logs.Close()
+	logData, err := io.ReadAll(logs)
+	assert.NoError(t, err, "Failed to read builder logs").Fatal()
+
+	var p BuilderParams
+	err = json.Unmarshal(logData, &p)
+	assert.NoError(t, err, "Builder did not receive valid params").Fatal()
+	assert.Equal(t, p.BuildID, build.ID, "Incorrect build ID")
+	assert.Equal(t, p.DataDir, fs.RootDir, "Incorrect data dir")
+	assert.Equal(t, len(p.Steps), 1, "Incorrect number of steps").Fatal()
+	assert.Equal(t, p.Steps[0].Secrets["TOKEN"], largeSecret, "Incorrect secret")
+
+	// The builder has exited
+	assert.Equal(t, c.IsRunning(pid, build.ID), false, "Exited builder is running")
+}
+
+func TestBuilderControllerIsRunning(t *testing.T) {
+	// A process that is still running, like a builder of another build whose
+	// PID was reused
+	cmd := exec.Command("sh", "-c", "sleep 10; exit 0", "builder", builderBuildIDArg(2))
+	err := cmd.Start()
+	assert.NoError(t, err, "Failed to start process").Fatal()
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	c := NewBuilderController(&store.FSStore{}, 0)
+	pid := cmd.Process.Pid
+	assert.Equal(t, c.IsRunning(pid, 2), true, "Builder of build is not running")
+	assert.Equal(t, c.IsRunning(pid, 1), false, "Process with other build ID is running")
+	assert.Equal(t, c.IsRunning(pid, 22), false, "Process with prefix of its build ID argument is running")
+}
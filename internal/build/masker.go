@@ -0,0 +1,194 @@
+package build
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+)
+
+// secretMask replaces secret values in build logs.
+const secretMask = "***"
+
+// minMaskedLength is the minimum length of a value to be masked. Masking
+// shorter values would mostly hide unrelated output.
+const minMaskedLength = 4
+
+// base64LineLength is the line length at which tools like base64 wrap their
+// output.
+const base64LineLength = 76
+
+// secretMasker masks secret values and common encodings of them in log lines.
+type secretMasker struct {
+	// Values to mask, longest first
+	values []string
+}
+
+func newSecretMasker(secretMaps ...map[string]string) *secretMasker {
+	var values []string
+	for _, secrets := range secretMaps {
+		for _, secret := range secrets {
+			values = append(values, maskedValues(secret)...)
+		}
+	}
+
+	values = slices.DeleteFunc(values, func(v string) bool {
+		return len(v) < minMaskedLength
+	})
+	// Prefer the longest match if values overlap
+	slices.SortFunc(values, func(a, b string) int {
+		return len(b) - len(a)
+	})
+	values = slices.Compact(values)
+
+	return &secretMasker{values}
+}
+
+// maskedValues returns the strings that reveal the secret if they show up in a
+// log line.
+func maskedValues(secret string) []string {
+	encodings := []*base64.Encoding{
+		base64.StdEncoding, base64.URLEncoding,
+		base64.RawStdEncoding, base64.RawURLEncoding,
+	}
+
+	values := []string{secret}
+	for _, enc := range encodings {
+		encoded := enc.EncodeToString([]byte(secret))
+		values = append(values, encoded)
+		// Wrapped base64 output ends up on multiple log lines
+		for len(encoded) > base64LineLength {
+			values = append(values, encoded[:base64LineLength])
+			encoded = encoded[base64LineLength:]
+		}
+		values = append(values, encoded)
+	}
+
+	// Multi-line secrets end up on multiple log lines, so mask each line
+	if strings.Contains(secret, "\n") {
+		for line := range strings.SplitSeq(secret, "\n") {
+			values = append(values, strings.TrimSuffix(line, "\r"))
+		}
+	}
+
+	return values
+}
+
+// find returns the sorted, non-overlapping ranges of text to be masked.
+func (m *secretMasker) find(text string) [][2]int {
+	var ranges [][2]int
+	for _, value := range m.values {
+		offset := 0
+		for {
+			i := strings.Index(text[offset:], value)
+			if i < 0 {
+				break
+			}
+			start := offset + i
+			ranges = append(ranges, [2]int{start, start + len(value)})
+			offset = start + 1
+		}
+	}
+
+	slices.SortFunc(ranges, func(a, b [2]int) int {
+		return a[0] - b[0]
+	})
+
+	// Merge overlapping ranges
+	var merged [][2]int
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && r[0] <= merged[n-1][1] {
+			merged[n-1][1] = max(merged[n-1][1], r[1])
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// mask returns text with all secret values replaced.
+func (m *secretMasker) mask(text string) string {
+	masked, _ := m.maskUntil(text, len(text))
+	return masked
+}
+
+// maskPrefix masks a text that is continued by more text, which is not known
+// yet. It returns the masked part of text that is safe to emit, and the rest,
+// which could contain the beginning of a secret and must be prepended to the
+// continuation.
+func (m *secretMasker) maskPrefix(text string) (string, string) {
+	if len(m.values) == 0 {
+		return text, ""
+	}
+	// A secret that starts within the last len-1 characters could continue
+	maxLen := len(m.values[0])
+	return m.maskUntil(text, max(0, len(text)-maxLen+1))
+}
+
+// maskUntil masks text up to cut, which is moved to the front if a secret
+// range spans it. It returns the masked text and the unmasked rest.
+func (m *secretMasker) maskUntil(text string, cut int) (string, string) {
+	ranges := m.find(text)
+	for _, r := range ranges {
+		if r[0] < cut && cut < r[1] {
+			cut = r[0]
+			break
+		}
+	}
+
+	var b strings.Builder
+	pos := 0
+	for _, r := range ranges {
+		if r[1] > cut {
+			break
+		}
+		b.WriteString(text[pos:r[0]])
+		b.WriteString(secretMask)
+		pos = r[1]
+	}
+	b.WriteString(text[pos:cut])
+
+	return b.String(), text[cut:]
+}
+
+// maxLogLineLength is the maximum length of a log entry. Longer lines are split
+// into multiple entries.
+const maxLogLineLength = 64 * 1024
+
+// scanLogLines reads lines from r and calls fn with each masked line. Lines
+// longer than maxLineLength are split, while still masking secrets that span
+// the split.
+func scanLogLines(r io.Reader, maxLineLength int, m *secretMasker, fn func(line string)) error {
+	reader := bufio.NewReaderSize(r, maxLineLength)
+
+	// Unmasked beginning of a long line that is continued in the next chunk
+	carry := ""
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		text := carry + string(chunk)
+		carry = ""
+
+		if errors.Is(err, bufio.ErrBufferFull) {
+			masked, rest := m.maskPrefix(text)
+			if masked != "" {
+				fn(masked)
+			}
+			carry = rest
+			continue
+		}
+
+		if len(text) > 0 {
+			text = strings.TrimSuffix(text, "\n")
+			text = strings.TrimSuffix(text, "\r")
+			fn(m.mask(text))
+		}
+
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
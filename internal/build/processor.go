@@ -2,8 +2,11 @@ package build
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/ctbur/ci-server/v2/internal/config"
@@ -13,30 +16,68 @@ import (
 )
 
 type Processor struct {
-	HostURL string
-	Repos   config.RepoConfigs
-	Builds  buildStore
-	Builder builderController
-	FS      processorFSStore
-	GitHub  commitStatusCreator
+	HostURL             string
+	Repos               config.RepoConfigs
+	MaxConcurrentBuilds int
+	Builds              buildStore
+	Builder             builderController
+	FS                  processorFSStore
+	GitHub              commitStatusCreator
+	Retention           config.RetentionConfig
+	// When the last cleanup ran
+	cleanedUp time.Time
 }
 
 type buildStore interface {
 	GetPendingBuilds(ctx context.Context) ([]store.PendingBuild, error)
 	StartBuild(ctx context.Context, buildID uint64, started time.Time, pid int, cacheID *uint64) error
-	FinishBuild(ctx context.Context, buildID uint64, finished time.Time, result store.BuildResult, cacheBuildFiles bool) error
+	FinishBuild(
+		ctx context.Context,
+		buildID uint64,
+		finished time.Time,
+		result store.BuildResult,
+		cacheBuildFiles bool,
+		output store.BuildOutput,
+	) error
+	CancelBuild(ctx context.Context, buildID uint64, ts time.Time) ([]uint64, error)
+	GetBuild(ctx context.Context, buildID uint64) (*store.Build, error)
 	ListBuilders(ctx context.Context) ([]store.Builder, error)
 	ListBuildDirsInUse(ctx context.Context) ([]uint64, error)
+	DeleteExpiredArtifacts(ctx context.Context, ts time.Time) ([]uint64, error)
+	InsertLogLines(ctx context.Context, buildID uint64, lines []store.LogLine) error
+	DeleteLogLines(ctx context.Context, buildIDs []uint64) error
+	ListBuildRepos(ctx context.Context, buildIDs []uint64) ([]store.BuildRepo, error)
+	ListRepoCaches(ctx context.Context) ([]store.RepoCache, error)
+	DropRepoCache(ctx context.Context, repo store.Repo, cacheID uint64) error
+	PruneBuilds(
+		ctx context.Context, policy store.PrunePolicy, removeFiles func(buildIDs []uint64) []uint64,
+	) ([]uint64, error)
+	ListenForBuildEvents(ctx context.Context, notify chan<- struct{}) error
 }
 
 type builderController interface {
 	Start(repo config.RepoConfig, build store.PendingBuild, runDeploy bool) (int, error)
 	IsRunning(pid int, buildID uint64) bool
+	Stop(pid int) error
+	Exited() <-chan struct{}
 }
 
 type processorFSStore interface {
-	ReadAndCleanExitCode(buildID uint64) (int, error)
+	ReadExitCode(buildID uint64) (int, error)
+	RemoveExitCode(buildID uint64) error
+	ReadBuildSteps(buildID uint64) ([]store.BuildStep, error)
+	RemoveBuildSteps(buildID uint64) error
+	ReadArtifactList(buildID uint64) ([]store.Artifact, error)
+	RemoveArtifactList(buildID uint64) error
+	RemoveArtifacts(buildID uint64) error
+	ReadTestResults(buildID uint64) ([]store.TestResult, error)
+	RemoveTestResults(buildID uint64) error
+	ReadLogs(buildID uint64, fn func(entry store.LogEntry) error) error
 	RetainBuildDirs(retainedIDs []uint64) ([]uint64, error)
+	MeasureBuildFiles() ([]store.BuildFiles, error)
+	RemoveLogs(buildID uint64) error
+	CompressLogs(buildID uint64) error
+	EvictRepoCaches(owner, name string, maxSize int64) ([]store.CacheEntry, error)
 }
 
 type commitStatusCreator interface {
@@ -60,23 +101,59 @@ func NewProcessor(
 	}
 
 	return &Processor{
-		HostURL: cfg.HostURL,
-		Repos:   cfg.Repos,
-		Builds:  db,
-		FS:      fs,
-		Builder: &BuilderController{FS: fs},
-		GitHub:  pgh,
+		HostURL:             cfg.HostURL,
+		Repos:               cfg.Repos,
+		MaxConcurrentBuilds: cfg.MaxConcurrentBuilds,
+		Builds:              db,
+		FS:                  fs,
+		Builder:             NewBuilderController(fs, cfg.MaxCacheSize),
+		GitHub:              pgh,
+		Retention:           cfg.Retention,
 	}
 }
 
-const dispatchPollPeriod = 500 * time.Millisecond
+const (
+	// Period of the sweep that catches anything the wake-ups missed, e.g.
+	// builders that were started before a server restart
+	sweepPeriod = 10 * time.Second
+	// Time to wait before listening again after the connection failed
+	listenRetryPeriod = 5 * time.Second
+	// Period of the cleanup that enforces the quotas and the retention policy.
+	// Measuring the logs walks their dirs, so this is done less often.
+	cleanupPeriod = 10 * time.Minute
+)
 
+// Run processes builds whenever a build is created or canceled, a builder
+// exits, or the sweep period elapses.
 func (p *Processor) Run(ctx context.Context) {
+	wake := make(chan struct{}, 1)
+	go p.listenForBuildEvents(ctx, wake)
+
 	for {
+		p.process(ctx)
+
 		select {
-		case <-time.After(dispatchPollPeriod):
-			p.process(ctx)
+		case <-wake:
+		case <-p.Builder.Exited():
+		case <-time.After(sweepPeriod):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *Processor) listenForBuildEvents(ctx context.Context, wake chan<- struct{}) {
+	log := ctxlog.FromContext(ctx)
+
+	for {
+		err := p.Builds.ListenForBuildEvents(ctx, wake)
+		if ctx.Err() != nil {
+			return
+		}
+		log.ErrorContext(ctx, "Failed to listen for build events", slog.Any("error", err))
 
+		select {
+		case <-time.After(listenRetryPeriod):
 		case <-ctx.Done():
 			return
 		}
@@ -93,15 +170,38 @@ func (p *Processor) process(ctx context.Context) {
 		return
 	}
 
+	// Number of running builds in total and by repo
+	numRunning := 0
+	numRunningByRepo := make(map[store.Repo]int)
+	var stillRunning []store.Builder
+
 	for _, br := range runningBuilders {
 		if p.Builder.IsRunning(br.PID, br.BuildID) {
+			numRunning++
+			numRunningByRepo[br.Repo]++
+			stillRunning = append(stillRunning, br)
+
+			if br.CancelRequested {
+				log.InfoContext(ctx, "Canceling build", slog.Uint64("build_id", br.BuildID))
+				if err := p.Builder.Stop(br.PID); err != nil {
+					log.ErrorContext(
+						ctx, "failed to stop builder",
+						slog.Uint64("build_id", br.BuildID),
+						slog.Any("error", err),
+					)
+				}
+			}
 			continue
 		}
 
 		// Update build result
-		exitCode, err := p.FS.ReadAndCleanExitCode(br.BuildID)
+		exitCode, err := p.FS.ReadExitCode(br.BuildID)
 		var result store.BuildResult
-		if err != nil {
+		if br.CancelRequested {
+			result = store.BuildResultCanceled
+		} else if errors.Is(err, store.ErrBuildTimedOut) {
+			result = store.BuildResultTimeout
+		} else if err != nil {
 			result = store.BuildResultError
 			log.InfoContext(
 				ctx, "Builder error",
@@ -117,8 +217,11 @@ func (p *Processor) process(ctx context.Context) {
 		repo := p.Repos.Get(br.Repo.Owner, br.Repo.Name)
 		cacheBuildFiles := false
 		if repo != nil {
-			// If default branch, move files to cache, delete otherwise
-			cacheBuildFiles = br.Ref == fmt.Sprintf("refs/heads/%s", repo.DefaultBranch)
+			// If default branch, move files to cache, delete otherwise. Only the
+			// first job of a build matrix makes the cache, and repos with keyed
+			// caches don't use the build dir as cache.
+			cacheBuildFiles = br.Ref == fmt.Sprintf("refs/heads/%s", repo.DefaultBranch) &&
+				br.JobIndex <= 1 && len(repo.Caches) == 0
 		} else {
 			log.ErrorContext(
 				ctx, "missing build config",
@@ -126,29 +229,49 @@ func (p *Processor) process(ctx context.Context) {
 				slog.String("repo", br.Repo.Name),
 			)
 		}
-		err = p.Builds.FinishBuild(ctx, br.BuildID, time.Now(), result, cacheBuildFiles)
+
+		finished := time.Now()
+		output := p.readBuildOutput(ctx, br.BuildID, repo, finished)
+
+		err = p.Builds.FinishBuild(ctx, br.BuildID, finished, result, cacheBuildFiles, output)
+		if err != nil {
+			// Output that can't be stored must not keep the build from
+			// finishing, so it is dropped
+			log.ErrorContext(
+				ctx, "failed to finish build with output",
+				slog.Uint64("build_id", br.BuildID),
+				slog.Any("error", err),
+			)
+			err = p.Builds.FinishBuild(ctx, br.BuildID, finished, result, cacheBuildFiles, store.BuildOutput{})
+		}
 		if err != nil {
+			// The exit code is kept, so the next run tries again
 			log.InfoContext(ctx, "failed to finish build", slog.Any("error", err))
 			continue
 		}
+		p.removeBuildOutput(ctx, br.BuildID)
+		p.indexLogs(ctx, br.BuildID)
+
+		if err := p.FS.CompressLogs(br.BuildID); err != nil {
+			// The logs stay readable uncompressed
+			log.ErrorContext(
+				ctx, "failed to compress logs",
+				slog.Uint64("build_id", br.BuildID),
+				slog.Any("error", err),
+			)
+		}
 
 		if p.GitHub != nil {
-			commitState := github.CommitStateError
-			switch result {
-			case store.BuildResultSuccess:
-				commitState = github.CommitStateSuccess
-			case store.BuildResultFailed, store.BuildResultCanceled, store.BuildResultTimeout:
-				commitState = github.CommitStateFailure
-			}
+			commitState, description := finishedCommitStatus(result)
 			err = p.GitHub.CreateCommitStatus(
 				ctx,
 				br.Repo.Owner,
 				br.Repo.Name,
 				br.CommitSHA,
 				commitState,
-				"Build finished",
+				description,
 				fmt.Sprintf("%s/builds/%d", p.HostURL, br.BuildID),
-				"CI",
+				commitStatusContext(br.Job),
 			)
 			if err != nil {
 				log.ErrorContext(
@@ -158,6 +281,9 @@ func (p *Processor) process(ctx context.Context) {
 					slog.Any("error", err),
 				)
 			}
+			if br.ParentID != nil {
+				p.createParentCommitStatus(ctx, *br.ParentID)
+			}
 		}
 
 		log.InfoContext(
@@ -175,10 +301,17 @@ func (p *Processor) process(ctx context.Context) {
 		log.ErrorContext(ctx, "failed to get pending builds", slog.Any("error", err))
 		return
 	}
+	pendingBuilds = p.cancelSupersededBuilds(ctx, pendingBuilds, stillRunning)
 
+	// Pending builds are ordered by creation, so builds are started first in
+	// first out. Builds over the limit stay pending until the next run.
 	for i := range pendingBuilds {
 		b := pendingBuilds[i]
 
+		if p.MaxConcurrentBuilds > 0 && numRunning >= p.MaxConcurrentBuilds {
+			break
+		}
+
 		repo := p.Repos.Get(b.Repo.Owner, b.Repo.Name)
 		if repo == nil {
 			log.ErrorContext(
@@ -189,10 +322,20 @@ func (p *Processor) process(ctx context.Context) {
 			continue
 		}
 
-		// TODO: limit builds by number or resource usage
+		// A repo at its limit must not hold up the builds of other repos
+		if repo.MaxConcurrentBuilds > 0 && numRunningByRepo[b.Repo] >= repo.MaxConcurrentBuilds {
+			continue
+		}
+
+		// Repos with keyed caches start from an empty build dir, even if they
+		// used the build dir as cache before
+		if len(repo.Caches) > 0 {
+			b.CacheID = nil
+		}
 
-		// Don't run deploy if not on default branch
-		runDeploy := b.Ref == fmt.Sprintf("refs/heads/%s", repo.DefaultBranch)
+		// Don't run deploy if not on default branch, and only in the first job
+		// of a build matrix
+		runDeploy := b.Ref == fmt.Sprintf("refs/heads/%s", repo.DefaultBranch) && b.JobIndex <= 1
 		pid, err := p.Builder.Start(*repo, b, runDeploy)
 		if err != nil {
 			log.ErrorContext(
@@ -203,6 +346,8 @@ func (p *Processor) process(ctx context.Context) {
 			)
 			continue
 		}
+		numRunning++
+		numRunningByRepo[b.Repo]++
 
 		// Update start time for build
 		err = p.Builds.StartBuild(ctx, b.ID, time.Now(), pid, b.CacheID)
@@ -224,7 +369,7 @@ func (p *Processor) process(ctx context.Context) {
 				github.CommitStatePending,
 				"Build started",
 				fmt.Sprintf("%s/builds/%d", p.HostURL, b.ID),
-				"CI",
+				commitStatusContext(b.Job),
 			)
 			if err != nil {
 				log.ErrorContext(
@@ -234,6 +379,9 @@ func (p *Processor) process(ctx context.Context) {
 					slog.Any("error", err),
 				)
 			}
+			if b.ParentID != nil {
+				p.createParentCommitStatus(ctx, *b.ParentID)
+			}
 		}
 
 		log.InfoContext(
@@ -258,4 +406,421 @@ func (p *Processor) process(ctx context.Context) {
 	if len(deletedIDs) > 0 {
 		log.InfoContext(ctx, "Deleted unused build dirs", slog.Any("build_ids", deletedIDs))
 	}
+
+	p.deleteExpiredArtifacts(ctx)
+
+	if now := time.Now(); now.Sub(p.cleanedUp) >= cleanupPeriod {
+		p.pruneBuilds(ctx, now)
+		p.enforceQuotas(ctx, now)
+		p.cleanedUp = now
+	}
+}
+
+// deleteExpiredArtifacts deletes artifacts once the retention period of their
+// repo has passed.
+func (p *Processor) deleteExpiredArtifacts(ctx context.Context) {
+	log := ctxlog.FromContext(ctx)
+
+	expiredIDs, err := p.Builds.DeleteExpiredArtifacts(ctx, time.Now())
+	if err != nil {
+		log.ErrorContext(ctx, "Failed to delete expired artifacts", slog.Any("error", err))
+		return
+	}
+
+	for _, id := range expiredIDs {
+		if err := p.FS.RemoveArtifacts(id); err != nil {
+			log.ErrorContext(
+				ctx, "Failed to remove expired artifacts",
+				slog.Uint64("build_id", id),
+				slog.Any("error", err),
+			)
+		}
+	}
+	if len(expiredIDs) > 0 {
+		log.InfoContext(ctx, "Deleted expired artifacts", slog.Any("build_ids", expiredIDs))
+	}
+}
+
+// readBuildOutput reads what the builder recorded about a finished build. The
+// output is only informational, so the build is finished without the parts
+// that can't be read.
+func (p *Processor) readBuildOutput(
+	ctx context.Context, buildID uint64, repo *config.RepoConfig, finished time.Time,
+) store.BuildOutput {
+	log := ctxlog.FromContext(ctx)
+	var output store.BuildOutput
+	var err error
+
+	output.Steps, err = p.FS.ReadBuildSteps(buildID)
+	if err != nil {
+		log.ErrorContext(
+			ctx, "failed to read build steps",
+			slog.Uint64("build_id", buildID),
+			slog.Any("error", err),
+		)
+	}
+
+	output.Artifacts, err = p.FS.ReadArtifactList(buildID)
+	if err != nil {
+		log.ErrorContext(
+			ctx, "failed to read artifacts",
+			slog.Uint64("build_id", buildID),
+			slog.Any("error", err),
+		)
+	}
+	if repo != nil && repo.ArtifactRetention > 0 {
+		expires := finished.Add(repo.ArtifactRetention)
+		for i := range output.Artifacts {
+			output.Artifacts[i].Expires = &expires
+		}
+	}
+
+	output.TestResults, err = p.FS.ReadTestResults(buildID)
+	if err != nil {
+		log.ErrorContext(
+			ctx, "failed to read test results",
+			slog.Uint64("build_id", buildID),
+			slog.Any("error", err),
+		)
+	}
+
+	return output
+}
+
+// indexLogs adds the logs of a finished build to the search index. The logs
+// are read before they are compressed, which is cheaper.
+func (p *Processor) indexLogs(ctx context.Context, buildID uint64) {
+	log := ctxlog.FromContext(ctx)
+
+	lines, err := p.readLogLines(buildID)
+	if err != nil {
+		log.ErrorContext(
+			ctx, "failed to read logs for search",
+			slog.Uint64("build_id", buildID),
+			slog.Any("error", err),
+		)
+	}
+
+	if err := p.Builds.InsertLogLines(ctx, buildID, lines); err != nil {
+		log.ErrorContext(
+			ctx, "failed to index logs",
+			slog.Uint64("build_id", buildID),
+			slog.Any("error", err),
+		)
+	}
+}
+
+// Limits of the log lines of a build that are indexed for search, which keep
+// builds that flood their logs from bloating the index. Postgres can't index
+// more than 1 MB of text per line anyway.
+const (
+	maxIndexedLogLines      = 100_000
+	maxIndexedLogLineLength = 4096
+)
+
+var errIndexedLogLinesLimit = errors.New("limit of indexed log lines reached")
+
+// readLogLines reads the lines of the build logs that are indexed for search.
+// Lines without text are left out. On errors, the lines read up to there are
+// returned.
+func (p *Processor) readLogLines(buildID uint64) ([]store.LogLine, error) {
+	var lines []store.LogLine
+	number := -1
+	err := p.FS.ReadLogs(buildID, func(entry store.LogEntry) error {
+		number++
+		text := store.PlainLogText(entry.Text)
+		if strings.TrimSpace(text) == "" {
+			return nil
+		}
+		if len(lines) == maxIndexedLogLines {
+			return errIndexedLogLinesLimit
+		}
+		if len(text) > maxIndexedLogLineLength {
+			// Drops a character that is cut in half
+			text = strings.ToValidUTF8(text[:maxIndexedLogLineLength], "")
+		}
+		lines = append(lines, store.LogLine{Number: number, Text: text})
+		return nil
+	})
+	if err != nil && !errors.Is(err, errIndexedLogLinesLimit) {
+		return lines, err
+	}
+	return lines, nil
+}
+
+// removeBuildOutput removes the exit code and the files the builder recorded a
+// build in, once the build finished.
+func (p *Processor) removeBuildOutput(ctx context.Context, buildID uint64) {
+	log := ctxlog.FromContext(ctx)
+
+	if err := p.FS.RemoveExitCode(buildID); err != nil {
+		log.ErrorContext(
+			ctx, "failed to remove exit code",
+			slog.Uint64("build_id", buildID),
+			slog.Any("error", err),
+		)
+	}
+	if err := p.FS.RemoveBuildSteps(buildID); err != nil {
+		log.ErrorContext(
+			ctx, "failed to remove build steps",
+			slog.Uint64("build_id", buildID),
+			slog.Any("error", err),
+		)
+	}
+	if err := p.FS.RemoveArtifactList(buildID); err != nil {
+		log.ErrorContext(
+			ctx, "failed to remove artifact list",
+			slog.Uint64("build_id", buildID),
+			slog.Any("error", err),
+		)
+	}
+	if err := p.FS.RemoveTestResults(buildID); err != nil {
+		log.ErrorContext(
+			ctx, "failed to remove test results",
+			slog.Uint64("build_id", buildID),
+			slog.Any("error", err),
+		)
+	}
+}
+
+type refKey struct {
+	Repo store.Repo
+	Ref  string
+}
+
+// groupID returns the ID of the build that a build belongs to, which is the
+// parent for jobs of a build matrix.
+func groupID(buildID uint64, job store.Job) uint64 {
+	if job.ParentID != nil {
+		return *job.ParentID
+	}
+	return buildID
+}
+
+// cancelSupersededBuilds cancels builds for which a newer build of the same
+// repo and ref exists, if configured for the repo. Pending builds are canceled
+// right away, running builds are stopped by a later run of the processor.
+// Jobs of a build matrix are superseded together by the jobs of a newer build.
+// It returns the pending builds that were not canceled.
+func (p *Processor) cancelSupersededBuilds(
+	ctx context.Context, pendingBuilds []store.PendingBuild, runningBuilders []store.Builder,
+) []store.PendingBuild {
+	log := ctxlog.FromContext(ctx)
+
+	latestIDs := make(map[refKey]uint64)
+	for _, b := range pendingBuilds {
+		key := refKey{b.Repo, b.Ref}
+		latestIDs[key] = max(latestIDs[key], groupID(b.ID, b.Job))
+	}
+	for _, br := range runningBuilders {
+		key := refKey{br.Repo, br.Ref}
+		latestIDs[key] = max(latestIDs[key], groupID(br.BuildID, br.Job))
+	}
+
+	for _, br := range runningBuilders {
+		repo := p.Repos.Get(br.Repo.Owner, br.Repo.Name)
+		if repo == nil || !repo.CancelSuperseded || !repo.CancelSupersededRunning {
+			continue
+		}
+		if br.CancelRequested || br.Ref == fmt.Sprintf("refs/heads/%s", repo.DefaultBranch) {
+			continue
+		}
+
+		latestID := latestIDs[refKey{br.Repo, br.Ref}]
+		if latestID == groupID(br.BuildID, br.Job) {
+			continue
+		}
+
+		_, err := p.Builds.CancelBuild(ctx, br.BuildID, time.Now())
+		if err != nil && !errors.Is(err, store.ErrBuildFinished) {
+			log.ErrorContext(
+				ctx, "failed to cancel superseded build",
+				slog.Uint64("build_id", br.BuildID),
+				slog.Any("error", err),
+			)
+			continue
+		}
+
+		log.InfoContext(
+			ctx, "Canceling superseded build",
+			slog.Uint64("build_id", br.BuildID),
+			slog.Uint64("superseded_by", latestID),
+		)
+	}
+
+	var remaining []store.PendingBuild
+	for _, b := range pendingBuilds {
+		repo := p.Repos.Get(b.Repo.Owner, b.Repo.Name)
+		latestID := latestIDs[refKey{b.Repo, b.Ref}]
+		if repo == nil || !repo.CancelSuperseded || latestID == groupID(b.ID, b.Job) {
+			remaining = append(remaining, b)
+			continue
+		}
+
+		_, err := p.Builds.CancelBuild(ctx, b.ID, time.Now())
+		if errors.Is(err, store.ErrBuildFinished) {
+			// Canceled by someone else in the meantime
+			continue
+		} else if err != nil {
+			log.ErrorContext(
+				ctx, "failed to cancel superseded build",
+				slog.Uint64("build_id", b.ID),
+				slog.Any("error", err),
+			)
+			remaining = append(remaining, b)
+			continue
+		}
+
+		if p.GitHub != nil {
+			err = p.GitHub.CreateCommitStatus(
+				ctx,
+				b.Repo.Owner,
+				b.Repo.Name,
+				b.CommitSHA,
+				github.CommitStateFailure,
+				"Build superseded by a newer build",
+				fmt.Sprintf("%s/builds/%d", p.HostURL, latestID),
+				commitStatusContext(b.Job),
+			)
+			if err != nil {
+				log.ErrorContext(
+					ctx,
+					"failed to create superseded commit status",
+					slog.Uint64("build_id", b.ID),
+					slog.Any("error", err),
+				)
+			}
+			if b.ParentID != nil {
+				p.createParentCommitStatus(ctx, *b.ParentID)
+			}
+		}
+
+		log.InfoContext(
+			ctx, "Canceled superseded build",
+			slog.Uint64("build_id", b.ID),
+			slog.Uint64("superseded_by", latestID),
+		)
+	}
+
+	return remaining
+}
+
+// CreateCanceledCommitStatuses updates the commit statuses of builds that were
+// canceled before they started, see store.DBStore.CancelBuild. Builds that were
+// running get theirs once their builder stopped. It is safe to call while the
+// processor runs.
+func (p *Processor) CreateCanceledCommitStatuses(ctx context.Context, buildIDs []uint64) {
+	log := ctxlog.FromContext(ctx)
+
+	if p.GitHub == nil {
+		return
+	}
+
+	var parentIDs []uint64
+	for _, buildID := range buildIDs {
+		b, err := p.Builds.GetBuild(ctx, buildID)
+		if err != nil {
+			log.ErrorContext(
+				ctx, "failed to get canceled build",
+				slog.Uint64("build_id", buildID),
+				slog.Any("error", err),
+			)
+			continue
+		}
+
+		commitState, description := finishedCommitStatus(store.BuildResultCanceled)
+		err = p.GitHub.CreateCommitStatus(
+			ctx,
+			b.Repo.Owner,
+			b.Repo.Name,
+			b.CommitSHA,
+			commitState,
+			description,
+			fmt.Sprintf("%s/builds/%d", p.HostURL, buildID),
+			commitStatusContext(b.Job),
+		)
+		if err != nil {
+			log.ErrorContext(
+				ctx,
+				"failed to create canceled commit status",
+				slog.Uint64("build_id", buildID),
+				slog.Any("error", err),
+			)
+		}
+		if b.ParentID != nil && !slices.Contains(parentIDs, *b.ParentID) {
+			parentIDs = append(parentIDs, *b.ParentID)
+		}
+	}
+
+	// The jobs of a build matrix are canceled together
+	for _, parentID := range parentIDs {
+		p.createParentCommitStatus(ctx, parentID)
+	}
+}
+
+// commitStatusContext returns the context of the commit status of a build.
+// Each job of a build matrix has its own status, in addition to the status of
+// its parent.
+func commitStatusContext(job store.Job) string {
+	if job.ParentID == nil {
+		return "CI"
+	}
+	return fmt.Sprintf("CI / %s", store.JobName(job.JobEnv))
+}
+
+// createParentCommitStatus updates the commit status of a build matrix after
+// one of its jobs started or finished.
+func (p *Processor) createParentCommitStatus(ctx context.Context, parentID uint64) {
+	log := ctxlog.FromContext(ctx)
+
+	parent, err := p.Builds.GetBuild(ctx, parentID)
+	if err != nil {
+		log.ErrorContext(
+			ctx, "failed to get parent build",
+			slog.Uint64("build_id", parentID),
+			slog.Any("error", err),
+		)
+		return
+	}
+
+	commitState, description := github.CommitStatePending, "Build started"
+	if parent.Result != nil {
+		commitState, description = finishedCommitStatus(*parent.Result)
+	}
+
+	err = p.GitHub.CreateCommitStatus(
+		ctx,
+		parent.Repo.Owner,
+		parent.Repo.Name,
+		parent.CommitSHA,
+		commitState,
+		description,
+		fmt.Sprintf("%s/builds/%d", p.HostURL, parentID),
+		"CI",
+	)
+	if err != nil {
+		log.ErrorContext(
+			ctx,
+			"failed to create parent commit status",
+			slog.Uint64("build_id", parentID),
+			slog.Any("error", err),
+		)
+	}
+}
+
+// finishedCommitStatus returns the GitHub commit state and description for a
+// build that finished with the given result.
+func finishedCommitStatus(result store.BuildResult) (github.CommitState, string) {
+	switch result {
+	case store.BuildResultSuccess:
+		return github.CommitStateSuccess, "Build finished"
+	case store.BuildResultFailed:
+		return github.CommitStateFailure, "Build finished"
+	case store.BuildResultCanceled:
+		return github.CommitStateFailure, "Build canceled"
+	case store.BuildResultTimeout:
+		return github.CommitStateFailure, "Build timed out"
+	default:
+		return github.CommitStateError, "Build finished"
+	}
 }
@@ -0,0 +1,834 @@
+package build
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ctbur/ci-server/v2/internal/assert"
+	"github.com/ctbur/ci-server/v2/internal/config"
+	"github.com/ctbur/ci-server/v2/internal/github"
+	"github.com/ctbur/ci-server/v2/internal/store"
+)
+
+type MockBuildStore struct {
+	PendingBuilds []store.PendingBuild
+	Builders      []store.Builder
+	StartedIDs    []uint64
+	CanceledIDs   []uint64
+	Results       map[uint64]store.BuildResult
+	BuildRepos    []store.BuildRepo
+	PrunedIDs     []uint64
+	PrunePolicy   *store.PrunePolicy
+	// Pruned builds that were deleted, since their files were removed
+	DeletedIDs []uint64
+	// Builds whose log lines were deleted from the search index
+	DeletedLogLineIDs []uint64
+	// Log lines indexed for search once builds finished
+	LogLines map[uint64][]store.LogLine
+	// Builds returned by GetBuild
+	Builds map[uint64]store.Build
+	// Output stored for finished builds
+	Outputs map[uint64]store.BuildOutput
+	// If set, finishing builds with test results fails, like for tests with
+	// names that can't be stored
+	RejectTestResults bool
+	// If set, finishing builds fails
+	FinishErr error
+	// Build dirs that repos use as cache
+	RepoCaches []store.RepoCache
+	// Repo caches that were dropped
+	DroppedCaches []store.RepoCache
+}
+
+func (s *MockBuildStore) GetPendingBuilds(ctx context.Context) ([]store.PendingBuild, error) {
+	return s.PendingBuilds, nil
+}
+
+func (s *MockBuildStore) StartBuild(
+	ctx context.Context, buildID uint64, started time.Time, pid int, cacheID *uint64,
+) error {
+	s.StartedIDs = append(s.StartedIDs, buildID)
+	return nil
+}
+
+func (s *MockBuildStore) FinishBuild(
+	ctx context.Context,
+	buildID uint64,
+	finished time.Time,
+	result store.BuildResult,
+	cacheBuildFiles bool,
+	output store.BuildOutput,
+) error {
+	if s.FinishErr != nil {
+		return s.FinishErr
+	}
+	if s.RejectTestResults && len(output.TestResults) > 0 {
+		return errors.New("invalid test name")
+	}
+	s.Results[buildID] = result
+	if s.Outputs == nil {
+		s.Outputs = make(map[uint64]store.BuildOutput)
+	}
+	s.Outputs[buildID] = output
+	return nil
+}
+
+func (s *MockBuildStore) CancelBuild(ctx context.Context, buildID uint64, ts time.Time) ([]uint64, error) {
+	s.CanceledIDs = append(s.CanceledIDs, buildID)
+	return []uint64{buildID}, nil
+}
+
+func (s *MockBuildStore) GetBuild(ctx context.Context, buildID uint64) (*store.Build, error) {
+	b, ok := s.Builds[buildID]
+	if !ok {
+		return nil, store.ErrNoBuild
+	}
+	return &b, nil
+}
+
+func (s *MockBuildStore) ListBuilders(ctx context.Context) ([]store.Builder, error) {
+	return s.Builders, nil
+}
+
+func (s *MockBuildStore) ListBuildDirsInUse(ctx context.Context) ([]uint64, error) {
+	return nil, nil
+}
+
+func (s *MockBuildStore) DeleteExpiredArtifacts(ctx context.Context, ts time.Time) ([]uint64, error) {
+	return nil, nil
+}
+
+func (s *MockBuildStore) InsertLogLines(ctx context.Context, buildID uint64, lines []store.LogLine) error {
+	if s.LogLines == nil {
+		s.LogLines = make(map[uint64][]store.LogLine)
+	}
+	s.LogLines[buildID] = lines
+	return nil
+}
+
+func (s *MockBuildStore) DeleteLogLines(ctx context.Context, buildIDs []uint64) error {
+	s.DeletedLogLineIDs = append(s.DeletedLogLineIDs, buildIDs...)
+	return nil
+}
+
+func (s *MockBuildStore) ListBuildRepos(ctx context.Context, buildIDs []uint64) ([]store.BuildRepo, error) {
+	var builds []store.BuildRepo
+	for _, b := range s.BuildRepos {
+		if slices.Contains(buildIDs, b.BuildID) {
+			builds = append(builds, b)
+		}
+	}
+	return builds, nil
+}
+
+func (s *MockBuildStore) ListRepoCaches(ctx context.Context) ([]store.RepoCache, error) {
+	return s.RepoCaches, nil
+}
+
+func (s *MockBuildStore) DropRepoCache(ctx context.Context, repo store.Repo, cacheID uint64) error {
+	s.DroppedCaches = append(s.DroppedCaches, store.RepoCache{Repo: repo, CacheID: cacheID})
+	return nil
+}
+
+func (s *MockBuildStore) PruneBuilds(
+	ctx context.Context, policy store.PrunePolicy, removeFiles func(buildIDs []uint64) []uint64,
+) ([]uint64, error) {
+	s.PrunePolicy = &policy
+	if policy.DryRun {
+		return s.PrunedIDs, nil
+	}
+	s.DeletedIDs = removeFiles(s.PrunedIDs)
+	return s.DeletedIDs, nil
+}
+
+func (s *MockBuildStore) ListenForBuildEvents(ctx context.Context, notify chan<- struct{}) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+type MockBuilderController struct {
+	RunningIDs  []uint64
+	StoppedIDs  []uint64
+	DeployedIDs []uint64
+}
+
+func (c *MockBuilderController) Start(
+	repo config.RepoConfig, build store.PendingBuild, runDeploy bool,
+) (int, error) {
+	c.RunningIDs = append(c.RunningIDs, build.ID)
+	if runDeploy {
+		c.DeployedIDs = append(c.DeployedIDs, build.ID)
+	}
+	// Use build ID as PID to keep things simple
+	return int(build.ID), nil // #nosec G115
+}
+
+func (c *MockBuilderController) IsRunning(pid int, buildID uint64) bool {
+	return slices.Contains(c.RunningIDs, buildID)
+}
+
+func (c *MockBuilderController) Stop(pid int) error {
+	c.StoppedIDs = append(c.StoppedIDs, uint64(pid)) // #nosec G115
+	return nil
+}
+
+func (c *MockBuilderController) Exited() <-chan struct{} {
+	return nil
+}
+
+type MockProcessorFS struct {
+	ExitCodes        map[uint64]int
+	BuildFiles       []store.BuildFiles
+	RemovedLogIDs    []uint64
+	CompressedLogIDs []uint64
+	EvictedCaches    []store.Repo
+	Logs             map[uint64][]store.LogEntry
+	// Builds whose artifacts can't be removed
+	LockedArtifactIDs []uint64
+	TestResults       map[uint64][]store.TestResult
+}
+
+func (fs *MockProcessorFS) ReadExitCode(buildID uint64) (int, error) {
+	exitCode, ok := fs.ExitCodes[buildID]
+	if !ok {
+		return 0, errors.New("no exit code")
+	}
+	return exitCode, nil
+}
+
+func (fs *MockProcessorFS) RemoveExitCode(buildID uint64) error {
+	delete(fs.ExitCodes, buildID)
+	return nil
+}
+
+func (fs *MockProcessorFS) ReadBuildSteps(buildID uint64) ([]store.BuildStep, error) {
+	return nil, nil
+}
+
+func (fs *MockProcessorFS) RemoveBuildSteps(buildID uint64) error {
+	return nil
+}
+
+func (fs *MockProcessorFS) ReadArtifactList(buildID uint64) ([]store.Artifact, error) {
+	return nil, nil
+}
+
+func (fs *MockProcessorFS) RemoveArtifactList(buildID uint64) error {
+	return nil
+}
+
+func (fs *MockProcessorFS) RemoveArtifacts(buildID uint64) error {
+	if slices.Contains(fs.LockedArtifactIDs, buildID) {
+		return errors.New("permission denied")
+	}
+	return nil
+}
+
+func (fs *MockProcessorFS) ReadTestResults(buildID uint64) ([]store.TestResult, error) {
+	return fs.TestResults[buildID], nil
+}
+
+func (fs *MockProcessorFS) RemoveTestResults(buildID uint64) error {
+	return nil
+}
+
+func (fs *MockProcessorFS) ReadLogs(buildID uint64, fn func(entry store.LogEntry) error) error {
+	for _, entry := range fs.Logs[buildID] {
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *MockProcessorFS) RetainBuildDirs(retainedIDs []uint64) ([]uint64, error) {
+	return nil, nil
+}
+
+func (fs *MockProcessorFS) MeasureBuildFiles() ([]store.BuildFiles, error) {
+	return fs.BuildFiles, nil
+}
+
+func (fs *MockProcessorFS) RemoveLogs(buildID uint64) error {
+	fs.RemovedLogIDs = append(fs.RemovedLogIDs, buildID)
+	return nil
+}
+
+func (fs *MockProcessorFS) CompressLogs(buildID uint64) error {
+	fs.CompressedLogIDs = append(fs.CompressedLogIDs, buildID)
+	return nil
+}
+
+func (fs *MockProcessorFS) EvictRepoCaches(owner, name string, maxSize int64) ([]store.CacheEntry, error) {
+	fs.EvictedCaches = append(fs.EvictedCaches, store.Repo{Owner: owner, Name: name})
+	return nil, nil
+}
+
+// MockCommitStatus is a commit status that was created with
+// MockCommitStatusCreator.
+type MockCommitStatus struct {
+	SHA         string
+	State       github.CommitState
+	Description string
+	TargetURL   string
+	Context     string
+}
+
+type MockCommitStatusCreator struct {
+	Statuses []MockCommitStatus
+}
+
+func (c *MockCommitStatusCreator) CreateCommitStatus(
+	ctx context.Context,
+	owner, repo, sha string,
+	state github.CommitState,
+	description string,
+	targetURL string,
+	contextStr string,
+) error {
+	c.Statuses = append(c.Statuses, MockCommitStatus{
+		SHA:         sha,
+		State:       state,
+		Description: description,
+		TargetURL:   targetURL,
+		Context:     contextStr,
+	})
+	return nil
+}
+
+var (
+	repoA = store.Repo{Owner: "owner", Name: "a"}
+	repoB = store.Repo{Owner: "owner", Name: "b"}
+)
+
+func runningBuilder(buildID uint64, repo store.Repo) store.Builder {
+	// #nosec G115
+	return store.Builder{PID: int(buildID), BuildID: buildID, Repo: repo, Ref: "refs/heads/feature"}
+}
+
+func pendingBuild(buildID uint64, repo store.Repo) store.PendingBuild {
+	return store.PendingBuild{ID: buildID, Repo: repo, Ref: "refs/heads/feature"}
+}
+
+func pendingJob(buildID, parentID uint64, jobIndex int, repo store.Repo) store.PendingBuild {
+	pb := pendingBuild(buildID, repo)
+	pb.Job = store.Job{ParentID: &parentID, JobIndex: jobIndex}
+	return pb
+}
+
+func TestProcessorConcurrencyLimits(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		maxTotal      int
+		maxRepoA      int
+		builders      []store.Builder
+		pendingBuilds []store.PendingBuild
+		wantStarted   []uint64
+	}{
+		{
+			desc: "No limits",
+			pendingBuilds: []store.PendingBuild{
+				pendingBuild(1, repoA), pendingBuild(2, repoA), pendingBuild(3, repoB),
+			},
+			wantStarted: []uint64{1, 2, 3},
+		},
+		{
+			desc:     "Global limit starts oldest builds first",
+			maxTotal: 2,
+			builders: []store.Builder{runningBuilder(1, repoB)},
+			pendingBuilds: []store.PendingBuild{
+				pendingBuild(2, repoA), pendingBuild(3, repoB), pendingBuild(4, repoA),
+			},
+			wantStarted: []uint64{2},
+		},
+		{
+			desc:     "Global limit reached",
+			maxTotal: 1,
+			builders: []store.Builder{runningBuilder(1, repoB)},
+			pendingBuilds: []store.PendingBuild{
+				pendingBuild(2, repoA),
+			},
+			wantStarted: nil,
+		},
+		{
+			desc:     "Repo limit does not block other repos",
+			maxRepoA: 1,
+			builders: []store.Builder{runningBuilder(1, repoA)},
+			pendingBuilds: []store.PendingBuild{
+				pendingBuild(2, repoA), pendingBuild(3, repoB), pendingBuild(4, repoA),
+			},
+			wantStarted: []uint64{3},
+		},
+		{
+			desc:     "Repo limit applies to newly started builds",
+			maxRepoA: 2,
+			pendingBuilds: []store.PendingBuild{
+				pendingBuild(1, repoA), pendingBuild(2, repoA), pendingBuild(3, repoA),
+			},
+			wantStarted: []uint64{1, 2},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			db := MockBuildStore{
+				PendingBuilds: tc.pendingBuilds,
+				Builders:      tc.builders,
+				Results:       make(map[uint64]store.BuildResult),
+			}
+			builder := MockBuilderController{}
+			for _, br := range tc.builders {
+				builder.RunningIDs = append(builder.RunningIDs, br.BuildID)
+			}
+
+			p := Processor{
+				Repos: config.RepoConfigs{
+					{Owner: repoA.Owner, Name: repoA.Name, MaxConcurrentBuilds: tc.maxRepoA},
+					{Owner: repoB.Owner, Name: repoB.Name},
+				},
+				MaxConcurrentBuilds: tc.maxTotal,
+				Builds:              &db,
+				Builder:             &builder,
+				FS:                  &MockProcessorFS{},
+			}
+
+			p.process(context.Background())
+
+			assert.DeepEqual(t, db.StartedIDs, tc.wantStarted, "Incorrect builds started")
+		})
+	}
+}
+
+func TestProcessorCancelSuperseded(t *testing.T) {
+	onRef := func(ref string, pb store.PendingBuild) store.PendingBuild {
+		pb.Ref = ref
+		return pb
+	}
+
+	testCases := []struct {
+		desc          string
+		cancelRunning bool
+		builders      []store.Builder
+		pendingBuilds []store.PendingBuild
+		wantCanceled  []uint64
+		wantStarted   []uint64
+	}{
+		{
+			desc: "Only latest pending build per ref is started",
+			pendingBuilds: []store.PendingBuild{
+				pendingBuild(1, repoA),
+				pendingBuild(2, repoA),
+				onRef("refs/heads/other", pendingBuild(3, repoA)),
+				pendingBuild(4, repoA),
+				pendingBuild(5, repoB),
+				pendingBuild(6, repoB),
+			},
+			wantCanceled: []uint64{1, 2},
+			// Repo B is not configured to cancel superseded builds
+			wantStarted: []uint64{3, 4, 5, 6},
+		},
+		{
+			desc:     "Running builds are not canceled by default",
+			builders: []store.Builder{runningBuilder(1, repoA)},
+			pendingBuilds: []store.PendingBuild{
+				pendingBuild(2, repoA),
+			},
+			wantCanceled: nil,
+			wantStarted:  []uint64{2},
+		},
+		{
+			desc:          "Running builds are canceled if configured",
+			cancelRunning: true,
+			builders:      []store.Builder{runningBuilder(1, repoA)},
+			pendingBuilds: []store.PendingBuild{
+				pendingBuild(2, repoA),
+			},
+			wantCanceled: []uint64{1},
+			wantStarted:  []uint64{2},
+		},
+		{
+			desc:          "Running builds on the default branch are not canceled",
+			cancelRunning: true,
+			builders: []store.Builder{
+				{PID: 1, BuildID: 1, Repo: repoA, Ref: "refs/heads/main"},
+			},
+			pendingBuilds: []store.PendingBuild{
+				onRef("refs/heads/main", pendingBuild(2, repoA)),
+			},
+			wantCanceled: nil,
+			wantStarted:  []uint64{2},
+		},
+		{
+			desc: "Jobs are superseded by the jobs of a newer build",
+			pendingBuilds: []store.PendingBuild{
+				pendingJob(2, 1, 1, repoA),
+				pendingJob(3, 1, 2, repoA),
+				pendingJob(5, 4, 1, repoA),
+				pendingJob(6, 4, 2, repoA),
+			},
+			wantCanceled: []uint64{2, 3},
+			wantStarted:  []uint64{5, 6},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			db := MockBuildStore{
+				PendingBuilds: tc.pendingBuilds,
+				Builders:      tc.builders,
+				Results:       make(map[uint64]store.BuildResult),
+			}
+			builder := MockBuilderController{}
+			for _, br := range tc.builders {
+				builder.RunningIDs = append(builder.RunningIDs, br.BuildID)
+			}
+
+			p := Processor{
+				Repos: config.RepoConfigs{
+					{
+						Owner:                   repoA.Owner,
+						Name:                    repoA.Name,
+						DefaultBranch:           "main",
+						CancelSuperseded:        true,
+						CancelSupersededRunning: tc.cancelRunning,
+					},
+					{Owner: repoB.Owner, Name: repoB.Name, DefaultBranch: "main"},
+				},
+				Builds:  &db,
+				Builder: &builder,
+				FS:      &MockProcessorFS{},
+			}
+
+			p.process(context.Background())
+
+			assert.DeepEqual(t, db.CanceledIDs, tc.wantCanceled, "Incorrect builds canceled")
+			assert.DeepEqual(t, db.StartedIDs, tc.wantStarted, "Incorrect builds started")
+		})
+	}
+}
+
+func TestProcessorDeploysFirstJob(t *testing.T) {
+	onMain := func(pb store.PendingBuild) store.PendingBuild {
+		pb.Ref = "refs/heads/main"
+		return pb
+	}
+
+	db := MockBuildStore{
+		PendingBuilds: []store.PendingBuild{
+			onMain(pendingJob(2, 1, 1, repoA)),
+			onMain(pendingJob(3, 1, 2, repoA)),
+			pendingJob(5, 4, 1, repoA),
+		},
+		Results: make(map[uint64]store.BuildResult),
+	}
+	builder := MockBuilderController{}
+
+	p := Processor{
+		Repos: config.RepoConfigs{
+			{Owner: repoA.Owner, Name: repoA.Name, DefaultBranch: "main"},
+		},
+		Builds:  &db,
+		Builder: &builder,
+		FS:      &MockProcessorFS{},
+	}
+
+	p.process(context.Background())
+
+	assert.DeepEqual(t, db.StartedIDs, []uint64{2, 3, 5}, "Incorrect builds started")
+	assert.DeepEqual(t, builder.DeployedIDs, []uint64{2}, "Incorrect builds deployed")
+}
+
+func TestProcessorQuotas(t *testing.T) {
+	now := time.Date(2025, 1, 31, 0, 0, 0, 0, time.UTC)
+	finishedAt := func(buildID uint64, repo store.Repo, daysAgo int) store.BuildRepo {
+		finished := now.AddDate(0, 0, -daysAgo)
+		return store.BuildRepo{BuildID: buildID, Repo: repo, Finished: &finished}
+	}
+
+	db := MockBuildStore{
+		BuildRepos: []store.BuildRepo{
+			// Repo A keeps logs for 10 days
+			finishedAt(1, repoA, 20),
+			finishedAt(2, repoA, 5),
+			{BuildID: 3, Repo: repoA},
+			// Repo B keeps 200 bytes of logs, including those of running builds
+			finishedAt(4, repoB, 3),
+			finishedAt(5, repoB, 2),
+			finishedAt(6, repoB, 1),
+			{BuildID: 7, Repo: repoB},
+		},
+		RepoCaches: []store.RepoCache{
+			// Repo A caches at most 1000 bytes
+			{Repo: repoA, CacheID: 9},
+			// Repo B has no cache quota
+			{Repo: repoB, CacheID: 10},
+		},
+	}
+	fs := MockProcessorFS{
+		BuildFiles: []store.BuildFiles{
+			{BuildID: 1, BuildLogs: 100, BuilderLogs: 10},
+			{BuildID: 2, BuildLogs: 100, BuilderLogs: 10},
+			{BuildID: 3, BuildLogs: 100},
+			{BuildID: 4, BuildLogs: 100},
+			{BuildID: 5, BuildLogs: 100},
+			{BuildID: 6, BuildLogs: 100},
+			{BuildID: 7, BuildLogs: 50},
+			// Build dirs don't count towards the log size
+			{BuildID: 8, BuildDir: 1000},
+			{BuildID: 9, BuildDir: 1001},
+			{BuildID: 10, BuildDir: 5000},
+		},
+	}
+
+	p := Processor{
+		Repos: config.RepoConfigs{
+			{
+				Owner: repoA.Owner, Name: repoA.Name,
+				Quota: config.QuotaConfig{MaxLogAge: 10 * 24 * time.Hour, MaxCacheSize: 1000},
+			},
+			{
+				Owner: repoB.Owner, Name: repoB.Name,
+				Quota: config.QuotaConfig{MaxLogSize: 200},
+			},
+		},
+		Builds: &db,
+		FS:     &fs,
+	}
+
+	p.enforceQuotas(context.Background(), now)
+
+	slices.Sort(fs.RemovedLogIDs)
+	assert.DeepEqual(t, fs.RemovedLogIDs, []uint64{1, 4, 5}, "Incorrect logs removed")
+	slices.Sort(db.DeletedLogLineIDs)
+	assert.DeepEqual(t, db.DeletedLogLineIDs, []uint64{1, 4, 5}, "Incorrect log lines deleted")
+	assert.DeepEqual(t, fs.EvictedCaches, []store.Repo{repoA}, "Incorrect caches evicted")
+	assert.DeepEqual(t, db.DroppedCaches, []store.RepoCache{{Repo: repoA, CacheID: 9}}, "Incorrect cache build dirs dropped")
+}
+
+func TestProcessorPruneBuilds(t *testing.T) {
+	now := time.Date(2025, 1, 31, 0, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		desc        string
+		retention   config.RetentionConfig
+		lockedIDs   []uint64
+		wantPolicy  *store.PrunePolicy
+		wantRemoved []uint64
+		wantDeleted []uint64
+	}{
+		{
+			desc:      "Disabled",
+			retention: config.RetentionConfig{DryRun: true},
+		},
+		{
+			desc:      "Keep builds",
+			retention: config.RetentionConfig{KeepBuilds: 10},
+			wantPolicy: &store.PrunePolicy{
+				KeepBuilds:  10,
+				KeepAfter:   now,
+				DefaultRefs: map[store.Repo]string{repoA: "refs/heads/main"},
+			},
+			wantRemoved: []uint64{3, 4},
+			wantDeleted: []uint64{3, 4},
+		},
+		{
+			desc:      "Files not removed",
+			retention: config.RetentionConfig{KeepBuilds: 10},
+			lockedIDs: []uint64{3},
+			wantPolicy: &store.PrunePolicy{
+				KeepBuilds:  10,
+				KeepAfter:   now,
+				DefaultRefs: map[store.Repo]string{repoA: "refs/heads/main"},
+			},
+			// Build 3 is kept and pruned again by the next run
+			wantRemoved: []uint64{3, 4},
+			wantDeleted: []uint64{4},
+		},
+		{
+			desc:      "Dry run",
+			retention: config.RetentionConfig{KeepFor: 24 * time.Hour, DryRun: true},
+			wantPolicy: &store.PrunePolicy{
+				KeepAfter:   now.Add(-24 * time.Hour),
+				DefaultRefs: map[store.Repo]string{repoA: "refs/heads/main"},
+				DryRun:      true,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			db := MockBuildStore{PrunedIDs: []uint64{3, 4}}
+			fs := MockProcessorFS{LockedArtifactIDs: tc.lockedIDs}
+			p := Processor{
+				Repos: config.RepoConfigs{
+					{Owner: repoA.Owner, Name: repoA.Name, DefaultBranch: "main"},
+				},
+				Builds:    &db,
+				FS:        &fs,
+				Retention: tc.retention,
+			}
+
+			p.pruneBuilds(context.Background(), now)
+
+			assert.DeepEqual(t, db.PrunePolicy, tc.wantPolicy, "Incorrect prune policy")
+			assert.DeepEqual(t, fs.RemovedLogIDs, tc.wantRemoved, "Incorrect logs removed")
+			assert.DeepEqual(t, db.DeletedIDs, tc.wantDeleted, "Incorrect builds deleted")
+		})
+	}
+}
+
+func TestProcessorCompressesLogs(t *testing.T) {
+	db := MockBuildStore{
+		Builders: []store.Builder{runningBuilder(1, repoA), runningBuilder(2, repoA)},
+		Results:  make(map[uint64]store.BuildResult),
+	}
+	// Only build 2 is still running
+	builder := MockBuilderController{RunningIDs: []uint64{2}}
+	fs := MockProcessorFS{ExitCodes: map[uint64]int{1: 0}}
+
+	p := Processor{
+		Repos:   config.RepoConfigs{{Owner: repoA.Owner, Name: repoA.Name, DefaultBranch: "main"}},
+		Builds:  &db,
+		Builder: &builder,
+		FS:      &fs,
+	}
+
+	p.process(context.Background())
+
+	assert.DeepEqual(t, db.Results, map[uint64]store.BuildResult{1: store.BuildResultSuccess}, "Incorrect results")
+	assert.DeepEqual(t, fs.CompressedLogIDs, []uint64{1}, "Incorrect logs compressed")
+}
+
+func TestProcessorFinishesBuildWithoutOutput(t *testing.T) {
+	db := MockBuildStore{
+		Builders:          []store.Builder{runningBuilder(1, repoA)},
+		Results:           make(map[uint64]store.BuildResult),
+		RejectTestResults: true,
+	}
+	builder := MockBuilderController{}
+	fs := MockProcessorFS{
+		ExitCodes:   map[uint64]int{1: 1},
+		TestResults: map[uint64][]store.TestResult{1: {{Name: "test", Status: store.TestStatusFailed}}},
+	}
+
+	p := Processor{
+		Repos:   config.RepoConfigs{{Owner: repoA.Owner, Name: repoA.Name, DefaultBranch: "main"}},
+		Builds:  &db,
+		Builder: &builder,
+		FS:      &fs,
+	}
+
+	p.process(context.Background())
+
+	// The build finishes with its result, but without the output that can't be
+	// stored
+	assert.DeepEqual(t, db.Results, map[uint64]store.BuildResult{1: store.BuildResultFailed}, "Incorrect results")
+	assert.DeepEqual(t, db.Outputs, map[uint64]store.BuildOutput{1: {}}, "Incorrect output stored")
+	assert.Equal(t, len(fs.ExitCodes), 0, "Exit code was not removed")
+}
+
+func TestProcessorKeepsExitCodeOfUnfinishedBuild(t *testing.T) {
+	db := MockBuildStore{
+		Builders:  []store.Builder{runningBuilder(1, repoA)},
+		Results:   make(map[uint64]store.BuildResult),
+		FinishErr: errors.New("connection refused"),
+	}
+	builder := MockBuilderController{}
+	fs := MockProcessorFS{ExitCodes: map[uint64]int{1: 0}}
+
+	p := Processor{
+		Repos:   config.RepoConfigs{{Owner: repoA.Owner, Name: repoA.Name, DefaultBranch: "main"}},
+		Builds:  &db,
+		Builder: &builder,
+		FS:      &fs,
+	}
+
+	p.process(context.Background())
+	assert.Equal(t, len(db.Results), 0, "Build finished")
+
+	// The next run finishes the build with its exit code
+	db.FinishErr = nil
+	p.process(context.Background())
+	assert.DeepEqual(t, db.Results, map[uint64]store.BuildResult{1: store.BuildResultSuccess}, "Incorrect results")
+}
+
+func TestProcessorIndexesLogs(t *testing.T) {
+	db := MockBuildStore{
+		Builders: []store.Builder{runningBuilder(1, repoA)},
+		Results:  make(map[uint64]store.BuildResult),
+	}
+	builder := MockBuilderController{}
+	fs := MockProcessorFS{
+		ExitCodes: map[uint64]int{1: 1},
+		Logs: map[uint64][]store.LogEntry{
+			1: {
+				{Text: "go test ./..."},
+				{Text: ""},
+				{Text: "\x1b[31mpanic:\x1b[0m connection refused"},
+				{Text: "  \x1b[0m"},
+				{Text: "FAIL"},
+			},
+		},
+	}
+
+	p := Processor{
+		Repos:   config.RepoConfigs{{Owner: repoA.Owner, Name: repoA.Name, DefaultBranch: "main"}},
+		Builds:  &db,
+		Builder: &builder,
+		FS:      &fs,
+	}
+
+	p.process(context.Background())
+
+	// Empty lines are left out, but keep the numbers of the lines
+	assert.DeepEqual(t,
+		db.LogLines[1],
+		[]store.LogLine{
+			{Number: 0, Text: "go test ./..."},
+			{Number: 2, Text: "panic: connection refused"},
+			{Number: 4, Text: "FAIL"},
+		},
+		"Incorrect log lines indexed",
+	)
+}
+
+func TestProcessorCreatesCanceledCommitStatuses(t *testing.T) {
+	parentID := uint64(1)
+	canceled := store.BuildResultCanceled
+	db := MockBuildStore{
+		Builds: map[uint64]store.Build{
+			1: {ID: 1, Repo: repoA, BuildMeta: store.BuildMeta{CommitSHA: "c1"}, Job: store.Job{JobCount: 2}},
+			2: {
+				ID: 2, Repo: repoA, Result: &canceled, BuildMeta: store.BuildMeta{CommitSHA: "c1"},
+				Job: store.Job{ParentID: &parentID, JobIndex: 1, JobEnv: map[string]string{"GO": "1.24"}},
+			},
+			3: {
+				ID: 3, Repo: repoA, Result: &canceled, BuildMeta: store.BuildMeta{CommitSHA: "c1"},
+				Job: store.Job{ParentID: &parentID, JobIndex: 2, JobEnv: map[string]string{"GO": "1.25"}},
+			},
+			4: {ID: 4, Repo: repoB, Result: &canceled, BuildMeta: store.BuildMeta{CommitSHA: "c4"}},
+		},
+	}
+	gh := MockCommitStatusCreator{}
+
+	p := Processor{
+		HostURL: "https://ci.example.com",
+		Builds:  &db,
+		GitHub:  &gh,
+	}
+
+	p.CreateCanceledCommitStatuses(context.Background(), []uint64{2, 3, 4})
+
+	// The status of the parent is updated once for both of its jobs
+	assert.DeepEqual(t,
+		gh.Statuses,
+		[]MockCommitStatus{
+			{"c1", github.CommitStateFailure, "Build canceled", "https://ci.example.com/builds/2", "CI / GO=1.24"},
+			{"c1", github.CommitStateFailure, "Build canceled", "https://ci.example.com/builds/3", "CI / GO=1.25"},
+			{"c4", github.CommitStateFailure, "Build canceled", "https://ci.example.com/builds/4", "CI"},
+			{"c1", github.CommitStatePending, "Build started", "https://ci.example.com/builds/1", "CI"},
+		},
+		"Incorrect commit statuses",
+	)
+}
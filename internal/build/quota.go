@@ -0,0 +1,173 @@
+package build
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/ctbur/ci-server/v2/internal/config"
+	"github.com/ctbur/ci-server/v2/internal/ctxlog"
+	"github.com/ctbur/ci-server/v2/internal/store"
+)
+
+// enforceQuotas deletes the data of repos that exceed their quotas, oldest
+// first.
+func (p *Processor) enforceQuotas(ctx context.Context, now time.Time) {
+	log := ctxlog.FromContext(ctx)
+
+	for _, repo := range p.Repos {
+		if repo.Quota.MaxCacheSize <= 0 {
+			continue
+		}
+
+		evicted, err := p.FS.EvictRepoCaches(repo.Owner, repo.Name, repo.Quota.MaxCacheSize)
+		if err != nil {
+			log.ErrorContext(
+				ctx, "Failed to evict caches",
+				slog.String("owner", repo.Owner),
+				slog.String("repo", repo.Name),
+				slog.Any("error", err),
+			)
+		}
+		for _, entry := range evicted {
+			log.InfoContext(
+				ctx, "Evicted cache",
+				slog.String("owner", repo.Owner),
+				slog.String("repo", repo.Name),
+				slog.String("key", entry.Key),
+			)
+		}
+	}
+
+	if !slices.ContainsFunc(p.Repos, func(r config.RepoConfig) bool {
+		return r.Quota.MaxCacheSize > 0 || r.Quota.MaxLogAge > 0 || r.Quota.MaxLogSize > 0
+	}) {
+		return
+	}
+
+	files, err := p.FS.MeasureBuildFiles()
+	if err != nil {
+		// Enforce the quotas with the files that could be measured
+		log.ErrorContext(ctx, "Failed to measure build files", slog.Any("error", err))
+	}
+
+	p.enforceCacheDirQuotas(ctx, files)
+	if slices.ContainsFunc(p.Repos, func(r config.RepoConfig) bool {
+		return r.Quota.MaxLogAge > 0 || r.Quota.MaxLogSize > 0
+	}) {
+		p.enforceLogQuotas(ctx, now, files)
+	}
+}
+
+// enforceCacheDirQuotas drops the build dirs that repos use as cache if they
+// are larger than the maximum cache size of their repo. The next successful
+// build of the default branch becomes the cache again.
+func (p *Processor) enforceCacheDirQuotas(ctx context.Context, files []store.BuildFiles) {
+	log := ctxlog.FromContext(ctx)
+
+	caches, err := p.Builds.ListRepoCaches(ctx)
+	if err != nil {
+		log.ErrorContext(ctx, "Failed to list repo caches", slog.Any("error", err))
+		return
+	}
+
+	dirSizes := make(map[uint64]int64)
+	for _, f := range files {
+		dirSizes[f.BuildID] = f.BuildDir
+	}
+
+	for _, c := range caches {
+		repo := p.Repos.Get(c.Repo.Owner, c.Repo.Name)
+		if repo == nil || repo.Quota.MaxCacheSize <= 0 || dirSizes[c.CacheID] <= repo.Quota.MaxCacheSize {
+			continue
+		}
+
+		// The build dir is removed once no builder copies it anymore
+		if err := p.Builds.DropRepoCache(ctx, c.Repo, c.CacheID); err != nil {
+			log.ErrorContext(
+				ctx, "Failed to drop cache build dir",
+				slog.Uint64("build_id", c.CacheID),
+				slog.Any("error", err),
+			)
+			continue
+		}
+		log.InfoContext(
+			ctx, "Dropped cache build dir over quota",
+			slog.String("owner", c.Repo.Owner),
+			slog.String("repo", c.Repo.Name),
+			slog.Uint64("build_id", c.CacheID),
+		)
+	}
+}
+
+// enforceLogQuotas deletes the logs of finished builds that are older than the
+// maximum log age of their repo, and the logs of the oldest builds of repos
+// whose logs exceed the maximum size.
+func (p *Processor) enforceLogQuotas(ctx context.Context, now time.Time, files []store.BuildFiles) {
+	log := ctxlog.FromContext(ctx)
+
+	logSizes := make(map[uint64]int64)
+	var buildIDs []uint64
+	for _, f := range files {
+		if f.Logs() > 0 {
+			logSizes[f.BuildID] = f.Logs()
+			buildIDs = append(buildIDs, f.BuildID)
+		}
+	}
+	if len(buildIDs) == 0 {
+		return
+	}
+
+	builds, err := p.Builds.ListBuildRepos(ctx, buildIDs)
+	if err != nil {
+		log.ErrorContext(ctx, "Failed to list repos of builds", slog.Any("error", err))
+		return
+	}
+
+	repoLogSizes := make(map[store.Repo]int64)
+	var finished []store.BuildRepo
+	for _, b := range builds {
+		repoLogSizes[b.Repo] += logSizes[b.BuildID]
+		if b.Finished != nil {
+			finished = append(finished, b)
+		}
+	}
+	slices.SortStableFunc(finished, func(a, b store.BuildRepo) int {
+		return a.Finished.Compare(*b.Finished)
+	})
+
+	var deletedIDs []uint64
+	for _, b := range finished {
+		repo := p.Repos.Get(b.Repo.Owner, b.Repo.Name)
+		if repo == nil {
+			continue
+		}
+
+		expired := repo.Quota.MaxLogAge > 0 && now.Sub(*b.Finished) > repo.Quota.MaxLogAge
+		overSize := repo.Quota.MaxLogSize > 0 && repoLogSizes[b.Repo] > repo.Quota.MaxLogSize
+		if !expired && !overSize {
+			continue
+		}
+
+		if err := p.FS.RemoveLogs(b.BuildID); err != nil {
+			log.ErrorContext(
+				ctx, "Failed to remove logs",
+				slog.Uint64("build_id", b.BuildID),
+				slog.Any("error", err),
+			)
+			continue
+		}
+		repoLogSizes[b.Repo] -= logSizes[b.BuildID]
+		deletedIDs = append(deletedIDs, b.BuildID)
+	}
+
+	if len(deletedIDs) > 0 {
+		log.InfoContext(ctx, "Deleted logs over quota", slog.Any("build_ids", deletedIDs))
+
+		// Don't find the logs in searches anymore
+		if err := p.Builds.DeleteLogLines(ctx, deletedIDs); err != nil {
+			log.ErrorContext(ctx, "Failed to delete log lines", slog.Any("error", err))
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package build
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/ctbur/ci-server/v2/internal/ctxlog"
+	"github.com/ctbur/ci-server/v2/internal/store"
+)
+
+// pruneBuilds deletes the builds that are not kept by the retention policy,
+// together with their logs and artifacts. In dry-run mode, it only logs which
+// builds would be deleted.
+func (p *Processor) pruneBuilds(ctx context.Context, now time.Time) {
+	log := ctxlog.FromContext(ctx)
+
+	if !p.Retention.Enabled() {
+		return
+	}
+
+	policy := store.PrunePolicy{
+		KeepBuilds:  p.Retention.KeepBuilds,
+		KeepAfter:   now.Add(-p.Retention.KeepFor),
+		DefaultRefs: make(map[store.Repo]string),
+		DryRun:      p.Retention.DryRun,
+	}
+	for _, repo := range p.Repos {
+		policy.DefaultRefs[store.Repo{Owner: repo.Owner, Name: repo.Name}] =
+			fmt.Sprintf("refs/heads/%s", repo.DefaultBranch)
+	}
+
+	buildIDs, err := p.Builds.PruneBuilds(ctx, policy, func(buildIDs []uint64) []uint64 {
+		return p.removeBuildFiles(ctx, buildIDs)
+	})
+	if err != nil {
+		log.ErrorContext(ctx, "Failed to prune builds", slog.Any("error", err))
+		return
+	}
+	if len(buildIDs) == 0 {
+		return
+	}
+
+	if p.Retention.DryRun {
+		log.InfoContext(ctx, "Would prune builds (dry run)", slog.Any("build_ids", buildIDs))
+	} else {
+		log.InfoContext(ctx, "Pruned builds", slog.Any("build_ids", buildIDs))
+	}
+}
+
+// removeBuildFiles removes the logs and artifacts of builds, and returns the
+// IDs of the builds whose files were removed. Their build dirs are removed once
+// they are no longer in use.
+func (p *Processor) removeBuildFiles(ctx context.Context, buildIDs []uint64) []uint64 {
+	log := ctxlog.FromContext(ctx)
+
+	var removedIDs []uint64
+	for _, id := range buildIDs {
+		err := errors.Join(p.FS.RemoveLogs(id), p.FS.RemoveArtifacts(id))
+		if err != nil {
+			log.ErrorContext(
+				ctx, "Failed to remove build files",
+				slog.Uint64("build_id", id),
+				slog.Any("error", err),
+			)
+			continue
+		}
+		removedIDs = append(removedIDs, id)
+	}
+	return removedIDs
+}
@@ -1,13 +1,13 @@
 package build
 
 import (
-	"bufio"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os/exec"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/ctbur/ci-server/v2/internal/store"
@@ -15,13 +15,24 @@ import (
 
 type CmdRunner struct {
 	FS *store.FSStore
+	// Masks secrets in the command output before it is written to the logs
+	Masker *secretMasker
 }
 
+// ErrCmdTimeout is returned when a command was killed because it ran for
+// longer than its timeout.
+var ErrCmdTimeout = errors.New("command timed out")
+
+// Run runs cmd of a build step in a sandbox and appends its output to the build
+// logs. If timeout is non-zero, the command and all of its child processes are
+// killed once the timeout is exceeded, and ErrCmdTimeout is returned.
 func (r *CmdRunner) Run(
 	buildID uint64,
+	step int,
 	absSandboxDir, workDir string,
 	cmd []string,
 	env []string,
+	timeout time.Duration,
 ) (int, error) {
 	// Run command in bubblewrap sandbox
 	var bwrapSandbox = []string{
@@ -46,10 +57,23 @@ func (r *CmdRunner) Run(
 	}
 	defer logWriter.Close()
 
-	return runAndLog(execCmd, logWriter)
+	return runAndLog(execCmd, logWriter, &step, timeout, r.Masker)
+}
+
+// logEntryWriter appends entries to the build logs, see store.LogWriter.
+type logEntryWriter interface {
+	WriteEntry(entry store.LogEntry) error
 }
 
-func runAndLog(cmd *exec.Cmd, logWriter io.Writer) (int, error) {
+// runAndLog runs cmd and writes its output to logWriter. Log entries are
+// attributed to step, unless it is nil.
+func runAndLog(
+	cmd *exec.Cmd, logWriter logEntryWriter, step *int, timeout time.Duration, masker *secretMasker,
+) (int, error) {
+	if masker == nil {
+		masker = newSecretMasker()
+	}
+
 	logChan := make(chan store.LogEntry, 100)
 	errChan := make(chan error, 3)
 	var logReaderWaitGroup sync.WaitGroup
@@ -59,17 +83,15 @@ func runAndLog(cmd *exec.Cmd, logWriter io.Writer) (int, error) {
 		defer logReaderWaitGroup.Done()
 		defer reader.Close()
 
-		scanner := bufio.NewScanner(reader)
-		for scanner.Scan() {
-			line := scanner.Text()
+		err := scanLogLines(reader, maxLogLineLength, masker, func(line string) {
 			logChan <- store.LogEntry{
+				Step:      step,
 				Stream:    stream,
 				Timestamp: time.Now(),
 				Text:      line,
 			}
-		}
-
-		if err := scanner.Err(); err != nil {
+		})
+		if err != nil {
 			errChan <- fmt.Errorf("failed to read build logs: %w", err)
 		}
 	}
@@ -89,15 +111,20 @@ func runAndLog(cmd *exec.Cmd, logWriter io.Writer) (int, error) {
 	go func() {
 		defer func() { logDoneChan <- struct{}{} }()
 
-		encoder := json.NewEncoder(logWriter)
 		for logEntry := range logChan {
-			if err := encoder.Encode(logEntry); err != nil {
+			if err := logWriter.WriteEntry(logEntry); err != nil {
 				errChan <- fmt.Errorf("failed to write log entry to file: %w", err)
 				return
 			}
 		}
 	}()
 
+	// Run the command in its own process group, so that it can be killed
+	// together with everything it spawned
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+	}
+
 	// Run and wait for the command
 	if err := cmd.Start(); err != nil {
 		if _, ok := err.(*exec.ExitError); !ok {
@@ -105,6 +132,15 @@ func runAndLog(cmd *exec.Cmd, logWriter io.Writer) (int, error) {
 		}
 	}
 
+	var timedOut atomic.Bool
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			timedOut.Store(true)
+			_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		})
+		defer timer.Stop()
+	}
+
 	errs := []error{}
 	if err := cmd.Wait(); err != nil && err.(*exec.ExitError) == nil {
 		errs = append(errs, fmt.Errorf("failed to execute build command: %w", err))
@@ -114,6 +150,16 @@ func runAndLog(cmd *exec.Cmd, logWriter io.Writer) (int, error) {
 	_ = outWriter.Close()
 	_ = errWriter.Close()
 	logReaderWaitGroup.Wait()
+
+	if timedOut.Load() {
+		logChan <- store.LogEntry{
+			Step:      step,
+			Stream:    store.LogStreamStderr,
+			Timestamp: time.Now(),
+			Text:      fmt.Sprintf("Command timed out after %s", timeout),
+		}
+		errs = append(errs, ErrCmdTimeout)
+	}
 	close(logChan)
 
 	// Wait for log writer to finish
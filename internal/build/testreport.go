@@ -0,0 +1,224 @@
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ctbur/ci-server/v2/internal/store"
+)
+
+// maxTestReportSize is the maximum size of a test report that is read.
+const maxTestReportSize = 32 * 1024 * 1024
+
+// maxTestMessageLength is the maximum length of the failure message kept for a
+// test. Longer messages are truncated.
+const maxTestMessageLength = 16 * 1024
+
+// readTestReport reads a JUnit XML or TAP test report. The format is detected
+// from the content, since both are commonly written to files with arbitrary
+// extensions.
+func readTestReport(reportPath string) ([]store.TestResult, error) {
+	// sec: Path is checked to be within the checkout dir
+	f, err := os.Open(reportPath) // #nosec G304
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, maxTestReportSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxTestReportSize {
+		return nil, fmt.Errorf("report is larger than %d bytes", maxTestReportSize)
+	}
+
+	// Tests of TAP reports have no suite, so use the name of the report
+	suite := strings.TrimSuffix(filepath.Base(reportPath), filepath.Ext(reportPath))
+
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("<")) {
+		return parseJUnit(data, suite)
+	}
+	return parseTAP(bytes.NewReader(data), suite)
+}
+
+type junitSuite struct {
+	Name   string       `xml:"name,attr"`
+	Suites []junitSuite `xml:"testsuite"`
+	Cases  []junitCase  `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure"`
+	Error     *junitFailure `xml:"error"`
+	Skipped   *junitFailure `xml:"skipped"`
+	SystemOut string        `xml:"system-out"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// parseJUnit parses a JUnit XML report. The root element can either be a
+// <testsuites> or a single <testsuite> element.
+func parseJUnit(data []byte, defaultSuite string) ([]store.TestResult, error) {
+	var root junitSuite
+	if err := xml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("invalid JUnit XML: %w", err)
+	}
+
+	var results []store.TestResult
+	var walk func(s junitSuite, suiteName string)
+	walk = func(s junitSuite, suiteName string) {
+		if s.Name != "" {
+			suiteName = s.Name
+		}
+		for _, c := range s.Cases {
+			results = append(results, junitResult(c, suiteName))
+		}
+		for _, child := range s.Suites {
+			walk(child, suiteName)
+		}
+	}
+	walk(root, defaultSuite)
+
+	return results, nil
+}
+
+func junitResult(c junitCase, suiteName string) store.TestResult {
+	result := store.TestResult{
+		Suite:  suiteName,
+		Name:   c.Name,
+		Status: store.TestStatusPassed,
+	}
+	// The class name is more specific than the suite in reports of most tools
+	if c.ClassName != "" {
+		result.Suite = c.ClassName
+	}
+
+	// Some tools write thousands separators
+	if seconds, err := strconv.ParseFloat(strings.ReplaceAll(c.Time, ",", ""), 64); err == nil && seconds > 0 {
+		result.Duration = time.Duration(seconds * float64(time.Second))
+	}
+
+	failure := c.Failure
+	if failure == nil {
+		failure = c.Error
+	}
+	if failure != nil {
+		result.Status = store.TestStatusFailed
+		result.Message = testMessage(failure.Message, failure.Text, c.SystemOut)
+	} else if c.Skipped != nil {
+		result.Status = store.TestStatusSkipped
+		result.Message = testMessage(c.Skipped.Message, c.Skipped.Text)
+	}
+
+	return store.SanitizeTestResult(result)
+}
+
+// tapTestLine matches a test line of a TAP report, e.g.
+// "not ok 2 - parses input # TODO not implemented".
+var tapTestLine = regexp.MustCompile(`^(not )?ok\b\s*(\d+)?\s*(?:-\s*)?([^#]*?)\s*(?:#\s*(\w+)\s*(.*))?$`)
+
+// parseTAP parses a TAP report. Only the tests at the top level are read,
+// subtests are part of the output of their parent.
+func parseTAP(r io.Reader, suite string) ([]store.TestResult, error) {
+	var results []store.TestResult
+	// Index of the last failed test, which YAML diagnostics belong to
+	lastFailed := -1
+	var diagnostics []string
+	inDiagnostics := false
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxTestReportSize)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if inDiagnostics {
+			if strings.TrimSpace(line) == "..." {
+				inDiagnostics = false
+				results[lastFailed].Message = testMessage(strings.Join(diagnostics, "\n"))
+				continue
+			}
+			diagnostics = append(diagnostics, line)
+			continue
+		}
+		if strings.TrimSpace(line) == "---" && lastFailed >= 0 && strings.HasPrefix(line, " ") {
+			inDiagnostics = true
+			diagnostics = nil
+			continue
+		}
+
+		m := tapTestLine.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		lastFailed = -1
+
+		result := store.TestResult{
+			Suite:  suite,
+			Name:   m[3],
+			Status: store.TestStatusPassed,
+		}
+		if result.Name == "" {
+			result.Name = fmt.Sprintf("test %s", m[2])
+		}
+
+		directive := strings.ToUpper(m[4])
+		switch {
+		case directive == "SKIP":
+			result.Status = store.TestStatusSkipped
+			result.Message = testMessage(m[5])
+		case directive == "TODO":
+			// Failures of TODO tests are expected
+			result.Status = store.TestStatusSkipped
+			result.Message = testMessage(m[5])
+		case m[1] != "":
+			result.Status = store.TestStatusFailed
+			lastFailed = len(results)
+		}
+		results = append(results, result)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read TAP report: %w", err)
+	}
+
+	if len(results) == 0 {
+		return nil, errors.New("no tests found in TAP report")
+	}
+	// Unlike XML, TAP reports can contain any bytes
+	for i := range results {
+		results[i] = store.SanitizeTestResult(results[i])
+	}
+	return results, nil
+}
+
+// testMessage joins the non-empty parts of a failure message and truncates it.
+func testMessage(parts ...string) string {
+	var nonEmpty []string
+	for _, part := range parts {
+		if part = strings.TrimSpace(part); part != "" {
+			nonEmpty = append(nonEmpty, part)
+		}
+	}
+	message := strings.Join(nonEmpty, "\n\n")
+
+	if len(message) > maxTestMessageLength {
+		message = strings.ToValidUTF8(message[:maxTestMessageLength], "") + "\n[truncated]"
+	}
+	return message
+}
@@ -0,0 +1,140 @@
+package build
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ctbur/ci-server/v2/internal/assert"
+	"github.com/ctbur/ci-server/v2/internal/store"
+)
+
+func TestReadTestReport(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		file     string
+		content  string
+		expected []store.TestResult
+	}{
+		{
+			desc: "JUnit XML with nested suites",
+			file: "junit.xml",
+			content: `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites>
+  <testsuite name="api">
+    <testcase classname="api.Users" name="creates user" time="1,250.5"/>
+    <testcase name="deletes user" time="0.01">
+      <failure message="expected 204" type="AssertionError">at users.test.js:12</failure>
+      <system-out>DELETE /users/1</system-out>
+    </testcase>
+    <testsuite name="api.nested">
+      <testcase name="crashes"><error message="panic"/></testcase>
+      <testcase name="later"><skipped message="not ready"/></testcase>
+    </testsuite>
+  </testsuite>
+</testsuites>`,
+			expected: []store.TestResult{
+				{
+					Suite: "api.Users", Name: "creates user", Status: store.TestStatusPassed,
+					Duration: 1250500 * time.Millisecond,
+				},
+				{
+					Suite: "api", Name: "deletes user", Status: store.TestStatusFailed,
+					Duration: 10 * time.Millisecond,
+					Message:  "expected 204\n\nat users.test.js:12\n\nDELETE /users/1",
+				},
+				{Suite: "api.nested", Name: "crashes", Status: store.TestStatusFailed, Message: "panic"},
+				{Suite: "api.nested", Name: "later", Status: store.TestStatusSkipped, Message: "not ready"},
+			},
+		},
+		{
+			desc:    "JUnit XML with a single suite",
+			file:    "single.xml",
+			content: `<testsuite><testcase name="works"/></testsuite>`,
+			expected: []store.TestResult{
+				{Suite: "single", Name: "works", Status: store.TestStatusPassed},
+			},
+		},
+		{
+			desc: "TAP with directives and diagnostics",
+			file: "cli.tap",
+			content: `TAP version 13
+1..5
+ok 1 - parses flags
+not ok 2 - exits with code
+  ---
+  message: expected 0
+  got: 1
+  ...
+ok 3 - uses color # SKIP no terminal
+not ok 4 # TODO not implemented
+# a comment
+    ok 1 - subtest
+ok 5 - cleans up
+`,
+			expected: []store.TestResult{
+				{Suite: "cli", Name: "parses flags", Status: store.TestStatusPassed},
+				{
+					Suite: "cli", Name: "exits with code", Status: store.TestStatusFailed,
+					Message: "message: expected 0\n  got: 1",
+				},
+				{Suite: "cli", Name: "uses color", Status: store.TestStatusSkipped, Message: "no terminal"},
+				{Suite: "cli", Name: "test 4", Status: store.TestStatusSkipped, Message: "not implemented"},
+				{Suite: "cli", Name: "cleans up", Status: store.TestStatusPassed},
+			},
+		},
+		{
+			desc: "TAP with names that can't be stored",
+			file: "names.tap",
+			content: "ok 1 - " + strings.Repeat("é", 600) + "\n" +
+				"not ok 2 - null\x00 byte\n" +
+				"ok 3 - invalid \xff UTF-8\n",
+			expected: []store.TestResult{
+				// Truncated to 1024 bytes, which are 512 characters
+				{Suite: "names", Name: strings.Repeat("é", 512), Status: store.TestStatusPassed},
+				{Suite: "names", Name: "null byte", Status: store.TestStatusFailed},
+				{Suite: "names", Name: "invalid � UTF-8", Status: store.TestStatusPassed},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			reportPath := path.Join(t.TempDir(), tc.file)
+			err := os.WriteFile(reportPath, []byte(tc.content), 0o600)
+			assert.NoError(t, err, "Failed to write report").Fatal()
+
+			results, err := readTestReport(reportPath)
+			assert.NoError(t, err, "Failed to read report").Fatal()
+			assert.DeepEqual(t, results, tc.expected, "Incorrect test results")
+		})
+	}
+}
+
+func TestReadTestReportErrors(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		content string
+	}{
+		{desc: "Invalid XML", content: "<testsuite><testcase>"},
+		{desc: "TAP without tests", content: "1..0\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			reportPath := path.Join(t.TempDir(), "report")
+			err := os.WriteFile(reportPath, []byte(tc.content), 0o600)
+			assert.NoError(t, err, "Failed to write report").Fatal()
+
+			_, err = readTestReport(reportPath)
+			assert.Equal(t, err != nil, true, "Expected error")
+		})
+	}
+}
+
+func TestTestMessageTruncated(t *testing.T) {
+	message := testMessage(strings.Repeat("a", maxTestMessageLength+1))
+	assert.Equal(t, message, strings.Repeat("a", maxTestMessageLength)+"\n[truncated]", "Incorrect message")
+}
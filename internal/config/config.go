@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
@@ -11,6 +12,38 @@ type Config struct {
 	DataDir string        `toml:"data_dir"`
 	GitHub  *GitHubConfig `toml:"github"`
 	Repos   RepoConfigs   `toml:"repos"`
+	// Maximum number of builds running at the same time, 0 means no limit
+	MaxConcurrentBuilds int `toml:"max_concurrent_builds"`
+	// Maximum total size of the keyed caches of all repos in bytes. The least
+	// recently used entries are evicted beyond it, 0 means no limit.
+	MaxCacheSize int64 `toml:"max_cache_size"`
+	// How caches are copied into build dirs: "auto", "copy", "reflink" or
+	// "btrfs". Defaults to "auto", which uses the fastest supported one.
+	CacheCopyStrategy string `toml:"cache_copy_strategy"`
+	// Which builds are kept, the others are deleted with their logs and
+	// artifacts
+	Retention RetentionConfig `toml:"retention"`
+	// Users of users.htpasswd that can open the admin pages under /admin/.
+	// Nobody can if it is empty.
+	Admins []string `toml:"admins"`
+}
+
+// RetentionConfig keeps the most recent builds of each repo, and all builds
+// that are newer than a duration. The latest finished build of the default
+// branch is always kept. Builds are kept indefinitely if neither is set.
+type RetentionConfig struct {
+	// Number of most recent builds kept per repo, counting the jobs of a build
+	// matrix as one build
+	KeepBuilds int `toml:"keep_builds"`
+	// Builds newer than this are kept, e.g. "2160h"
+	KeepFor time.Duration `toml:"keep_for"`
+	// If enabled, the builds that would be deleted are only logged
+	DryRun bool `toml:"dry_run"`
+}
+
+// Enabled returns whether builds are deleted at all.
+func (r RetentionConfig) Enabled() bool {
+	return r.KeepBuilds > 0 || r.KeepFor > 0
 }
 
 type GitHubConfig struct {
@@ -34,6 +67,74 @@ type RepoConfig struct {
 	DeployCmd    []string          `toml:"deploy_command"`
 	// Name mapped to "encrypted_deploy_secrets" - we decrypt it as part of loading the config
 	DeploySecrets map[string]string `toml:"encrypted_deploy_secrets"`
+	Timeout       TimeoutConfig     `toml:"timeout"`
+	// Maximum number of builds of this repo running at the same time, 0 means
+	// no limit
+	MaxConcurrentBuilds int `toml:"max_concurrent_builds"`
+	// Cancel pending builds once a newer build for the same ref is created
+	CancelSuperseded bool `toml:"cancel_superseded"`
+	// Together with CancelSuperseded, also cancel running builds, except for
+	// builds of the default branch
+	CancelSupersededRunning bool `toml:"cancel_superseded_running"`
+	// If enabled, builds run the steps of the pipeline file in the repo, and
+	// fall back to the build and deploy commands if there is none
+	Pipeline PipelineConfig `toml:"pipeline"`
+	// If set, each build fans out into one job per combination of env var
+	// values. Only the first job deploys.
+	Matrix MatrixConfig `toml:"matrix"`
+	// Glob patterns of files in the checkout dir that are kept as artifacts
+	// after the build, e.g. "dist/*.tar.gz"
+	Artifacts []string `toml:"artifacts"`
+	// Time after which the artifacts of a build are deleted, e.g. "720h". A
+	// zero duration means that they are kept indefinitely.
+	ArtifactRetention time.Duration `toml:"artifact_retention"`
+	// Glob patterns of JUnit XML or TAP test reports in the checkout dir that
+	// are read after the build, e.g. "reports/*.xml"
+	TestReports []string `toml:"test_reports"`
+	// Caches that are restored before and saved after each build. If set, the
+	// build dir of the default branch is no longer used as cache.
+	Caches []CacheConfig `toml:"caches"`
+	// Limits on the data of this repo in the data dir
+	Quota QuotaConfig `toml:"quota"`
+	// Set env vars that make tools print colors although their output is not
+	// a terminal. The colors are rendered in the logs.
+	ForceColor bool `toml:"force_color"`
+}
+
+// QuotaConfig limits the data that a repo keeps in the data dir. The oldest
+// data is deleted first, and zero values mean no limit.
+type QuotaConfig struct {
+	// Time after which the logs of finished builds are deleted, e.g. "2160h"
+	MaxLogAge time.Duration `toml:"max_log_age"`
+	// Maximum total size of the build and builder logs in bytes. The logs of
+	// running builds count towards it, but are not deleted.
+	MaxLogSize int64 `toml:"max_log_size"`
+	// Maximum total size of the keyed cache entries in bytes. The least
+	// recently used entries are evicted beyond it.
+	MaxCacheSize int64 `toml:"max_cache_size"`
+}
+
+// CacheConfig is a set of paths that is cached under a key derived from the
+// content of files in the checkout, e.g. lockfiles.
+type CacheConfig struct {
+	// Name of the cache, which prefixes its keys
+	Name string `toml:"name"`
+	// Paths relative to the checkout dir, or to the build dir, which is HOME,
+	// if prefixed with "~/", e.g. "node_modules" or "~/go/pkg/mod"
+	Paths []string `toml:"paths"`
+	// Glob patterns of the files in the checkout dir whose content is hashed
+	// into the key, e.g. "go.sum"
+	KeyFiles []string `toml:"key_files"`
+	// Key prefixes of entries that are restored if there is no entry for the
+	// key, e.g. "go-". The most recently created matching entry is used.
+	RestoreKeys []string `toml:"restore_keys"`
+}
+
+// TimeoutConfig limits how long the build and deploy commands may run, e.g.
+// "30m". A zero duration means that the command may run indefinitely.
+type TimeoutConfig struct {
+	Build  time.Duration `toml:"build"`
+	Deploy time.Duration `toml:"deploy"`
 }
 
 func Load(secretKey, configFile string) (*Config, error) {
@@ -0,0 +1,66 @@
+package config
+
+import (
+	"maps"
+	"slices"
+)
+
+// MatrixConfig makes each build of a repo fan out into jobs, one for each
+// combination of env var values. The values are set in the env of the job.
+type MatrixConfig struct {
+	// Values of each env var, e.g. GO_VERSION = ["1.23", "1.24"]
+	Env map[string][]string `toml:"env"`
+	// Combinations that are added to the jobs
+	Include []map[string]string `toml:"include"`
+	// Combinations that are removed from the jobs. An entry removes every
+	// combination that has all of its values.
+	Exclude []map[string]string `toml:"exclude"`
+}
+
+// Expand returns the env vars of each job, or nil if the matrix is empty and
+// builds should not fan out. Combinations are ordered by the env var names
+// and the order of their values, followed by the included ones.
+func (m MatrixConfig) Expand() []map[string]string {
+	if len(m.Env) == 0 && len(m.Include) == 0 {
+		return nil
+	}
+
+	var jobs []map[string]string
+	if len(m.Env) > 0 {
+		jobs = []map[string]string{{}}
+		for _, name := range slices.Sorted(maps.Keys(m.Env)) {
+			var expanded []map[string]string
+			for _, job := range jobs {
+				for _, value := range m.Env[name] {
+					next := maps.Clone(job)
+					next[name] = value
+					expanded = append(expanded, next)
+				}
+			}
+			jobs = expanded
+		}
+	}
+
+	jobs = slices.DeleteFunc(jobs, func(job map[string]string) bool {
+		return slices.ContainsFunc(m.Exclude, func(exclude map[string]string) bool {
+			return containsAll(job, exclude)
+		})
+	})
+
+	for _, include := range m.Include {
+		if !slices.ContainsFunc(jobs, func(job map[string]string) bool { return maps.Equal(job, include) }) {
+			jobs = append(jobs, include)
+		}
+	}
+
+	return jobs
+}
+
+func containsAll(env, values map[string]string) bool {
+	for name, value := range values {
+		if v, ok := env[name]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
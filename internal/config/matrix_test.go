@@ -0,0 +1,77 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/ctbur/ci-server/v2/internal/assert"
+)
+
+func TestMatrixExpand(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		matrix   MatrixConfig
+		wantJobs []map[string]string
+	}{
+		{
+			desc:     "Empty matrix",
+			matrix:   MatrixConfig{},
+			wantJobs: nil,
+		},
+		{
+			desc: "Single axis",
+			matrix: MatrixConfig{
+				Env: map[string][]string{"GO": {"1.23", "1.24"}},
+			},
+			wantJobs: []map[string]string{{"GO": "1.23"}, {"GO": "1.24"}},
+		},
+		{
+			desc: "Multiple axes with include and exclude",
+			matrix: MatrixConfig{
+				Env: map[string][]string{
+					"OS": {"linux", "darwin"},
+					"GO": {"1.23", "1.24"},
+				},
+				Include: []map[string]string{
+					{"GO": "1.25", "OS": "linux"},
+					// Already part of the matrix
+					{"GO": "1.24", "OS": "linux"},
+				},
+				Exclude: []map[string]string{
+					{"GO": "1.23", "OS": "darwin"},
+				},
+			},
+			wantJobs: []map[string]string{
+				{"GO": "1.23", "OS": "linux"},
+				{"GO": "1.24", "OS": "linux"},
+				{"GO": "1.24", "OS": "darwin"},
+				{"GO": "1.25", "OS": "linux"},
+			},
+		},
+		{
+			desc: "Exclude with partial values",
+			matrix: MatrixConfig{
+				Env: map[string][]string{
+					"OS": {"linux", "darwin"},
+					"GO": {"1.23", "1.24"},
+				},
+				Exclude: []map[string]string{{"OS": "darwin"}},
+			},
+			wantJobs: []map[string]string{
+				{"GO": "1.23", "OS": "linux"},
+				{"GO": "1.24", "OS": "linux"},
+			},
+		},
+		{
+			desc: "Only includes",
+			matrix: MatrixConfig{
+				Include: []map[string]string{{"TARGET": "arm"}, {"TARGET": "x86"}},
+			},
+			wantJobs: []map[string]string{{"TARGET": "arm"}, {"TARGET": "x86"}},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert.DeepEqual(t, tc.matrix.Expand(), tc.wantJobs, "Incorrect jobs")
+		})
+	}
+}
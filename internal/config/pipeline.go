@@ -0,0 +1,116 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// PipelineFile is the path of the pipeline definition relative to the root of
+// a repo.
+const PipelineFile = ".ci.toml"
+
+// PipelineConfig controls whether the builds of a repo may be defined by the
+// pipeline file in the built commit instead of the build and deploy commands.
+type PipelineConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Names of build and deploy secrets that pipeline steps may request. Deploy
+	// secrets are only available to builds that are allowed to deploy.
+	AllowedSecrets []string `toml:"allowed_secrets"`
+}
+
+// Pipeline is the definition of a build read from the pipeline file of a repo.
+type Pipeline struct {
+	// Env vars set for all steps
+	Env   map[string]string `toml:"env"`
+	Steps []PipelineStep    `toml:"steps"`
+}
+
+// PipelineStep is a command that runs as part of a pipeline. Steps run in
+// order, and the pipeline stops at the first step that fails.
+type PipelineStep struct {
+	Name    string            `toml:"name"`
+	Command []string          `toml:"command"`
+	Env     map[string]string `toml:"env"`
+	// Names of the secrets to pass to the step as env vars
+	Secrets []string `toml:"secrets"`
+	// Limits how long the step may run, in addition to the build timeout
+	Timeout time.Duration `toml:"timeout"`
+	When    StepCondition `toml:"when"`
+}
+
+// StepCondition decides whether a step runs. An empty condition always
+// matches.
+type StepCondition struct {
+	// Branch name patterns as understood by path.Match, e.g. "release/*"
+	Branches []string `toml:"branches"`
+}
+
+// LoadPipeline reads and validates a pipeline file.
+func LoadPipeline(pipelineFile string) (*Pipeline, error) {
+	var pipeline Pipeline
+	md, err := toml.DecodeFile(pipelineFile, &pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load pipeline file: %w", err)
+	}
+
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("unknown key '%s' in pipeline file", undecoded[0])
+	}
+
+	if err := pipeline.validate(); err != nil {
+		return nil, fmt.Errorf("invalid pipeline file: %w", err)
+	}
+
+	return &pipeline, nil
+}
+
+func (p *Pipeline) validate() error {
+	if len(p.Steps) == 0 {
+		return errors.New("pipeline has no steps")
+	}
+
+	names := make(map[string]bool)
+	for i, step := range p.Steps {
+		if step.Name == "" {
+			return fmt.Errorf("step %d has no name", i+1)
+		}
+		if names[step.Name] {
+			return fmt.Errorf("duplicate step name '%s'", step.Name)
+		}
+		names[step.Name] = true
+
+		if len(step.Command) == 0 {
+			return fmt.Errorf("step '%s' has no command", step.Name)
+		}
+		for _, pattern := range step.When.Branches {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid branch pattern '%s' in step '%s': %w", pattern, step.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Matches reports whether a step runs for a build of the given branch. Builds
+// that are not of a branch, e.g. tags, have an empty branch.
+func (c StepCondition) Matches(branch string) bool {
+	if len(c.Branches) == 0 {
+		return true
+	}
+	if branch == "" {
+		return false
+	}
+
+	for _, pattern := range c.Branches {
+		// Patterns were validated when loading the pipeline
+		if ok, _ := path.Match(pattern, branch); ok {
+			return true
+		}
+	}
+	return false
+}
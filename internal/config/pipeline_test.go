@@ -0,0 +1,125 @@
+package config
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/ctbur/ci-server/v2/internal/assert"
+)
+
+func TestLoadPipeline(t *testing.T) {
+	testCases := []struct {
+		desc         string
+		content      string
+		wantPipeline *Pipeline
+		wantErr      bool
+	}{
+		{
+			desc: "Valid pipeline",
+			content: `
+[env]
+GOFLAGS = "-mod=readonly"
+
+[[steps]]
+name = "test"
+command = ["go", "test", "./..."]
+
+[[steps]]
+name = "deploy"
+command = ["./deploy.sh"]
+secrets = ["DEPLOY_TOKEN"]
+timeout = "5m"
+env = { TARGET = "prod" }
+when = { branches = ["main", "release/*"] }
+`,
+			wantPipeline: &Pipeline{
+				Env: map[string]string{"GOFLAGS": "-mod=readonly"},
+				Steps: []PipelineStep{
+					{Name: "test", Command: []string{"go", "test", "./..."}},
+					{
+						Name:    "deploy",
+						Command: []string{"./deploy.sh"},
+						Env:     map[string]string{"TARGET": "prod"},
+						Secrets: []string{"DEPLOY_TOKEN"},
+						Timeout: 5 * time.Minute,
+						When:    StepCondition{Branches: []string{"main", "release/*"}},
+					},
+				},
+			},
+		},
+		{
+			desc:    "No steps",
+			content: `env = { A = "b" }`,
+			wantErr: true,
+		},
+		{
+			desc: "Duplicate step name",
+			content: `
+[[steps]]
+name = "test"
+command = ["true"]
+
+[[steps]]
+name = "test"
+command = ["true"]
+`,
+			wantErr: true,
+		},
+		{
+			desc: "Step without command",
+			content: `
+[[steps]]
+name = "test"
+`,
+			wantErr: true,
+		},
+		{
+			desc: "Unknown key",
+			content: `
+[[steps]]
+name = "test"
+command = ["true"]
+when = { branch = "main" }
+`,
+			wantErr: true,
+		},
+		{
+			desc: "Invalid branch pattern",
+			content: `
+[[steps]]
+name = "test"
+command = ["true"]
+when = { branches = ["[main"] }
+`,
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			pipelineFile := path.Join(t.TempDir(), PipelineFile)
+			err := os.WriteFile(pipelineFile, []byte(tc.content), 0o600)
+			assert.NoError(t, err, "Failed to write pipeline file").Fatal()
+
+			pipeline, err := LoadPipeline(pipelineFile)
+			if tc.wantErr {
+				assert.Equal(t, err != nil, true, "Expected error for invalid pipeline")
+				return
+			}
+			assert.NoError(t, err, "Failed to load pipeline").Fatal()
+			assert.DeepEqual(t, pipeline, tc.wantPipeline, "Incorrect pipeline")
+		})
+	}
+}
+
+func TestStepConditionMatches(t *testing.T) {
+	cond := StepCondition{Branches: []string{"main", "release/*"}}
+
+	assert.Equal(t, StepCondition{}.Matches("feature"), true, "Empty condition must match")
+	assert.Equal(t, StepCondition{}.Matches(""), true, "Empty condition must match non-branch builds")
+	assert.Equal(t, cond.Matches("main"), true, "Condition must match exact branch")
+	assert.Equal(t, cond.Matches("release/1.0"), true, "Condition must match branch pattern")
+	assert.Equal(t, cond.Matches("feature"), false, "Condition must not match other branch")
+	assert.Equal(t, cond.Matches(""), false, "Condition must not match non-branch builds")
+}
@@ -0,0 +1,225 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Artifact is a file kept from the checkout of a build.
+type Artifact struct {
+	// Path of the file relative to the checkout dir
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	// The artifact is deleted after this time, nil means never
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+var ErrNoArtifact = errors.New("artifact does not exist")
+
+func (fs *FSStore) artifactsDir(buildID uint64) string {
+	return path.Join(fs.RootDir, "artifacts", strconv.FormatUint(buildID, 10))
+}
+
+func (fs *FSStore) artifactListPath(buildID uint64) string {
+	return path.Join(fs.RootDir, "artifacts", fmt.Sprintf("%d.json", buildID))
+}
+
+// StoreArtifact copies a file into the artifacts of a build under the given
+// name, and returns its size and hash.
+func (fs *FSStore) StoreArtifact(buildID uint64, name, srcPath string) (Artifact, error) {
+	if !filepath.IsLocal(name) {
+		return Artifact{}, fmt.Errorf("invalid artifact name '%s'", name)
+	}
+
+	// sec: Path is checked to be within the checkout dir by the builder
+	src, err := os.Open(srcPath) // #nosec G304
+	if err != nil {
+		return Artifact{}, fmt.Errorf("failed to open artifact: %w", err)
+	}
+	defer src.Close()
+
+	dstPath := path.Join(fs.artifactsDir(buildID), name)
+	if err := os.MkdirAll(path.Dir(dstPath), 0o700); err != nil {
+		return Artifact{}, fmt.Errorf("failed to create artifact dir: %w", err)
+	}
+	// sec: Name is checked to be local above
+	dst, err := os.OpenFile(dstPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600) // #nosec G304
+	if err != nil {
+		return Artifact{}, fmt.Errorf("failed to create artifact: %w", err)
+	}
+	defer dst.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(dst, hash), src)
+	if err != nil {
+		return Artifact{}, fmt.Errorf("failed to copy artifact: %w", err)
+	}
+	if err := dst.Close(); err != nil {
+		return Artifact{}, fmt.Errorf("failed to write artifact: %w", err)
+	}
+
+	return Artifact{
+		Name:   name,
+		Size:   size,
+		SHA256: hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+// OpenArtifact opens an artifact of a build for reading.
+func (fs *FSStore) OpenArtifact(buildID uint64, name string) (*os.File, error) {
+	if !filepath.IsLocal(name) {
+		return nil, ErrNoArtifact
+	}
+	// sec: Name is checked to be local above
+	f, err := os.Open(path.Join(fs.artifactsDir(buildID), name)) // #nosec G304
+	if os.IsNotExist(err) {
+		return nil, ErrNoArtifact
+	}
+	return f, err
+}
+
+// RemoveArtifacts removes all artifacts of a build.
+func (fs *FSStore) RemoveArtifacts(buildID uint64) error {
+	return removeAll(fs.artifactsDir(buildID))
+}
+
+// While a build is running, the builder lists the artifacts it stored in a
+// file. Once the build finishes, they are moved to the database.
+
+// WriteArtifactList replaces the list of artifacts of a running build.
+func (fs *FSStore) WriteArtifactList(buildID uint64, artifacts []Artifact) error {
+	data, err := json.Marshal(artifacts)
+	if err != nil {
+		return fmt.Errorf("failed to marshal artifacts: %w", err)
+	}
+	if err := os.WriteFile(fs.artifactListPath(buildID), data, 0o600); err != nil {
+		return fmt.Errorf("failed to write artifacts: %w", err)
+	}
+	return nil
+}
+
+// ReadArtifactList returns the artifacts of a build that has not been moved to
+// the database yet, or nil if there are none.
+func (fs *FSStore) ReadArtifactList(buildID uint64) ([]Artifact, error) {
+	// sec: Path is from a trusted user
+	data, err := os.ReadFile(fs.artifactListPath(buildID)) // #nosec G304
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read artifacts: %w", err)
+	}
+
+	var artifacts []Artifact
+	if err := json.Unmarshal(data, &artifacts); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal artifacts: %w", err)
+	}
+	return artifacts, nil
+}
+
+// RemoveArtifactList removes the list of artifacts of a build once they are
+// stored in the database.
+func (fs *FSStore) RemoveArtifactList(buildID uint64) error {
+	err := os.Remove(fs.artifactListPath(buildID))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func insertArtifacts(ctx context.Context, tx pgx.Tx, buildID uint64, artifacts []Artifact) error {
+	for _, artifact := range artifacts {
+		_, err := tx.Exec(
+			ctx,
+			`INSERT INTO artifacts (build_id, name, size, sha256, expires)
+			VALUES ($1, $2, $3, $4, $5)`,
+			buildID,
+			artifact.Name,
+			artifact.Size,
+			artifact.SHA256,
+			artifact.Expires,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to insert artifact '%s': %w", artifact.Name, err)
+		}
+	}
+	return nil
+}
+
+// GetArtifacts returns the artifacts of a finished build.
+func (db DBStore) GetArtifacts(ctx context.Context, buildID uint64) ([]Artifact, error) {
+	rows, err := db.pool.Query(
+		ctx,
+		`SELECT name, size, sha256, expires
+		FROM artifacts
+		WHERE build_id = $1
+		ORDER BY name`,
+		buildID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return pgx.CollectRows(
+		rows,
+		func(row pgx.CollectableRow) (Artifact, error) {
+			a := Artifact{}
+			err := row.Scan(&a.Name, &a.Size, &a.SHA256, &a.Expires)
+			return a, err
+		})
+}
+
+// GetArtifact returns an artifact of a finished build, or ErrNoArtifact if it
+// does not exist.
+func (db DBStore) GetArtifact(ctx context.Context, buildID uint64, name string) (*Artifact, error) {
+	a := Artifact{Name: name}
+	err := db.pool.QueryRow(
+		ctx,
+		`SELECT size, sha256, expires
+		FROM artifacts
+		WHERE build_id = $1 AND name = $2`,
+		buildID,
+		name,
+	).Scan(&a.Size, &a.SHA256, &a.Expires)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNoArtifact
+	} else if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// DeleteExpiredArtifacts deletes the artifacts that expired before ts and
+// returns the IDs of the builds whose artifacts were deleted.
+func (db DBStore) DeleteExpiredArtifacts(ctx context.Context, ts time.Time) ([]uint64, error) {
+	rows, err := db.pool.Query(
+		ctx,
+		`WITH deleted AS (
+			DELETE FROM artifacts
+			WHERE expires < $1
+			RETURNING build_id
+		)
+		SELECT DISTINCT build_id FROM deleted ORDER BY build_id`,
+		ts,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return pgx.CollectRows(rows, pgx.RowTo[uint64])
+}
@@ -0,0 +1,395 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/*
+ * Cache entries are kept per repo:
+ * rootDir/
+ *   caches/
+ *     .lock                     held shared while entries are used, and
+ *                               exclusively while entries are evicted
+ *     <owner>/<repo>/
+ *       <entry ID>/             files of the entry, relative to the build dir
+ *       <entry ID>.json         metadata of the entry
+ *       .tmp-<random>/          entry that is being saved
+ *
+ * The entry ID is derived from the ref and key of the entry. Builds only
+ * restore entries saved by builds of their own ref or of the default branch,
+ * so that builds of other branches can't change what the default branch
+ * builds with.
+ */
+
+// CacheEntry is a set of files of a build dir that were saved under a key.
+type CacheEntry struct {
+	Key      string    `json:"key"`
+	Ref      string    `json:"ref"`
+	Size     int64     `json:"size"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used"`
+
+	// Directory of the entry's metadata, not stored
+	dir string
+	id  string
+}
+
+func cacheEntryID(ref, key string) string {
+	sum := sha256.Sum256([]byte(ref + "\x00" + key))
+	return hex.EncodeToString(sum[:16])
+}
+
+func (fs *FSStore) repoCacheDir(owner, name string) string {
+	return path.Join(fs.RootDir, "caches", owner, name)
+}
+
+// lockCaches locks the cache dir and returns a function to unlock it.
+func (fs *FSStore) lockCaches(exclusive bool) (func(), error) {
+	lockPath := path.Join(fs.RootDir, "caches", ".lock")
+	// sec: Path is from a trusted user
+	f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDONLY, 0o600) // #nosec G304
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cache lock: %w", err)
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	// sec: File descriptors fit into an int
+	if err := syscall.Flock(int(f.Fd()), how); err != nil { // #nosec G115
+		_ = f.Close()
+		return nil, fmt.Errorf("failed to lock caches: %w", err)
+	}
+
+	// Closing the file releases the lock
+	return func() { _ = f.Close() }, nil
+}
+
+// listCacheEntries returns the entries in the cache dir of a repo.
+func listCacheEntries(dir string) ([]CacheEntry, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list cache entries: %w", err)
+	}
+
+	var entries []CacheEntry
+	for _, file := range files {
+		id, ok := strings.CutSuffix(file.Name(), ".json")
+		if !ok || file.IsDir() {
+			continue
+		}
+
+		// sec: Path is from a trusted user
+		data, err := os.ReadFile(path.Join(dir, file.Name())) // #nosec G304
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cache entry: %w", err)
+		}
+		entry := CacheEntry{dir: dir, id: id}
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal cache entry: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func writeCacheEntry(entry CacheEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal cache entry: %w", err)
+	}
+
+	// Entries are read by other builders, so replace the file atomically
+	entryPath := path.Join(entry.dir, entry.id+".json")
+	tmpPath := fmt.Sprintf("%s.tmp-%d", entryPath, os.Getpid())
+	if err := os.WriteFile(tmpPath, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write cache entry: %w", err)
+	}
+	if err := os.Rename(tmpPath, entryPath); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("failed to write cache entry: %w", err)
+	}
+	return nil
+}
+
+// findCacheEntry returns the entry with the exact key, or else the latest
+// entry whose key starts with the first matching restore key. Entries of
+// earlier refs take precedence.
+func findCacheEntry(entries []CacheEntry, refs []string, key string, restoreKeys []string) *CacheEntry {
+	find := func(match func(e CacheEntry) bool) *CacheEntry {
+		for _, ref := range refs {
+			var found *CacheEntry
+			for i, e := range entries {
+				if e.Ref == ref && match(e) && (found == nil || e.Created.After(found.Created)) {
+					found = &entries[i]
+				}
+			}
+			if found != nil {
+				return found
+			}
+		}
+		return nil
+	}
+
+	if entry := find(func(e CacheEntry) bool { return e.Key == key }); entry != nil {
+		return entry
+	}
+	for _, prefix := range restoreKeys {
+		if entry := find(func(e CacheEntry) bool { return strings.HasPrefix(e.Key, prefix) }); entry != nil {
+			return entry
+		}
+	}
+	return nil
+}
+
+// RestoreCache copies the files of a cache entry of a repo into the build dir.
+// The entry is looked up by key, or by the restore keys as a fallback, among
+// the entries saved by builds of the given refs. It returns the restored entry,
+// or nil if there is none.
+func (fs *FSStore) RestoreCache(
+	owner, name string, refs []string, key string, restoreKeys []string, absBuildDir string,
+) (*CacheEntry, error) {
+	unlock, err := fs.lockCaches(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	entries, err := listCacheEntries(fs.repoCacheDir(owner, name))
+	if err != nil {
+		return nil, err
+	}
+
+	entry := findCacheEntry(entries, refs, key, restoreKeys)
+	if entry == nil {
+		return nil, nil
+	}
+
+	// Copy the contents of the entry dir into the existing build dir
+	entryDir := path.Join(entry.dir, entry.id)
+	if err := fs.copyDirs(entryDir+"/.", absBuildDir); err != nil {
+		return nil, fmt.Errorf("failed to restore cache entry '%s': %w", entry.Key, err)
+	}
+
+	entry.LastUsed = time.Now()
+	if err := writeCacheEntry(*entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// SaveCache saves the given paths of the build dir as a cache entry of a repo.
+// Paths that don't exist are skipped. It returns the saved entry, or nil if
+// an entry with the same ref and key already exists.
+func (fs *FSStore) SaveCache(
+	owner, name, ref, key string, absBuildDir string, paths []string,
+) (*CacheEntry, error) {
+	unlock, err := fs.lockCaches(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	dir := fs.repoCacheDir(owner, name)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create cache dir: %w", err)
+	}
+
+	id := cacheEntryID(ref, key)
+	entryDir := path.Join(dir, id)
+	if _, err := os.Stat(entryDir); err == nil {
+		return nil, nil
+	}
+
+	// Copy into a temporary dir first, so that builders never restore a
+	// partially saved entry
+	tmpDir, err := os.MkdirTemp(dir, ".tmp-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cache entry dir: %w", err)
+	}
+	defer func() { _ = removeAll(tmpDir) }()
+
+	for _, p := range paths {
+		if !filepath.IsLocal(p) {
+			return nil, fmt.Errorf("cache path '%s' is not within the build dir", p)
+		}
+
+		src := path.Join(absBuildDir, p)
+		if _, err := os.Lstat(src); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to stat cache path '%s': %w", p, err)
+		}
+
+		dst := path.Join(tmpDir, p)
+		if err := os.MkdirAll(path.Dir(dst), 0o700); err != nil {
+			return nil, fmt.Errorf("failed to create cache path '%s': %w", p, err)
+		}
+		if err := fs.copyDirs(src, dst); err != nil {
+			return nil, fmt.Errorf("failed to copy cache path '%s': %w", p, err)
+		}
+	}
+
+	size, err := dirSize(tmpDir)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	entry := CacheEntry{
+		Key:      key,
+		Ref:      ref,
+		Size:     size,
+		Created:  now,
+		LastUsed: now,
+		dir:      dir,
+		id:       id,
+	}
+
+	if err := os.Rename(tmpDir, entryDir); err != nil {
+		if errors.Is(err, os.ErrExist) || errors.Is(err, syscall.ENOTEMPTY) {
+			// Saved by another build in the meantime
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to save cache entry: %w", err)
+	}
+	if err := writeCacheEntry(entry); err != nil {
+		_ = removeAll(entryDir)
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// removeUnusedCacheDirs removes the dirs in the cache dir of a repo that don't
+// belong to an entry. Nothing is being saved while the caches are locked
+// exclusively, so these are left over from builders that were killed.
+func removeUnusedCacheDirs(dir string, entries []CacheEntry) error {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to list cache dirs: %w", err)
+	}
+
+	var errs []error
+	for _, file := range files {
+		if !file.IsDir() || slices.ContainsFunc(entries, func(e CacheEntry) bool { return e.id == file.Name() }) {
+			continue
+		}
+		if err := removeAll(path.Join(dir, file.Name())); err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete unused cache dir: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// dirSize returns the total size of the files in a dir. Files that are deleted
+// in the meantime are skipped.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get size of '%s': %w", dir, err)
+	}
+	return size, nil
+}
+
+// EvictCaches deletes the least recently used cache entries of all repos until
+// their total size is at most maxSize. It returns the deleted entries.
+func (fs *FSStore) EvictCaches(maxSize int64) ([]CacheEntry, error) {
+	return fs.evictCaches(path.Join(fs.RootDir, "caches", "*", "*"), maxSize)
+}
+
+// EvictRepoCaches deletes the least recently used cache entries of a repo until
+// their total size is at most maxSize. It returns the deleted entries.
+func (fs *FSStore) EvictRepoCaches(owner, name string, maxSize int64) ([]CacheEntry, error) {
+	return fs.evictCaches(fs.repoCacheDir(owner, name), maxSize)
+}
+
+// evictCaches deletes the least recently used cache entries in the cache dirs
+// matching the pattern until their total size is at most maxSize.
+func (fs *FSStore) evictCaches(repoDirPattern string, maxSize int64) ([]CacheEntry, error) {
+	unlock, err := fs.lockCaches(true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	repoDirs, err := filepath.Glob(repoDirPattern)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list cache dirs: %w", err)
+	}
+
+	var entries []CacheEntry
+	var errs []error
+	for _, dir := range repoDirs {
+		repoEntries, err := listCacheEntries(dir)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		entries = append(entries, repoEntries...)
+
+		if err := removeUnusedCacheDirs(dir, repoEntries); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	var totalSize int64
+	for _, e := range entries {
+		totalSize += e.Size
+	}
+
+	slices.SortFunc(entries, func(a, b CacheEntry) int {
+		return a.LastUsed.Compare(b.LastUsed)
+	})
+
+	var evicted []CacheEntry
+	for _, e := range entries {
+		if totalSize <= maxSize {
+			break
+		}
+
+		// Remove the metadata first, so that a partially deleted entry is not
+		// restored
+		if err := os.Remove(path.Join(e.dir, e.id+".json")); err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete cache entry '%s': %w", e.Key, err))
+			continue
+		}
+		if err := removeAll(path.Join(e.dir, e.id)); err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete cache entry '%s': %w", e.Key, err))
+		}
+		totalSize -= e.Size
+		evicted = append(evicted, e)
+	}
+
+	return evicted, errors.Join(errs...)
+}
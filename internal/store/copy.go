@@ -0,0 +1,173 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// CopyStrategy is how cached files are copied into build dirs.
+//
+// Overlayfs is not offered: the build dir of a cached build must be complete,
+// since later builds start from it, while an overlay only has the changes of
+// a build in its upper dir. The checkout also happens outside of the sandbox,
+// where the overlay would be mounted.
+type CopyStrategy string
+
+const (
+	// Use the fastest strategy the data dir supports
+	CopyStrategyAuto CopyStrategy = "auto"
+	// Copy all files
+	CopyStrategyCopy CopyStrategy = "copy"
+	// Clone files with reflinks, which share their data until it is modified.
+	// Requires a filesystem like btrfs or XFS.
+	CopyStrategyReflink CopyStrategy = "reflink"
+	// Create build dirs as btrfs subvolumes, which are snapshotted instead of
+	// copied. Other files are cloned with reflinks.
+	CopyStrategyBtrfs CopyStrategy = "btrfs"
+)
+
+const (
+	btrfsSuperMagic = 0x9123683e
+	// Inode number of the root dir of a btrfs subvolume
+	btrfsSubvolumeIno = 256
+	// ioctl to clone a file, see ioctl_ficlone(2)
+	ficlone = 0x40049409
+)
+
+// ResolveCopyStrategy checks that the data dir supports the strategy, and
+// detects the fastest supported strategy for CopyStrategyAuto. An empty
+// strategy is the same as CopyStrategyAuto.
+func (fs *FSStore) ResolveCopyStrategy(strategy CopyStrategy) (CopyStrategy, error) {
+	switch strategy {
+	case "", CopyStrategyAuto:
+		for _, s := range []CopyStrategy{CopyStrategyBtrfs, CopyStrategyReflink} {
+			if fs.copyStrategySupported(s) == nil {
+				return s, nil
+			}
+		}
+		return CopyStrategyCopy, nil
+	case CopyStrategyCopy, CopyStrategyReflink, CopyStrategyBtrfs:
+		if err := fs.copyStrategySupported(strategy); err != nil {
+			return "", fmt.Errorf("copy strategy '%s' is not supported by '%s': %w", strategy, fs.RootDir, err)
+		}
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("unknown copy strategy '%s'", strategy)
+	}
+}
+
+func (fs *FSStore) copyStrategySupported(strategy CopyStrategy) error {
+	switch strategy {
+	case CopyStrategyBtrfs:
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(fs.RootDir, &stat); err != nil {
+			return err
+		}
+		if stat.Type != btrfsSuperMagic {
+			return errors.New("not a btrfs filesystem")
+		}
+		if _, err := exec.LookPath("btrfs"); err != nil {
+			return err
+		}
+		return nil
+	case CopyStrategyReflink:
+		return probeReflink(fs.RootDir)
+	default:
+		return nil
+	}
+}
+
+// probeReflink checks if files in dir can be cloned.
+func probeReflink(dir string) error {
+	src, err := os.CreateTemp(dir, ".reflink-probe-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(src.Name())
+	defer src.Close()
+	if _, err := src.WriteString("probe"); err != nil {
+		return err
+	}
+
+	dst, err := os.CreateTemp(dir, ".reflink-probe-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// copyDirs copies src to dst, preserving attributes and symlinks. If dst is an
+// existing dir, src is copied into it.
+func (fs *FSStore) copyDirs(src, dst string) error {
+	args := []string{"-a"}
+	switch fs.CopyStrategy {
+	case CopyStrategyReflink:
+		args = append(args, "--reflink=always")
+	case CopyStrategyBtrfs:
+		// Files copied from a different filesystem can't be cloned
+		args = append(args, "--reflink=auto")
+	}
+	return runCopyCmd("cp", append(args, src, dst)...)
+}
+
+// createBuildDir creates an empty build dir, or a copy of the cache dir if it
+// is given.
+func (fs *FSStore) createBuildDir(buildDir string, cacheDir *string) error {
+	if fs.CopyStrategy == CopyStrategyBtrfs {
+		if cacheDir == nil {
+			return runCopyCmd("btrfs", "subvolume", "create", buildDir)
+		}
+		// Caches made before switching to btrfs are plain dirs
+		if isBtrfsSubvolume(*cacheDir) {
+			return runCopyCmd("btrfs", "subvolume", "snapshot", *cacheDir, buildDir)
+		}
+	}
+
+	if cacheDir == nil {
+		return os.Mkdir(buildDir, 0o700)
+	}
+	// copyDirs will create the build dir
+	return fs.copyDirs(*cacheDir, buildDir)
+}
+
+func isBtrfsSubvolume(dir string) bool {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(dir, &stat); err != nil {
+		return false
+	}
+	return stat.Ino == btrfsSubvolumeIno
+}
+
+// removeBuildDir removes a build dir, which can be a btrfs subvolume.
+func (fs *FSStore) removeBuildDir(buildDir string) error {
+	err := removeAll(buildDir)
+	if err != nil && fs.CopyStrategy == CopyStrategyBtrfs && isBtrfsSubvolume(buildDir) {
+		// Removing a subvolume with rmdir requires a recent kernel
+		return runCopyCmd("btrfs", "subvolume", "delete", buildDir)
+	}
+	return err
+}
+
+func runCopyCmd(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+
+	out := &bytes.Buffer{}
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to run %s: %w\n\n%s output:\n%s", name, err, name, out)
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/jackc/pgx/v5"
@@ -64,10 +65,63 @@ type BuildMeta struct {
 	Author    string
 }
 
+// buildEventsChannel is the Postgres notification channel on which build
+// creations and cancellations are announced.
+const buildEventsChannel = "build_events"
+
+func notifyBuildEvent(ctx context.Context, tx pgx.Tx, buildID uint64) error {
+	// Notifications are only delivered once the transaction commits
+	_, err := tx.Exec(
+		ctx,
+		`SELECT pg_notify($1, $2)`,
+		buildEventsChannel,
+		strconv.FormatUint(buildID, 10),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to notify %s: %w", buildEventsChannel, err)
+	}
+	return nil
+}
+
+// ListenForBuildEvents blocks and sends to notify whenever a build is created or
+// canceled. Sends are dropped if notify is full. It returns when the context is
+// canceled or the connection fails.
+func (db DBStore) ListenForBuildEvents(ctx context.Context, notify chan<- struct{}) error {
+	conn, err := db.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	// Don't return the connection to the pool as it is still listening
+	pgConn := conn.Hijack()
+	defer pgConn.Close(context.Background())
+
+	_, err = pgConn.Exec(ctx, "LISTEN "+buildEventsChannel)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", buildEventsChannel, err)
+	}
+
+	for {
+		_, err := pgConn.WaitForNotification(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to wait for notification: %w", err)
+		}
+
+		select {
+		case notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// CreateBuild creates a pending build. If jobs are given, it creates a parent
+// build with one child build per job instead, which runs with the env vars of
+// the job. The parent is not run itself, but reflects the state of its jobs.
+// It returns the ID of the build or parent build.
 func (db DBStore) CreateBuild(
 	ctx context.Context,
 	repoOwner, repoName string,
 	build BuildMeta,
+	jobs []map[string]string,
 	ts time.Time,
 ) (uint64, error) {
 	tx, err := db.pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.Serializable})
@@ -99,7 +153,7 @@ func (db DBStore) CreateBuild(
 	// Create build
 	var newID uint64
 
-	err = db.pool.QueryRow(
+	err = tx.QueryRow(
 		ctx,
 		`INSERT INTO builds (
 			repo_id,
@@ -109,9 +163,10 @@ func (db DBStore) CreateBuild(
 			commit_sha,
 			message,
 			author,
-			created
+			created,
+			job_count
 		) VALUES (
-			$1, $2, $3, $4, $5, $6, $7, $8
+			$1, $2, $3, $4, $5, $6, $7, $8, $9
 		) RETURNING id`,
 		repoID,
 		buildNumber,
@@ -121,12 +176,53 @@ func (db DBStore) CreateBuild(
 		build.Message,
 		build.Author,
 		ts,
+		len(jobs),
 	).Scan(&newID)
 
 	if err != nil {
 		return 0, fmt.Errorf("failed to create build: %w", err)
 	}
 
+	// Create jobs, which share the build number with their parent
+	for i, jobEnv := range jobs {
+		_, err = tx.Exec(
+			ctx,
+			`INSERT INTO builds (
+				repo_id,
+				number,
+				link,
+				ref,
+				commit_sha,
+				message,
+				author,
+				created,
+				parent_id,
+				job_index,
+				job_env
+			) VALUES (
+				$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11
+			)`,
+			repoID,
+			buildNumber,
+			build.Link,
+			build.Ref,
+			build.CommitSHA,
+			build.Message,
+			build.Author,
+			ts,
+			newID,
+			i+1,
+			jobEnv,
+		)
+		if err != nil {
+			return 0, fmt.Errorf("failed to create job %d: %w", i+1, err)
+		}
+	}
+
+	if err := notifyBuildEvent(ctx, tx, newID); err != nil {
+		return 0, err
+	}
+
 	if err := tx.Commit(ctx); err != nil {
 		return 0, fmt.Errorf("failed to commit transaction: %w", err)
 	}
@@ -147,11 +243,11 @@ func (db DBStore) StartBuild(
 	}
 	defer tx.Rollback(ctx)
 
-	_, err = tx.Exec(
+	tag, err := tx.Exec(
 		ctx,
 		`UPDATE builds
 		SET started = $1
-		WHERE id = $2`,
+		WHERE id = $2 AND result IS NULL`,
 		started,
 		buildID,
 	)
@@ -159,26 +255,43 @@ func (db DBStore) StartBuild(
 		return fmt.Errorf("failed to update build: %w", err)
 	}
 
+	// The build was canceled while the builder was starting, so the builder
+	// needs to be stopped right away
+	cancelRequested := tag.RowsAffected() == 0
+
 	_, err = tx.Exec(
 		ctx,
-		`INSERT INTO builders (build_id, pid, cache_id)
-		VALUES ($1, $2, $3)`,
-		buildID, pid, cacheID,
+		`INSERT INTO builders (build_id, pid, cache_id, cancel_requested)
+		VALUES ($1, $2, $3, $4)`,
+		buildID, pid, cacheID, cancelRequested,
 	)
 	if err != nil {
 		return fmt.Errorf("failed to update builders: %w", err)
 	}
 
+	if err := updateParentBuild(ctx, tx, buildID); err != nil {
+		return err
+	}
+
 	// TODO: return error if no rows were affected (build not found)
 	return tx.Commit(ctx)
 }
 
+// BuildOutput is what the builder recorded while running a build, which is
+// stored together with the result once the build finishes.
+type BuildOutput struct {
+	Steps       []BuildStep
+	Artifacts   []Artifact
+	TestResults []TestResult
+}
+
 func (db DBStore) FinishBuild(
 	ctx context.Context,
 	buildID uint64,
 	finished time.Time,
 	result BuildResult,
 	cacheBuildFiles bool,
+	output BuildOutput,
 ) error {
 	tx, err := db.pool.BeginTx(ctx, pgx.TxOptions{})
 	if err != nil {
@@ -199,6 +312,22 @@ func (db DBStore) FinishBuild(
 		return fmt.Errorf("failed to update build: %w", err)
 	}
 
+	if err := insertBuildSteps(ctx, tx, buildID, output.Steps); err != nil {
+		return err
+	}
+
+	if err := insertArtifacts(ctx, tx, buildID, output.Artifacts); err != nil {
+		return err
+	}
+
+	if err := insertTestResults(ctx, tx, buildID, output.TestResults); err != nil {
+		return err
+	}
+
+	if err := updateParentBuild(ctx, tx, buildID); err != nil {
+		return err
+	}
+
 	if cacheBuildFiles {
 		_, err = tx.Exec(
 			ctx,
@@ -232,6 +361,105 @@ func (db DBStore) FinishBuild(
 	return tx.Commit(ctx)
 }
 
+var ErrBuildFinished error = errors.New("build has already finished")
+
+// CancelBuild cancels a build. Pending builds are marked as canceled right away,
+// while running builds are flagged so that their builder is stopped. Canceling
+// a parent build cancels all of its unfinished jobs.
+// It returns the IDs of the builds that were canceled right away, ErrNoBuild if
+// the build does not exist, and ErrBuildFinished if it is already finished.
+func (db DBStore) CancelBuild(ctx context.Context, buildID uint64, ts time.Time) ([]uint64, error) {
+	tx, err := db.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var jobCount int
+	var finished bool
+	err = tx.QueryRow(
+		ctx,
+		`SELECT job_count, result IS NOT NULL FROM builds WHERE id = $1`,
+		buildID,
+	).Scan(&jobCount, &finished)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNoBuild
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to check build: %w", err)
+	}
+	if finished {
+		return nil, ErrBuildFinished
+	}
+
+	canceledIDs := []uint64{buildID}
+	if jobCount > 0 {
+		rows, err := tx.Query(
+			ctx,
+			`SELECT id FROM builds WHERE parent_id = $1 AND result IS NULL ORDER BY id`,
+			buildID,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query jobs: %w", err)
+		}
+		canceledIDs, err = pgx.CollectRows(rows, pgx.RowTo[uint64])
+		if err != nil {
+			return nil, fmt.Errorf("failed to query jobs: %w", err)
+		}
+	}
+
+	var pendingIDs []uint64
+	for _, id := range canceledIDs {
+		pending, err := cancelBuild(ctx, tx, id, ts)
+		if err != nil {
+			return nil, err
+		}
+		if pending {
+			pendingIDs = append(pendingIDs, id)
+		}
+	}
+
+	if err := notifyBuildEvent(ctx, tx, buildID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return pendingIDs, nil
+}
+
+// cancelBuild cancels a build that is not finished. It returns whether the
+// build was pending and is canceled right away.
+func cancelBuild(ctx context.Context, tx pgx.Tx, buildID uint64, ts time.Time) (bool, error) {
+	tag, err := tx.Exec(
+		ctx,
+		`UPDATE builds
+		SET finished = $1, result = $2
+		WHERE id = $3 AND started IS NULL AND result IS NULL`,
+		ts,
+		BuildResultCanceled,
+		buildID,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to update build: %w", err)
+	}
+	if tag.RowsAffected() > 0 {
+		return true, updateParentBuild(ctx, tx, buildID)
+	}
+
+	// The build is running, its builder is stopped by the processor
+	_, err = tx.Exec(
+		ctx,
+		`UPDATE builders
+		SET cancel_requested = TRUE
+		WHERE build_id = $1`,
+		buildID,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to update builders: %w", err)
+	}
+	return false, nil
+}
+
 type Build struct {
 	ID       uint64
 	RepoID   uint64
@@ -242,6 +470,17 @@ type Build struct {
 	Result   *BuildResult
 	Repo     Repo
 	BuildMeta
+	Job
+}
+
+// Job describes how a build relates to a build matrix. Parent builds have a
+// JobCount, while their jobs have a ParentID, JobIndex starting at 1 and
+// JobEnv. Builds without matrix have none of them.
+type Job struct {
+	ParentID *uint64
+	JobIndex int
+	JobCount int
+	JobEnv   map[string]string
 }
 
 var ErrNoBuild error = errors.New("build does not exist")
@@ -264,6 +503,10 @@ func (db DBStore) GetBuild(ctx context.Context, buildID uint64) (*Build, error)
 			b.started,
 			b.finished,
 			b.result,
+			b.parent_id,
+			b.job_index,
+			b.job_count,
+			b.job_env,
 			r.owner,
 			r.name
 		FROM builds AS b
@@ -283,6 +526,10 @@ func (db DBStore) GetBuild(ctx context.Context, buildID uint64) (*Build, error)
 		&b.Started,
 		&b.Finished,
 		&b.Result,
+		&b.ParentID,
+		&b.JobIndex,
+		&b.JobCount,
+		&b.JobEnv,
 		&b.Repo.Owner,
 		&b.Repo.Name,
 	)
@@ -312,10 +559,16 @@ func (db DBStore) ListBuilds(
 			b.started,
 			b.finished,
 			b.result,
+			b.parent_id,
+			b.job_index,
+			b.job_count,
+			b.job_env,
 			r.owner,
 			r.name
 		FROM builds AS b
 		INNER JOIN repos AS r ON b.repo_id = r.id
+		-- Jobs are listed on the page of their parent
+		WHERE b.parent_id IS NULL
 		ORDER BY b.id DESC
 		LIMIT $1
 		OFFSET $2`,
@@ -341,6 +594,10 @@ func (db DBStore) ListBuilds(
 			&b.Started,
 			&b.Finished,
 			&b.Result,
+			&b.ParentID,
+			&b.JobIndex,
+			&b.JobCount,
+			&b.JobEnv,
 			&b.Repo.Owner,
 			&b.Repo.Name,
 		)
@@ -350,7 +607,7 @@ func (db DBStore) ListBuilds(
 
 func (db DBStore) CountBuilds(ctx context.Context) (uint64, error) {
 	var count uint64
-	err := db.pool.QueryRow(ctx, `SELECT COUNT(*) FROM builds`).Scan(&count)
+	err := db.pool.QueryRow(ctx, `SELECT COUNT(*) FROM builds WHERE parent_id IS NULL`).Scan(&count)
 	return count, err
 }
 
@@ -360,6 +617,7 @@ type PendingBuild struct {
 	Repo      Repo
 	Ref       string
 	CommitSHA string
+	Job
 }
 
 func (db DBStore) GetPendingBuilds(ctx context.Context) ([]PendingBuild, error) {
@@ -371,10 +629,16 @@ func (db DBStore) GetPendingBuilds(ctx context.Context) ([]PendingBuild, error)
 			b.commit_sha,
 			r.owner,
 			r.name,
-			r.cache_id
+			r.cache_id,
+			b.parent_id,
+			b.job_index,
+			b.job_env
 		FROM builds AS b
 		INNER JOIN repos AS r ON b.repo_id = r.id
-		WHERE b.started IS NULL AND b.finished IS NULL AND b.result IS NULL
+		WHERE
+			b.started IS NULL AND b.finished IS NULL AND b.result IS NULL
+			-- Parent builds are not run, only their jobs
+			AND b.job_count = 0
 		ORDER BY id ASC`,
 	)
 	if err != nil {
@@ -393,18 +657,39 @@ func (db DBStore) GetPendingBuilds(ctx context.Context) ([]PendingBuild, error)
 				&b.Repo.Owner,
 				&b.Repo.Name,
 				&b.CacheID,
+				&b.ParentID,
+				&b.JobIndex,
+				&b.JobEnv,
 			)
 			return b, err
 		})
 }
 
+// GetQueuePosition returns the 1-based position of a pending build among all
+// pending builds, in the order in which they are started.
+func (db DBStore) GetQueuePosition(ctx context.Context, buildID uint64) (uint64, error) {
+	var position uint64
+	err := db.pool.QueryRow(
+		ctx,
+		`SELECT COUNT(*)
+		FROM builds
+		WHERE
+			started IS NULL AND finished IS NULL AND result IS NULL
+			AND job_count = 0 AND id <= $1`,
+		buildID,
+	).Scan(&position)
+	return position, err
+}
+
 type Builder struct {
-	PID       int
-	BuildID   uint64
-	Repo      Repo
-	CommitSHA string
-	Ref       string
-	CacheID   *uint64
+	PID             int
+	BuildID         uint64
+	Repo            Repo
+	CommitSHA       string
+	Ref             string
+	CacheID         *uint64
+	CancelRequested bool
+	Job
 }
 
 func (db DBStore) ListBuilders(ctx context.Context) ([]Builder, error) {
@@ -417,7 +702,11 @@ func (db DBStore) ListBuilders(ctx context.Context) ([]Builder, error) {
 			r.name,
 			b.commit_sha,
 			b.ref,
-			br.cache_id
+			br.cache_id,
+			br.cancel_requested,
+			b.parent_id,
+			b.job_index,
+			b.job_env
 		FROM builders AS br
 		INNER JOIN builds AS b ON br.build_id = b.id
 		INNER JOIN repos AS r ON b.repo_id = r.id
@@ -440,6 +729,10 @@ func (db DBStore) ListBuilders(ctx context.Context) ([]Builder, error) {
 				&b.CommitSHA,
 				&b.Ref,
 				&b.CacheID,
+				&b.CancelRequested,
+				&b.ParentID,
+				&b.JobIndex,
+				&b.JobEnv,
 			)
 			return b, err
 		})
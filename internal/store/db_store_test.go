@@ -2,6 +2,9 @@ package store
 
 import (
 	"context"
+	"fmt"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
@@ -52,7 +55,7 @@ func TestBuildStore(t *testing.T) {
 			CommitSHA: "000011",
 			Message:   "message_r1b1",
 		}
-		r1b1ID, err := s.CreateBuild(ctx, "owner", "repo1", r1b1, time.UnixMilli(11))
+		r1b1ID, err := s.CreateBuild(ctx, "owner", "repo1", r1b1, nil, time.UnixMilli(11))
 		assert.NoError(t, err, "Failed to create build").Fatal()
 		assert.Equal(t, r1b1ID, 1, "Incorrect ID for build").Fatal()
 
@@ -62,7 +65,7 @@ func TestBuildStore(t *testing.T) {
 			CommitSHA: "000012",
 			Message:   "message_r1b2",
 		}
-		r1b2ID, err := s.CreateBuild(ctx, "owner", "repo1", r1b2, time.UnixMilli(12))
+		r1b2ID, err := s.CreateBuild(ctx, "owner", "repo1", r1b2, nil, time.UnixMilli(12))
 		assert.NoError(t, err, "Failed to create build").Fatal()
 		assert.Equal(t, r1b2ID, 2, "Incorrect ID for build").Fatal()
 
@@ -72,7 +75,7 @@ func TestBuildStore(t *testing.T) {
 			CommitSHA: "000021",
 			Message:   "message_r2b1",
 		}
-		r2b1ID, err := s.CreateBuild(ctx, "owner", "repo2", r2b1, time.UnixMilli(21))
+		r2b1ID, err := s.CreateBuild(ctx, "owner", "repo2", r2b1, nil, time.UnixMilli(21))
 		assert.NoError(t, err, "Failed to create build").Fatal()
 		assert.Equal(t, r2b1ID, 3, "Incorrect ID for build").Fatal()
 
@@ -82,7 +85,7 @@ func TestBuildStore(t *testing.T) {
 			CommitSHA: "000022",
 			Message:   "message_r2b2",
 		}
-		r2b2ID, err := s.CreateBuild(ctx, "owner", "repo2", r2b2, time.UnixMilli(22))
+		r2b2ID, err := s.CreateBuild(ctx, "owner", "repo2", r2b2, nil, time.UnixMilli(22))
 		assert.NoError(t, err, "Failed to create build").Fatal()
 		assert.Equal(t, r2b2ID, 4, "Incorrect ID for build").Fatal()
 
@@ -109,7 +112,7 @@ func TestBuildStore(t *testing.T) {
 				Name:  "repo2",
 			},
 		}
-		assert.Equal(t, *r2b2got, r2b2want, "Unexpected build retrieved").Fatal()
+		assert.DeepEqual(t, *r2b2got, r2b2want, "Unexpected build retrieved").Fatal()
 
 		_, err = s.GetBuild(ctx, 100)
 		assert.ErrorIs(t, err, ErrNoBuild, "Incorrect error for non-existent build").Fatal()
@@ -123,7 +126,7 @@ func TestBuildStore(t *testing.T) {
 			[]uint64{4, 3, 2, 1},
 			"Incorrect build IDs",
 		).Fatal()
-		assert.Equal(t, builds[0], r2b2want, "Unexpected build retrieved")
+		assert.DeepEqual(t, builds[0], r2b2want, "Unexpected build retrieved")
 
 		// Test listing builds with beforeID and limit
 		builds, err = s.ListBuilds(ctx, 1, 2)
@@ -159,10 +162,30 @@ func TestBuildStore(t *testing.T) {
 	t.Run("Start and finish first build of each repo", func(t *testing.T) {
 		// Finish r1b1 and cache results
 		s.StartBuild(ctx, 1, time.UnixMilli(1011), 10011, nil)
-		s.FinishBuild(ctx, 1, time.UnixMilli(2011), BuildResultSuccess, true)
+		stepStarted, stepFinished, exitCode := time.UnixMilli(1500), time.UnixMilli(2000), 0
+		steps := []BuildStep{
+			{Index: 0, Name: "build", Started: &stepStarted, Finished: &stepFinished, ExitCode: &exitCode},
+			{Index: 1, Name: "deploy", Skipped: true},
+		}
+		expires := time.UnixMilli(5011)
+		artifacts := []Artifact{
+			{Name: "dist/app.tar.gz", Size: 3, SHA256: strings.Repeat("a", 64), Expires: &expires},
+			{Name: "README.md", Size: 6, SHA256: strings.Repeat("b", 64), Expires: &expires},
+		}
+		testResults := []TestResult{
+			{Suite: "pkg", Name: "TestB", Status: TestStatusPassed, Duration: 1500 * time.Millisecond},
+			{Suite: "pkg", Name: "TestA", Status: TestStatusFailed, Message: "expected 1"},
+			{Suite: "pkg", Name: "TestA", Status: TestStatusPassed},
+			{Suite: "cli", Name: "TestC", Status: TestStatusSkipped},
+		}
+		s.FinishBuild(ctx, 1, time.UnixMilli(2011), BuildResultSuccess, true, BuildOutput{
+			Steps:       steps,
+			Artifacts:   artifacts,
+			TestResults: testResults,
+		})
 		// Finish r2b1 without caching results
 		s.StartBuild(ctx, 3, time.UnixMilli(1021), 10021, nil)
-		s.FinishBuild(ctx, 3, time.UnixMilli(2021), BuildResultSuccess, false)
+		s.FinishBuild(ctx, 3, time.UnixMilli(2021), BuildResultSuccess, false, BuildOutput{})
 
 		pendingBuilds, err := s.GetPendingBuilds(ctx)
 		assert.NoError(t, err, "Failed to get pending builds")
@@ -187,6 +210,62 @@ func TestBuildStore(t *testing.T) {
 		assert.NoError(t, err, "Failed to get build")
 		assert.Equal(t, *r2r1got.Started, time.UnixMilli(1021), "Incorrect start time")
 		assert.Equal(t, *r2r1got.Finished, time.UnixMilli(2021), "Incorrect start time")
+
+		// Check steps
+		r1r1steps, err := s.GetBuildSteps(ctx, 1)
+		assert.NoError(t, err, "Failed to get build steps").Fatal()
+		assert.Equal(t, len(r1r1steps), 2, "Incorrect number of build steps").Fatal()
+		assert.Equal(t, r1r1steps[0].Name, "build", "Incorrect step name")
+		assert.Equal(t, *r1r1steps[0].Started, stepStarted, "Incorrect step start time")
+		assert.Equal(t, *r1r1steps[0].ExitCode, 0, "Incorrect step exit code")
+		assert.Equal(t, r1r1steps[1].Name, "deploy", "Incorrect step name")
+		assert.Equal(t, r1r1steps[1].Skipped, true, "Step not skipped")
+		assert.Equal(t, r1r1steps[1].ExitCode, nil, "Incorrect step exit code")
+
+		r2r1steps, err := s.GetBuildSteps(ctx, 3)
+		assert.NoError(t, err, "Failed to get build steps")
+		assert.Equal(t, len(r2r1steps), 0, "Incorrect number of build steps")
+
+		// Check artifacts
+		r1r1artifacts, err := s.GetArtifacts(ctx, 1)
+		assert.NoError(t, err, "Failed to get artifacts").Fatal()
+		assert.Equal(t, len(r1r1artifacts), 2, "Incorrect number of artifacts").Fatal()
+		// Ordered by name
+		assert.Equal(t, r1r1artifacts[0].Name, "README.md", "Incorrect artifact name")
+		assert.Equal(t, r1r1artifacts[1].Size, 3, "Incorrect artifact size")
+		assert.Equal(t, *r1r1artifacts[1].Expires, expires, "Incorrect artifact expiry")
+
+		artifact, err := s.GetArtifact(ctx, 1, "dist/app.tar.gz")
+		assert.NoError(t, err, "Failed to get artifact").Fatal()
+		assert.Equal(t, artifact.SHA256, strings.Repeat("a", 64), "Incorrect artifact hash")
+
+		_, err = s.GetArtifact(ctx, 3, "dist/app.tar.gz")
+		assert.ErrorIs(t, err, ErrNoArtifact, "Incorrect error for non-existent artifact")
+
+		expiredIDs, err := s.DeleteExpiredArtifacts(ctx, time.UnixMilli(5000))
+		assert.NoError(t, err, "Failed to delete expired artifacts")
+		assert.Equal(t, len(expiredIDs), 0, "Deleted artifacts before they expired")
+
+		expiredIDs, err = s.DeleteExpiredArtifacts(ctx, time.UnixMilli(6000))
+		assert.NoError(t, err, "Failed to delete expired artifacts")
+		assert.DeepEqual(t, expiredIDs, []uint64{1}, "Incorrect builds with expired artifacts")
+
+		r1r1artifacts, err = s.GetArtifacts(ctx, 1)
+		assert.NoError(t, err, "Failed to get artifacts")
+		assert.Equal(t, len(r1r1artifacts), 0, "Expired artifacts were not deleted")
+
+		// Check test results, failed tests first and duplicates keep the failure
+		r1r1tests, err := s.GetTestResults(ctx, 1)
+		assert.NoError(t, err, "Failed to get test results")
+		assert.DeepEqual(t,
+			r1r1tests,
+			[]TestResult{
+				{Suite: "pkg", Name: "TestA", Status: TestStatusFailed, Message: "expected 1"},
+				{Suite: "cli", Name: "TestC", Status: TestStatusSkipped},
+				{Suite: "pkg", Name: "TestB", Status: TestStatusPassed, Duration: 1500 * time.Millisecond},
+			},
+			"Incorrect test results",
+		)
 	})
 
 	t.Run("Start second build of each repo", func(t *testing.T) {
@@ -212,4 +291,390 @@ func TestBuildStore(t *testing.T) {
 		assert.NoError(t, err, "Failed to list build dirs in use")
 		assert.DeepEqual(t, buildIDs, []uint64{1, 2, 4}, "Incorrect build dirs in use")
 	})
+
+	t.Run("Cancel builds", func(t *testing.T) {
+		// Cancel pending build
+		r1b3 := BuildMeta{
+			Link:      "https://github.com/owner/repos1/b3",
+			Ref:       "ref_r1b3",
+			CommitSHA: "000013",
+			Message:   "message_r1b3",
+		}
+		r1b3ID, err := s.CreateBuild(ctx, "owner", "repo1", r1b3, nil, time.UnixMilli(13))
+		assert.NoError(t, err, "Failed to create build").Fatal()
+
+		canceledIDs, err := s.CancelBuild(ctx, r1b3ID, time.UnixMilli(3013))
+		assert.NoError(t, err, "Failed to cancel pending build")
+		assert.DeepEqual(t, canceledIDs, []uint64{r1b3ID}, "Incorrect builds canceled right away")
+
+		r1b3got, err := s.GetBuild(ctx, r1b3ID)
+		assert.NoError(t, err, "Failed to get build").Fatal()
+		assert.Equal(t, *r1b3got.Result, BuildResultCanceled, "Incorrect result")
+		assert.Equal(t, *r1b3got.Finished, time.UnixMilli(3013), "Incorrect finish time")
+
+		pendingBuilds, err := s.GetPendingBuilds(ctx)
+		assert.NoError(t, err, "Failed to get pending builds")
+		assert.Equal(t, len(pendingBuilds), 0, "Canceled build is still pending")
+
+		// Cancel running build
+		canceledIDs, err = s.CancelBuild(ctx, 2, time.UnixMilli(3012))
+		assert.NoError(t, err, "Failed to cancel running build")
+		assert.Equal(t, len(canceledIDs), 0, "Running build canceled right away")
+
+		builders, err := s.ListBuilders(ctx)
+		assert.NoError(t, err, "Failed to list builders").Fatal()
+		assert.Equal(t, builders[0].CancelRequested, true, "Cancel not requested")
+		assert.Equal(t, builders[1].CancelRequested, false, "Cancel requested for wrong build")
+
+		// Cancel finished and non-existent builds
+		_, err = s.CancelBuild(ctx, 1, time.UnixMilli(3011))
+		assert.ErrorIs(t, err, ErrBuildFinished, "Incorrect error for finished build")
+
+		_, err = s.CancelBuild(ctx, 100, time.UnixMilli(3011))
+		assert.ErrorIs(t, err, ErrNoBuild, "Incorrect error for non-existent build")
+	})
+
+	t.Run("Fan out build into jobs", func(t *testing.T) {
+		r1b4 := BuildMeta{
+			Link:      "https://github.com/owner/repos1/b4",
+			Ref:       "ref_r1b4",
+			CommitSHA: "000014",
+			Message:   "message_r1b4",
+		}
+		jobs := []map[string]string{{"GO_VERSION": "1.23"}, {"GO_VERSION": "1.24"}}
+		parentID, err := s.CreateBuild(ctx, "owner", "repo1", r1b4, jobs, time.UnixMilli(14))
+		assert.NoError(t, err, "Failed to create build").Fatal()
+
+		// Only the jobs are pending, not their parent
+		pendingBuilds, err := s.GetPendingBuilds(ctx)
+		assert.NoError(t, err, "Failed to get pending builds").Fatal()
+		assert.Equal(t, len(pendingBuilds), 2, "Incorrect number of pending builds").Fatal()
+		assert.Equal(t, *pendingBuilds[0].ParentID, parentID, "Incorrect parent ID")
+		assert.Equal(t, pendingBuilds[0].JobIndex, 1, "Incorrect job index")
+		assert.DeepEqual(t, pendingBuilds[0].JobEnv, jobs[0], "Incorrect job env")
+		assert.Equal(t, pendingBuilds[1].JobIndex, 2, "Incorrect job index")
+		assert.DeepEqual(t, pendingBuilds[1].JobEnv, jobs[1], "Incorrect job env")
+
+		// Jobs are not listed as builds
+		builds, err := s.ListBuilds(ctx, 0, 1)
+		assert.NoError(t, err, "Failed to list builds").Fatal()
+		assert.Equal(t, builds[0].ID, parentID, "Incorrect latest build")
+		assert.Equal(t, builds[0].JobCount, 2, "Incorrect job count")
+
+		jobBuilds, err := s.ListJobs(ctx, parentID)
+		assert.NoError(t, err, "Failed to list jobs").Fatal()
+		assert.Equal(t, len(jobBuilds), 2, "Incorrect number of jobs").Fatal()
+		assert.Equal(t, jobBuilds[0].Number, builds[0].Number, "Job has different build number")
+		job1, job2 := jobBuilds[0].ID, jobBuilds[1].ID
+
+		// The parent starts with its first job
+		s.StartBuild(ctx, job1, time.UnixMilli(1014), 10014, nil)
+		s.FinishBuild(ctx, job1, time.UnixMilli(2014), BuildResultSuccess, false, BuildOutput{})
+
+		parent, err := s.GetBuild(ctx, parentID)
+		assert.NoError(t, err, "Failed to get build").Fatal()
+		assert.Equal(t, *parent.Started, time.UnixMilli(1014), "Incorrect start time")
+		assert.Equal(t, parent.Finished, nil, "Parent finished before its jobs")
+		assert.Equal(t, parent.Result, nil, "Parent has result before its jobs")
+
+		// Canceling the parent cancels its unfinished jobs
+		canceledIDs, err := s.CancelBuild(ctx, parentID, time.UnixMilli(3014))
+		assert.NoError(t, err, "Failed to cancel build")
+		assert.DeepEqual(t, canceledIDs, []uint64{job2}, "Incorrect builds canceled right away")
+
+		job2got, err := s.GetBuild(ctx, job2)
+		assert.NoError(t, err, "Failed to get build").Fatal()
+		assert.Equal(t, *job2got.Result, BuildResultCanceled, "Incorrect job result")
+
+		parent, err = s.GetBuild(ctx, parentID)
+		assert.NoError(t, err, "Failed to get build").Fatal()
+		assert.Equal(t, *parent.Finished, time.UnixMilli(3014), "Incorrect finish time")
+		assert.Equal(t, *parent.Result, BuildResultCanceled, "Incorrect result")
+
+		_, err = s.CancelBuild(ctx, parentID, time.UnixMilli(3015))
+		assert.ErrorIs(t, err, ErrBuildFinished, "Incorrect error for finished build")
+	})
+
+	t.Run("Detect flaky tests", func(t *testing.T) {
+		passed := func(name string) TestResult {
+			return TestResult{Suite: "pkg", Name: name, Status: TestStatusPassed}
+		}
+		failed := func(name string) TestResult {
+			return TestResult{Suite: "pkg", Name: name, Status: TestStatusFailed}
+		}
+		runBuild := func(ref, commitSHA string, ts int64, results ...TestResult) uint64 {
+			meta := BuildMeta{Ref: ref, CommitSHA: commitSHA}
+			id, err := s.CreateBuild(ctx, "owner", "repo2", meta, nil, time.UnixMilli(ts))
+			assert.NoError(t, err, "Failed to create build").Fatal()
+			s.StartBuild(ctx, id, time.UnixMilli(ts+1), 10000, nil)
+			s.FinishBuild(ctx, id, time.UnixMilli(ts+2), BuildResultFailed, false, BuildOutput{
+				TestResults: results,
+			})
+			return id
+		}
+
+		main := "refs/heads/main"
+		runBuild(main, "c1", 100, passed("TestFlaky"), passed("TestBroken"), failed("TestFixed"))
+		b2 := runBuild(main, "c2", 200, failed("TestFlaky"), failed("TestBroken"), passed("TestFixed"))
+		b3 := runBuild(main, "c3", 300, passed("TestFlaky"), failed("TestBroken"), failed("TestRerun"))
+		// Re-run of the same commit
+		runBuild(main, "c3", 400, passed("TestFlaky"), failed("TestBroken"), passed("TestRerun"))
+		// Builds of other refs are ignored
+		runBuild("refs/heads/feature", "c4", 500, passed("TestBroken"), failed("TestFlaky"), passed("TestFlaky"))
+
+		flakyTests, err := s.ListFlakyTests(ctx, "owner", "repo2", main)
+		assert.NoError(t, err, "Failed to list flaky tests").Fatal()
+		assert.DeepEqual(t,
+			flakyTests,
+			[]FlakyTest{
+				{Suite: "pkg", Name: "TestRerun", Flips: 1, LastBuildID: b3, LastFinished: time.UnixMilli(302)},
+				{Suite: "pkg", Name: "TestFlaky", Flips: 1, LastBuildID: b2, LastFinished: time.UnixMilli(202)},
+			},
+			"Incorrect flaky tests",
+		)
+	})
+
+	t.Run("List repos of builds", func(t *testing.T) {
+		meta := BuildMeta{Ref: "refs/heads/main", CommitSHA: "c5"}
+		id, err := s.CreateBuild(ctx, "owner", "repo2", meta, nil, time.UnixMilli(600))
+		assert.NoError(t, err, "Failed to create build").Fatal()
+		s.StartBuild(ctx, id, time.UnixMilli(601), 10000, nil)
+		s.FinishBuild(ctx, id, time.UnixMilli(602), BuildResultSuccess, false, BuildOutput{})
+
+		// Builds that don't exist are left out
+		builds, err := s.ListBuildRepos(ctx, []uint64{id, id + 1000})
+		assert.NoError(t, err, "Failed to list repos of builds").Fatal()
+		finished := time.UnixMilli(602)
+		assert.DeepEqual(t,
+			builds,
+			[]BuildRepo{{BuildID: id, Repo: Repo{Owner: "owner", Name: "repo2"}, Finished: &finished}},
+			"Incorrect repos of builds",
+		)
+	})
+
+	t.Run("Drop repo cache", func(t *testing.T) {
+		repo := Repo{Owner: "owner", Name: "repo2"}
+		meta := BuildMeta{Ref: "refs/heads/main", CommitSHA: "c6"}
+		id, err := s.CreateBuild(ctx, repo.Owner, repo.Name, meta, nil, time.UnixMilli(700))
+		assert.NoError(t, err, "Failed to create build").Fatal()
+		s.StartBuild(ctx, id, time.UnixMilli(701), 10000, nil)
+		s.FinishBuild(ctx, id, time.UnixMilli(702), BuildResultSuccess, true, BuildOutput{})
+
+		caches, err := s.ListRepoCaches(ctx)
+		assert.NoError(t, err, "Failed to list repo caches").Fatal()
+		assert.Equal(t, slices.Contains(caches, RepoCache{Repo: repo, CacheID: id}), true, "Build dir is not used as cache")
+
+		// Dropping an older cache keeps the current one
+		err = s.DropRepoCache(ctx, repo, id-1)
+		assert.NoError(t, err, "Failed to drop repo cache")
+		dirsInUse, err := s.ListBuildDirsInUse(ctx)
+		assert.NoError(t, err, "Failed to list build dirs in use").Fatal()
+		assert.Equal(t, slices.Contains(dirsInUse, id), true, "Current cache was dropped")
+
+		err = s.DropRepoCache(ctx, repo, id)
+		assert.NoError(t, err, "Failed to drop repo cache")
+		dirsInUse, err = s.ListBuildDirsInUse(ctx)
+		assert.NoError(t, err, "Failed to list build dirs in use").Fatal()
+		assert.Equal(t, slices.Contains(dirsInUse, id), false, "Dropped cache is still in use")
+	})
+
+	t.Run("Notify on build events", func(t *testing.T) {
+		listenCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		notify := make(chan struct{}, 1)
+		listenErr := make(chan error, 1)
+		go func() {
+			listenErr <- s.ListenForBuildEvents(listenCtx, notify)
+		}()
+
+		// Keep creating builds until the listener is set up and notified
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		timeout := time.After(5 * time.Second)
+
+	LOOP:
+		for {
+			select {
+			case <-notify:
+				break LOOP
+			case <-ticker.C:
+				_, err := s.CreateBuild(ctx, "owner", "repo2", BuildMeta{Ref: "ref_notify"}, nil, time.Now())
+				assert.NoError(t, err, "Failed to create build").Fatal()
+			case <-timeout:
+				t.Fatal("No notification received")
+			}
+		}
+
+		cancel()
+		err := <-listenErr
+		assert.ErrorIs(t, err, context.Canceled, "Incorrect error after canceling listener")
+	})
+
+	t.Run("Prune builds", func(t *testing.T) {
+		err := s.CreateRepoIfNotExists(ctx, Repo{Owner: "owner", Name: "repo3"})
+		assert.NoError(t, err, "Failed to create owner/repo3").Fatal()
+
+		runBuild := func(ref string, ts int64, cacheBuildFiles bool) uint64 {
+			meta := BuildMeta{Ref: ref, CommitSHA: "c1"}
+			id, err := s.CreateBuild(ctx, "owner", "repo3", meta, nil, time.UnixMilli(ts))
+			assert.NoError(t, err, "Failed to create build").Fatal()
+			s.StartBuild(ctx, id, time.UnixMilli(ts), 10000, nil)
+			s.FinishBuild(ctx, id, time.UnixMilli(ts), BuildResultSuccess, cacheBuildFiles, BuildOutput{})
+			return id
+		}
+
+		main, feature := "refs/heads/main", "refs/heads/feature"
+		b1 := runBuild(main, 1000, false)
+		// Build matrix, which is pruned with its jobs
+		m, err := s.CreateBuild(
+			ctx, "owner", "repo3", BuildMeta{Ref: feature, CommitSHA: "c1"},
+			[]map[string]string{{"GO": "1.23"}, {"GO": "1.24"}}, time.UnixMilli(1000),
+		)
+		assert.NoError(t, err, "Failed to create build").Fatal()
+		jobBuilds, err := s.ListJobs(ctx, m)
+		assert.NoError(t, err, "Failed to list jobs").Fatal()
+		assert.Equal(t, len(jobBuilds), 2, "Incorrect number of jobs").Fatal()
+		j1, j2 := jobBuilds[0].ID, jobBuilds[1].ID
+		for _, id := range []uint64{j1, j2} {
+			s.StartBuild(ctx, id, time.UnixMilli(1000), 10000, nil)
+			s.FinishBuild(ctx, id, time.UnixMilli(1000), BuildResultSuccess, false, BuildOutput{})
+		}
+		// Build dir used as cache
+		b2 := runBuild(main, 1001, true)
+		b3 := runBuild(feature, 1002, false)
+		// Latest finished build of the default branch
+		b4 := runBuild(main, 1003, false)
+		b5 := runBuild(feature, 1004, false)
+		// Newer than the retention period
+		b6 := runBuild(feature, 1006, false)
+		// Unfinished
+		b7, err := s.CreateBuild(ctx, "owner", "repo3", BuildMeta{Ref: feature}, nil, time.UnixMilli(1000))
+		assert.NoError(t, err, "Failed to create build").Fatal()
+
+		policy := PrunePolicy{
+			// Keeps b7 and b6
+			KeepBuilds:  2,
+			KeepAfter:   time.UnixMilli(1005),
+			DefaultRefs: map[Repo]string{{Owner: "owner", Name: "repo3"}: main},
+			DryRun:      true,
+		}
+		noFiles := func(buildIDs []uint64) []uint64 {
+			t.Errorf("Removed files in dry run")
+			return nil
+		}
+		wantPruned := []uint64{b1, m, j1, j2, b3, b5}
+		wantKept := []uint64{b2, b4, b6, b7}
+
+		dryRunIDs, err := s.PruneBuilds(ctx, policy, noFiles)
+		assert.NoError(t, err, "Failed to prune builds in dry run").Fatal()
+		for _, id := range wantPruned {
+			assert.Equal(t, slices.Contains(dryRunIDs, id), true, "Build not pruned in dry run")
+		}
+		for _, id := range wantKept {
+			assert.Equal(t, slices.Contains(dryRunIDs, id), false, "Build pruned in dry run")
+		}
+		_, err = s.GetBuild(ctx, b1)
+		assert.NoError(t, err, "Build was deleted in dry run")
+
+		// Builds are kept if their files can't be removed, and build matrices if
+		// the files of one of their jobs can't be removed
+		policy.DryRun = false
+		prunedIDs, err := s.PruneBuilds(ctx, policy, func(buildIDs []uint64) []uint64 {
+			assert.DeepEqual(t, buildIDs, dryRunIDs, "Incorrect build files removed")
+			var removedIDs []uint64
+			for _, id := range buildIDs {
+				if id != b1 && id != j2 {
+					removedIDs = append(removedIDs, id)
+				}
+			}
+			return removedIDs
+		})
+		assert.NoError(t, err, "Failed to prune builds").Fatal()
+		assert.DeepEqual(t, prunedIDs, []uint64{b3, b5}, "Incorrect builds pruned")
+		for _, id := range []uint64{b1, m, j1, j2} {
+			_, err = s.GetBuild(ctx, id)
+			assert.NoError(t, err, "Build was deleted although files were not removed")
+		}
+
+		// The next run prunes the remaining builds
+		var removedIDs []uint64
+		prunedIDs, err = s.PruneBuilds(ctx, policy, func(buildIDs []uint64) []uint64 {
+			removedIDs = buildIDs
+			return buildIDs
+		})
+		assert.NoError(t, err, "Failed to prune builds").Fatal()
+		assert.DeepEqual(t, prunedIDs, []uint64{b1, m, j1, j2}, "Incorrect builds pruned")
+		assert.DeepEqual(t, removedIDs, prunedIDs, "Incorrect build files removed")
+		for _, id := range wantPruned {
+			_, err = s.GetBuild(ctx, id)
+			assert.ErrorIs(t, err, ErrNoBuild, "Build was not deleted")
+		}
+		for _, id := range wantKept {
+			_, err = s.GetBuild(ctx, id)
+			assert.NoError(t, err, "Build was deleted")
+		}
+	})
+
+	t.Run("Search logs", func(t *testing.T) {
+		err := s.CreateRepoIfNotExists(ctx, Repo{Owner: "owner", Name: "repo3"})
+		assert.NoError(t, err, "Failed to create owner/repo3").Fatal()
+
+		runBuild := func(ts int64, result BuildResult, lines ...string) uint64 {
+			meta := BuildMeta{Ref: "refs/heads/main", CommitSHA: "c6"}
+			id, err := s.CreateBuild(ctx, "owner", "repo3", meta, nil, time.UnixMilli(ts))
+			assert.NoError(t, err, "Failed to create build").Fatal()
+			s.StartBuild(ctx, id, time.UnixMilli(ts+1), 10000, nil)
+
+			var logLines []LogLine
+			for i, text := range lines {
+				logLines = append(logLines, LogLine{Number: i, Text: text})
+			}
+			err = s.FinishBuild(ctx, id, time.UnixMilli(ts+2), result, false, BuildOutput{})
+			assert.NoError(t, err, "Failed to finish build").Fatal()
+			err = s.InsertLogLines(ctx, id, logLines)
+			assert.NoError(t, err, "Failed to insert log lines").Fatal()
+			return id
+		}
+		b1 := runBuild(700, BuildResultFailed, "go test ./...", "panic: connection refused", "FAIL")
+		b2 := runBuild(800, BuildResultSuccess, "retrying: connection refused", "connection refused", "ok")
+
+		search := func(q LogSearch) []string {
+			hits, err := s.SearchLogs(ctx, q, 1, 10)
+			assert.NoError(t, err, "Failed to search logs").Fatal()
+			var found []string
+			for _, h := range hits {
+				assert.Equal(t, h.Repo, Repo{Owner: "owner", Name: "repo3"}, "Incorrect repo")
+				found = append(found, fmt.Sprintf("%d:%d", h.BuildID, h.Line.Number))
+			}
+			return found
+		}
+
+		// Only the first line of each build is returned, the latest build first
+		assert.DeepEqual(t,
+			search(LogSearch{Query: "Connection refused"}),
+			[]string{fmt.Sprintf("%d:0", b2), fmt.Sprintf("%d:1", b1)},
+			"Incorrect hits",
+		)
+		assert.DeepEqual(t,
+			search(LogSearch{Query: `"connection refused" -panic`}),
+			[]string{fmt.Sprintf("%d:0", b2)},
+			"Incorrect hits for excluded word",
+		)
+		assert.DeepEqual(t,
+			search(LogSearch{Query: "connection", Result: BuildResultFailed}),
+			[]string{fmt.Sprintf("%d:1", b1)},
+			"Incorrect hits for result",
+		)
+		assert.DeepEqual(t,
+			search(LogSearch{Query: "connection", CreatedBefore: time.UnixMilli(800)}),
+			[]string{fmt.Sprintf("%d:1", b1)},
+			"Incorrect hits for time range",
+		)
+		assert.DeepEqual(t,
+			search(LogSearch{Query: "connection", Repo: Repo{Owner: "owner", Name: "repo1"}}),
+			nil,
+			"Incorrect hits for other repo",
+		)
+	})
 }
@@ -1,12 +1,10 @@
 package store
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"slices"
@@ -19,46 +17,83 @@ import (
  *   build/
  *     <ID>/             build dir for build with ID
  *   exit_code/
- *     <ID>            exit code of the build command
+ *     <ID>            exit code of the build command, or "timeout"
+ *   build-steps/
+ *     <ID>.json         steps of running build with ID
+ *   artifacts/
+ *     <ID>/             artifacts of build with ID
+ *     <ID>.json         artifacts of running build with ID
+ *   test-results/
+ *     <ID>.json         test results of running build with ID
+ *   caches/             keyed cache entries of each repo, see caches.go
  *   build-logs/
- *     <ID>.jsonl        log file for build with ID
+ *     <ID>.jsonl        log file for running build with ID
+ *     <ID>.jsonl.gz     compressed log file for finished build with ID
+ *     <ID>.idx          offsets of the lines in the log file for build with ID
  *   builder-logs/
- *     <ID>.jsonl        log file for builder with ID
+ *     <ID>.txt          log file for builder with ID
  *
  *
- * The cache dir is used to speed up builds on the default branch.
- * It is copied into the build dir before the build starts.
- * After a successful build on the default branch, the build dir
- * is moved to the cache dir.
+ * For repos without keyed caches, the build dir of the last successful
+ * build on the default branch is used as cache. It is copied into the
+ * build dir before the build starts. How files are copied depends on the
+ * copy strategy, see copy.go.
  */
 
 type FSStore struct {
 	RootDir string
+	// How build dirs and cache entries are copied, see ResolveCopyStrategy.
+	// Files are copied if it is empty.
+	CopyStrategy CopyStrategy
 }
 
 func (fs *FSStore) WriteExitCode(buildID uint64, exitCode int) error {
-	exitCodePath := path.Join(fs.RootDir, "exit-code", strconv.FormatUint(buildID, 10))
-	return os.WriteFile(exitCodePath, []byte(strconv.Itoa(exitCode)), 0o600)
+	return os.WriteFile(fs.exitCodePath(buildID), []byte(strconv.Itoa(exitCode)), 0o600)
 }
 
-func (fs *FSStore) ReadAndCleanExitCode(buildID uint64) (int, error) {
-	exitCodeFile := path.Join(fs.RootDir, "exit-code", strconv.FormatUint(buildID, 10))
+// exitCodeTimeout is written instead of an exit code when the builder killed a
+// command because it exceeded its timeout.
+const exitCodeTimeout = "timeout"
+
+var ErrBuildTimedOut = errors.New("build timed out")
+
+func (fs *FSStore) WriteTimeout(buildID uint64) error {
+	return os.WriteFile(fs.exitCodePath(buildID), []byte(exitCodeTimeout), 0o600)
+}
+
+// ReadExitCode reads the exit code that the builder wrote for a build. It
+// returns ErrBuildTimedOut if a command of the build timed out. The exit code
+// is kept until RemoveExitCode, so that it is read again if finishing the
+// build fails.
+func (fs *FSStore) ReadExitCode(buildID uint64) (int, error) {
 	// sec: Path is from a trusted user
-	data, err := os.ReadFile(exitCodeFile) // #nosec G304
+	data, err := os.ReadFile(fs.exitCodePath(buildID)) // #nosec G304
 	if err != nil {
 		return 0, err
 	}
 
+	if string(data) == exitCodeTimeout {
+		return 0, ErrBuildTimedOut
+	}
+
 	exitCode, err := strconv.ParseUint(string(data), 10, 32)
 	if err != nil {
 		return 0, err
 	}
+	return int(exitCode), nil
+}
 
-	if err := os.Remove(exitCodeFile); err != nil {
-		return int(exitCode), err
+// RemoveExitCode removes the exit code of a build once the build finished.
+func (fs *FSStore) RemoveExitCode(buildID uint64) error {
+	err := os.Remove(fs.exitCodePath(buildID))
+	if err != nil && !os.IsNotExist(err) {
+		return err
 	}
+	return nil
+}
 
-	return int(exitCode), nil
+func (fs *FSStore) exitCodePath(buildID uint64) string {
+	return path.Join(fs.RootDir, "exit-code", strconv.FormatUint(buildID, 10))
 }
 
 // CreateBuildDir creates directory, which contains another directory under
@@ -72,15 +107,14 @@ func (fs *FSStore) CreateBuildDir(
 
 	if cacheID != nil {
 		cacheDir := path.Join(fs.RootDir, "build", strconv.FormatUint(*cacheID, 10))
-		// copyDirs will create the build dir
-		if err := copyDirs(cacheDir, buildDir); err != nil {
+		if err := fs.createBuildDir(buildDir, &cacheDir); err != nil {
 			return "", fmt.Errorf(
 				"failed to copy repo cache dir '%s' to build dir '%s': %w",
 				cacheDir, buildDir, err,
 			)
 		}
 	} else {
-		if err := os.Mkdir(buildDir, 0o700); err != nil {
+		if err := fs.createBuildDir(buildDir, nil); err != nil {
 			return "", fmt.Errorf("failed to create empty dir: %w", err)
 		}
 	}
@@ -99,20 +133,6 @@ func (fs *FSStore) CreateBuildDir(
 	return absBuildDir, nil
 }
 
-func copyDirs(src, dst string) error {
-	// Use cp -a for archive copy (preserving most (all?) attributes and symlinks)
-	cpCmd := exec.Command("cp", "-a", src, dst)
-
-	out := &bytes.Buffer{}
-	cpCmd.Stdout = out
-	cpCmd.Stderr = out
-
-	if err := cpCmd.Run(); err != nil {
-		return fmt.Errorf("failed to copy dirs: w%\n\ncp output:\n%s", err, out)
-	}
-	return nil
-}
-
 func (fs *FSStore) RetainBuildDirs(retainedIDs []uint64) ([]uint64, error) {
 	buildRootDir := path.Join(fs.RootDir, "build")
 	entries, err := os.ReadDir(buildRootDir)
@@ -139,7 +159,7 @@ func (fs *FSStore) RetainBuildDirs(retainedIDs []uint64) ([]uint64, error) {
 		}
 
 		buildDir := path.Join(buildRootDir, strconv.FormatUint(id, 10))
-		err := removeAll(buildDir)
+		err := fs.removeBuildDir(buildDir)
 		if err != nil {
 			errs = append(errs, fmt.Errorf("failed to delete cache dir: %w", err))
 			continue
@@ -181,20 +201,44 @@ func (fs *FSStore) CreateRootDirs() error {
 	if err := os.MkdirAll(path.Join(fs.RootDir, "exit-code"), 0o700); err != nil {
 		return err
 	}
+	if err := os.MkdirAll(path.Join(fs.RootDir, "build-steps"), 0o700); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Join(fs.RootDir, "artifacts"), 0o700); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Join(fs.RootDir, "test-results"), 0o700); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Join(fs.RootDir, "caches"), 0o700); err != nil {
+		return err
+	}
 	if err := os.MkdirAll(path.Join(fs.RootDir, "build"), 0o700); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (fs *FSStore) OpenBuildLogs(buildID uint64) (io.WriteCloser, error) {
-	logFilePath := path.Join(fs.RootDir, "build-logs", fmt.Sprintf("%d.jsonl", buildID))
+func (fs *FSStore) OpenBuilderLogs(buildID uint64) (io.WriteCloser, error) {
+	logFilePath := fs.builderLogPath(buildID)
 	// sec: Path is from a trusted user
 	return os.OpenFile(logFilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600) // #nosec G304
 }
 
-func (fs *FSStore) OpenBuilderLogs(buildID uint64) (io.WriteCloser, error) {
-	logFilePath := path.Join(fs.RootDir, "builder-logs", fmt.Sprintf("%d.txt", buildID))
+// ReadBuilderLogs opens the logs of the builder of a build for reading. It
+// returns nil if there are no logs.
+func (fs *FSStore) ReadBuilderLogs(buildID uint64) (*os.File, error) {
+	logFilePath := fs.builderLogPath(buildID)
 	// sec: Path is from a trusted user
-	return os.OpenFile(logFilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600) // #nosec G304
+	logFile, err := os.Open(logFilePath) // #nosec G304
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open builder log file '%s': %w", logFilePath, err)
+	}
+	return logFile, nil
+}
+
+func (fs *FSStore) builderLogPath(buildID uint64) string {
+	return path.Join(fs.RootDir, "builder-logs", fmt.Sprintf("%d.txt", buildID))
 }
@@ -1,9 +1,14 @@
 package store
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/ctbur/ci-server/v2/internal/assert"
 )
@@ -40,3 +45,586 @@ func TestRemoveAll(t *testing.T) {
 		t.Errorf("Directory was not deleted. os.Stat returned %v", err)
 	}
 }
+
+func TestExitCode(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "exit-code-test")
+	assert.NoError(t, err, "Failed to create temp directory").Fatal()
+	defer os.RemoveAll(tempDir)
+
+	fs := FSStore{RootDir: tempDir}
+	err = fs.CreateRootDirs()
+	assert.NoError(t, err, "Failed to create root dirs").Fatal()
+
+	err = fs.WriteExitCode(1, 3)
+	assert.NoError(t, err, "Failed to write exit code")
+	err = fs.WriteTimeout(2)
+	assert.NoError(t, err, "Failed to write timeout")
+
+	exitCode, err := fs.ReadExitCode(1)
+	assert.NoError(t, err, "Failed to read exit code")
+	assert.Equal(t, exitCode, 3, "Incorrect exit code")
+
+	_, err = fs.ReadExitCode(2)
+	assert.ErrorIs(t, err, ErrBuildTimedOut, "Incorrect error for timed out build")
+
+	// Exit codes are kept until they are removed
+	exitCode, err = fs.ReadExitCode(1)
+	assert.NoError(t, err, "Failed to read exit code again")
+	assert.Equal(t, exitCode, 3, "Incorrect exit code")
+
+	for _, id := range []uint64{1, 2, 3} {
+		err = fs.RemoveExitCode(id)
+		assert.NoError(t, err, "Failed to remove exit code")
+	}
+	_, err = fs.ReadExitCode(1)
+	assert.ErrorIs(t, err, os.ErrNotExist, "Exit code was not removed")
+	_, err = fs.ReadExitCode(2)
+	assert.ErrorIs(t, err, os.ErrNotExist, "Timeout was not removed")
+}
+
+func TestBuildSteps(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "build-steps-test")
+	assert.NoError(t, err, "Failed to create temp directory").Fatal()
+	defer os.RemoveAll(tempDir)
+
+	fs := FSStore{RootDir: tempDir}
+	err = fs.CreateRootDirs()
+	assert.NoError(t, err, "Failed to create root dirs").Fatal()
+
+	steps, err := fs.ReadBuildSteps(1)
+	assert.NoError(t, err, "Failed to read missing build steps")
+	assert.Equal(t, len(steps), 0, "Got steps before they were written")
+
+	exitCode := 0
+	written := []BuildStep{
+		{Index: 0, Name: "build", ExitCode: &exitCode},
+		{Index: 1, Name: "deploy", Skipped: true},
+	}
+	err = fs.WriteBuildSteps(1, written)
+	assert.NoError(t, err, "Failed to write build steps").Fatal()
+
+	steps, err = fs.ReadBuildSteps(1)
+	assert.NoError(t, err, "Failed to read build steps")
+	assert.DeepEqual(t, steps, written, "Incorrect build steps")
+
+	err = fs.RemoveBuildSteps(1)
+	assert.NoError(t, err, "Failed to remove build steps")
+	steps, err = fs.ReadBuildSteps(1)
+	assert.NoError(t, err, "Failed to read removed build steps")
+	assert.Equal(t, len(steps), 0, "Build steps were not removed")
+}
+
+func TestArtifacts(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "artifacts-test")
+	assert.NoError(t, err, "Failed to create temp directory").Fatal()
+	defer os.RemoveAll(tempDir)
+
+	fs := FSStore{RootDir: tempDir}
+	err = fs.CreateRootDirs()
+	assert.NoError(t, err, "Failed to create root dirs").Fatal()
+
+	srcPath := filepath.Join(tempDir, "app.tar.gz")
+	err = os.WriteFile(srcPath, []byte("app"), 0o600)
+	assert.NoError(t, err, "Failed to write source file").Fatal()
+
+	artifact, err := fs.StoreArtifact(1, "dist/app.tar.gz", srcPath)
+	assert.NoError(t, err, "Failed to store artifact").Fatal()
+	assert.DeepEqual(t,
+		artifact,
+		Artifact{
+			Name:   "dist/app.tar.gz",
+			Size:   3,
+			SHA256: "a172cedcae47474b615c54d510a5d84a8dea3032e958587430b413538be3f333",
+		},
+		"Incorrect artifact",
+	)
+
+	_, err = fs.StoreArtifact(1, "../escape", srcPath)
+	assert.Equal(t, err != nil, true, "Stored artifact outside of artifacts dir")
+
+	f, err := fs.OpenArtifact(1, "dist/app.tar.gz")
+	assert.NoError(t, err, "Failed to open artifact").Fatal()
+	data, err := io.ReadAll(f)
+	f.Close()
+	assert.NoError(t, err, "Failed to read artifact")
+	assert.Equal(t, string(data), "app", "Incorrect artifact contents")
+
+	_, err = fs.OpenArtifact(1, "../1.json")
+	assert.ErrorIs(t, err, ErrNoArtifact, "Opened file outside of artifacts dir")
+
+	err = fs.WriteArtifactList(1, []Artifact{artifact})
+	assert.NoError(t, err, "Failed to write artifact list").Fatal()
+	artifacts, err := fs.ReadArtifactList(1)
+	assert.NoError(t, err, "Failed to read artifact list")
+	assert.DeepEqual(t, artifacts, []Artifact{artifact}, "Incorrect artifact list")
+
+	err = fs.RemoveArtifactList(1)
+	assert.NoError(t, err, "Failed to remove artifact list")
+	err = fs.RemoveArtifacts(1)
+	assert.NoError(t, err, "Failed to remove artifacts")
+	_, err = fs.OpenArtifact(1, "dist/app.tar.gz")
+	assert.ErrorIs(t, err, ErrNoArtifact, "Artifact was not removed")
+}
+
+func TestCaches(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "caches-test")
+	assert.NoError(t, err, "Failed to create temp directory").Fatal()
+	defer removeAll(tempDir)
+
+	fs := FSStore{RootDir: tempDir}
+	err = fs.CreateRootDirs()
+	assert.NoError(t, err, "Failed to create root dirs").Fatal()
+
+	main, feature := "refs/heads/main", "refs/heads/feature"
+	newBuildDir := func(files map[string]string) string {
+		dir, err := os.MkdirTemp(tempDir, "build-")
+		assert.NoError(t, err, "Failed to create build dir").Fatal()
+		for name, content := range files {
+			filePath := filepath.Join(dir, name)
+			err := os.MkdirAll(filepath.Dir(filePath), 0o700)
+			assert.NoError(t, err, "Failed to create dir").Fatal()
+			err = os.WriteFile(filePath, []byte(content), 0o600)
+			assert.NoError(t, err, "Failed to write file").Fatal()
+		}
+		return dir
+	}
+	readFile := func(dir, name string) string {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return ""
+		}
+		return string(data)
+	}
+
+	// Save entries of the default branch and a feature branch
+	buildDir := newBuildDir(map[string]string{"go/pkg/mod/a": "main", "owner/repo/main.go": "code"})
+	entry, err := fs.SaveCache("owner", "repo", main, "go-1", buildDir, []string{"go/pkg/mod", "missing"})
+	assert.NoError(t, err, "Failed to save cache").Fatal()
+	assert.Equal(t, entry.Size, 4, "Incorrect cache size")
+
+	entry, err = fs.SaveCache("owner", "repo", main, "go-1", buildDir, []string{"go/pkg/mod"})
+	assert.NoError(t, err, "Failed to save cache")
+	assert.Equal(t, entry, nil, "Saved existing cache entry again")
+
+	buildDir = newBuildDir(map[string]string{"go/pkg/mod/a": "feature"})
+	_, err = fs.SaveCache("owner", "repo", feature, "go-2", buildDir, []string{"go/pkg/mod"})
+	assert.NoError(t, err, "Failed to save cache").Fatal()
+
+	_, err = fs.SaveCache("owner", "repo", main, "go-3", buildDir, []string{"../escape"})
+	assert.Equal(t, err != nil, true, "Saved cache path outside of build dir")
+
+	// Restore by exact key, restore key, and from the default branch
+	testCases := []struct {
+		desc        string
+		refs        []string
+		key         string
+		restoreKeys []string
+		wantKey     string
+		wantContent string
+	}{
+		{desc: "Exact key", refs: []string{main}, key: "go-1", wantKey: "go-1", wantContent: "main"},
+		{desc: "Restore key", refs: []string{main}, key: "go-4", restoreKeys: []string{"go-"}, wantKey: "go-1", wantContent: "main"},
+		{desc: "Own ref first", refs: []string{feature, main}, key: "go-4", restoreKeys: []string{"go-"}, wantKey: "go-2", wantContent: "feature"},
+		{desc: "Other branches are not restored", refs: []string{main}, key: "go-2"},
+		{desc: "No matching key", refs: []string{main}, key: "npm-1", restoreKeys: []string{"npm-"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			buildDir := newBuildDir(nil)
+			entry, err := fs.RestoreCache("owner", "repo", tc.refs, tc.key, tc.restoreKeys, buildDir)
+			assert.NoError(t, err, "Failed to restore cache").Fatal()
+
+			if tc.wantKey == "" {
+				assert.Equal(t, entry, nil, "Restored unexpected cache entry")
+				return
+			}
+			assert.Equal(t, entry.Key, tc.wantKey, "Incorrect cache entry")
+			assert.Equal(t, readFile(buildDir, "go/pkg/mod/a"), tc.wantContent, "Incorrect restored content")
+			assert.Equal(t, readFile(buildDir, "owner/repo/main.go"), "", "Restored path that was not cached")
+		})
+	}
+
+	// The feature branch entry was used least recently
+	_, err = fs.RestoreCache("owner", "repo", []string{main}, "go-1", nil, newBuildDir(nil))
+	assert.NoError(t, err, "Failed to restore cache")
+
+	evicted, err := fs.EvictCaches(100)
+	assert.NoError(t, err, "Failed to evict caches")
+	assert.Equal(t, len(evicted), 0, "Evicted caches below the maximum size")
+
+	evicted, err = fs.EvictCaches(5)
+	assert.NoError(t, err, "Failed to evict caches").Fatal()
+	assert.Equal(t, len(evicted), 1, "Incorrect number of evicted caches").Fatal()
+	assert.Equal(t, evicted[0].Key, "go-2", "Evicted wrong cache entry")
+
+	entry, err = fs.RestoreCache("owner", "repo", []string{feature}, "go-2", nil, newBuildDir(nil))
+	assert.NoError(t, err, "Failed to restore cache")
+	assert.Equal(t, entry, nil, "Evicted cache entry was restored")
+}
+
+func TestCopyStrategies(t *testing.T) {
+	for _, strategy := range []CopyStrategy{CopyStrategyCopy, CopyStrategyReflink, CopyStrategyBtrfs} {
+		t.Run(string(strategy), func(t *testing.T) {
+			tempDir, err := os.MkdirTemp("", "copy-strategy-test")
+			assert.NoError(t, err, "Failed to create temp directory").Fatal()
+			defer removeAll(tempDir)
+
+			fs := FSStore{RootDir: tempDir}
+			err = fs.CreateRootDirs()
+			assert.NoError(t, err, "Failed to create root dirs").Fatal()
+
+			fs.CopyStrategy, err = fs.ResolveCopyStrategy(strategy)
+			if err != nil {
+				t.Skipf("Copy strategy is not supported: %v", err)
+			}
+			assert.Equal(t, fs.CopyStrategy, strategy, "Incorrect resolved strategy")
+
+			cacheDir, err := fs.CreateBuildDir(1, nil, "owner/repo")
+			assert.NoError(t, err, "Failed to create build dir").Fatal()
+			cacheFile := filepath.Join(cacheDir, "owner/repo/file")
+			err = os.WriteFile(cacheFile, []byte("cached"), 0o600)
+			assert.NoError(t, err, "Failed to write file").Fatal()
+
+			cacheID := uint64(1)
+			buildDir, err := fs.CreateBuildDir(2, &cacheID, "owner/repo")
+			assert.NoError(t, err, "Failed to create build dir from cache").Fatal()
+			buildFile := filepath.Join(buildDir, "owner/repo/file")
+			data, err := os.ReadFile(buildFile)
+			assert.NoError(t, err, "Failed to read copied file")
+			assert.Equal(t, string(data), "cached", "Incorrect copied file")
+
+			// Changing the copy must not change the cache
+			err = os.WriteFile(buildFile, []byte("changed"), 0o600)
+			assert.NoError(t, err, "Failed to write file").Fatal()
+			data, err = os.ReadFile(cacheFile)
+			assert.NoError(t, err, "Failed to read cached file")
+			assert.Equal(t, string(data), "cached", "Cached file was changed")
+
+			deleted, err := fs.RetainBuildDirs(nil)
+			assert.NoError(t, err, "Failed to delete build dirs")
+			assert.DeepEqual(t, deleted, []uint64{1, 2}, "Incorrect deleted build dirs")
+		})
+	}
+}
+
+// fakeCopyCmds puts cp and btrfs commands in front of PATH, which create the
+// dir of their last argument instead of copying. It returns the calls to them.
+func fakeCopyCmds(t *testing.T) func() []string {
+	binDir := t.TempDir()
+	callsFile := filepath.Join(binDir, "calls")
+	for _, name := range []string{"cp", "btrfs"} {
+		script := fmt.Sprintf(
+			"#!/bin/sh\necho \"%s $*\" >> '%s'\nfor last; do :; done\nmkdir -p \"$last\"\n",
+			name, callsFile,
+		)
+		// sec: The fake command has to be executable
+		err := os.WriteFile(filepath.Join(binDir, name), []byte(script), 0o700) // #nosec G306
+		assert.NoError(t, err, "Failed to write fake command").Fatal()
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	return func() []string {
+		data, err := os.ReadFile(callsFile)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		assert.NoError(t, err, "Failed to read calls").Fatal()
+		return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+}
+
+func TestCreateBuildDir(t *testing.T) {
+	for _, tc := range []struct {
+		strategy  CopyStrategy
+		withCache bool
+		// Calls with the dirs replaced by CACHE and BUILD
+		wantCalls []string
+	}{
+		{CopyStrategyCopy, false, nil},
+		{CopyStrategyCopy, true, []string{"cp -a CACHE BUILD"}},
+		{CopyStrategyReflink, false, nil},
+		{CopyStrategyReflink, true, []string{"cp -a --reflink=always CACHE BUILD"}},
+		{CopyStrategyBtrfs, false, []string{"btrfs subvolume create BUILD"}},
+		// Caches made before switching to btrfs are plain dirs, which are copied
+		{CopyStrategyBtrfs, true, []string{"cp -a --reflink=auto CACHE BUILD"}},
+	} {
+		t.Run(fmt.Sprintf("%s cache=%t", tc.strategy, tc.withCache), func(t *testing.T) {
+			calls := fakeCopyCmds(t)
+			fs := FSStore{RootDir: t.TempDir(), CopyStrategy: tc.strategy}
+
+			buildDir := filepath.Join(fs.RootDir, "build")
+			var cacheDir *string
+			if tc.withCache {
+				dir := filepath.Join(fs.RootDir, "cache")
+				err := os.Mkdir(dir, 0o700)
+				assert.NoError(t, err, "Failed to create cache dir").Fatal()
+				cacheDir = &dir
+			}
+
+			err := fs.createBuildDir(buildDir, cacheDir)
+			assert.NoError(t, err, "Failed to create build dir").Fatal()
+			_, err = os.Stat(buildDir)
+			assert.NoError(t, err, "Build dir was not created")
+
+			var gotCalls []string
+			for _, call := range calls() {
+				call = strings.ReplaceAll(call, buildDir, "BUILD")
+				if cacheDir != nil {
+					call = strings.ReplaceAll(call, *cacheDir, "CACHE")
+				}
+				gotCalls = append(gotCalls, call)
+			}
+			assert.DeepEqual(t, gotCalls, tc.wantCalls, "Incorrect commands run")
+
+			// Build dirs that are not subvolumes are removed like other dirs
+			err = fs.removeBuildDir(buildDir)
+			assert.NoError(t, err, "Failed to remove build dir")
+			_, err = os.Stat(buildDir)
+			assert.Equal(t, os.IsNotExist(err), true, "Build dir was not removed")
+			assert.Equal(t, len(calls()), len(tc.wantCalls), "Commands run to remove build dir")
+		})
+	}
+}
+
+func TestResolveCopyStrategy(t *testing.T) {
+	fs := FSStore{RootDir: t.TempDir()}
+
+	strategy, err := fs.ResolveCopyStrategy(CopyStrategyAuto)
+	assert.NoError(t, err, "Failed to detect copy strategy")
+	assert.Equal(t, fs.copyStrategySupported(strategy), nil, "Detected unsupported copy strategy")
+
+	strategy, err = fs.ResolveCopyStrategy(CopyStrategyCopy)
+	assert.NoError(t, err, "Failed to resolve copy strategy")
+	assert.Equal(t, strategy, CopyStrategyCopy, "Incorrect resolved strategy")
+
+	_, err = fs.ResolveCopyStrategy("overlay")
+	if err == nil {
+		t.Errorf("Resolved unknown copy strategy")
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "disk-usage-test")
+	assert.NoError(t, err, "Failed to create temp directory").Fatal()
+	defer removeAll(tempDir)
+
+	fs := FSStore{RootDir: tempDir}
+	err = fs.CreateRootDirs()
+	assert.NoError(t, err, "Failed to create root dirs").Fatal()
+
+	writeFile := func(name string, size int) {
+		filePath := filepath.Join(tempDir, name)
+		err := os.MkdirAll(filepath.Dir(filePath), 0o700)
+		assert.NoError(t, err, "Failed to create dir").Fatal()
+		err = os.WriteFile(filePath, make([]byte, size), 0o600)
+		assert.NoError(t, err, "Failed to write file").Fatal()
+	}
+	writeFile("build-logs/1.jsonl", 100)
+	writeFile("builder-logs/1.txt", 10)
+	writeFile("build/1/owner/a/main.go", 1000)
+	writeFile("build/1/go/pkg/mod/a", 2000)
+	writeFile("build-logs/2.jsonl", 200)
+	writeFile("artifacts/2/dist.tar.gz", 300)
+	writeFile("artifacts/2.json", 30)
+	// Files of builds that are not in the database
+	writeFile("build-logs/3.jsonl", 400)
+
+	files, err := fs.MeasureBuildFiles()
+	assert.NoError(t, err, "Failed to measure build files").Fatal()
+	assert.DeepEqual(t,
+		files,
+		[]BuildFiles{
+			{BuildID: 1, BuildLogs: 100, BuilderLogs: 10, BuildDir: 3000},
+			{BuildID: 2, BuildLogs: 200, Artifacts: 330},
+			{BuildID: 3, BuildLogs: 400},
+		},
+		"Incorrect build files",
+	)
+
+	_, err = fs.SaveCache("owner", "a", "refs/heads/main", "go-1", filepath.Join(tempDir, "build/1"), []string{"go"})
+	assert.NoError(t, err, "Failed to save cache").Fatal()
+	caches, err := fs.MeasureCaches()
+	assert.NoError(t, err, "Failed to measure caches")
+
+	repoA, repoB := Repo{Owner: "owner", Name: "a"}, Repo{Owner: "owner", Name: "b"}
+	builds := []BuildRepo{{BuildID: 1, Repo: repoA}, {BuildID: 2, Repo: repoB}}
+	assert.DeepEqual(t,
+		RepoDiskUsage(files, builds, caches),
+		map[Repo]DiskUsage{
+			repoA:  {BuildLogs: 100, BuilderLogs: 10, BuildDirs: 3000, Caches: 2000},
+			repoB:  {BuildLogs: 200, Artifacts: 330},
+			Repo{}: {BuildLogs: 400},
+		},
+		"Incorrect disk usage",
+	)
+
+	err = fs.RemoveLogs(1)
+	assert.NoError(t, err, "Failed to remove logs")
+	err = fs.RemoveLogs(2)
+	assert.NoError(t, err, "Failed to remove logs without builder logs")
+	files, err = fs.MeasureBuildFiles()
+	assert.NoError(t, err, "Failed to measure build files").Fatal()
+	assert.DeepEqual(t,
+		files,
+		[]BuildFiles{
+			{BuildID: 1, BuildDir: 3000},
+			{BuildID: 2, Artifacts: 330},
+			{BuildID: 3, BuildLogs: 400},
+		},
+		"Incorrect build files after removing logs",
+	)
+}
+
+func TestLogs(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "logs-test")
+	assert.NoError(t, err, "Failed to create temp directory").Fatal()
+	defer os.RemoveAll(tempDir)
+
+	fs := FSStore{RootDir: tempDir}
+	err = fs.CreateRootDirs()
+	assert.NoError(t, err, "Failed to create root dirs").Fatal()
+
+	for _, text := range []string{"one", "two", "three"} {
+		err := fs.AppendBuildLog(1, text)
+		assert.NoError(t, err, "Failed to append log").Fatal()
+	}
+	logTexts := func(logs []LogEntry) []string {
+		var texts []string
+		for _, l := range logs {
+			texts = append(texts, l.Text)
+		}
+		return texts
+	}
+
+	pages := []struct {
+		fromLine int
+		maxLines int
+		expected []string
+	}{
+		{fromLine: 0, maxLines: 0, expected: []string{"one", "two", "three"}},
+		{fromLine: 1, maxLines: 0, expected: []string{"two", "three"}},
+		{fromLine: 0, maxLines: 2, expected: []string{"one", "two"}},
+		{fromLine: 2, maxLines: 2, expected: []string{"three"}},
+		{fromLine: 3, maxLines: 2, expected: nil},
+		{fromLine: 10, maxLines: 0, expected: nil},
+	}
+	checkPages := func(msg string) {
+		for _, p := range pages {
+			logs, err := fs.GetLogs(context.Background(), 1, p.fromLine, p.maxLines)
+			page := fmt.Sprintf("%s from line %d, max %d lines", msg, p.fromLine, p.maxLines)
+			assert.NoError(t, err, "Failed to get "+page)
+			assert.DeepEqual(t, logTexts(logs), p.expected, "Incorrect "+page)
+		}
+	}
+	checkPages("logs")
+
+	// Lines that are not indexed are skipped from the last indexed line
+	indexPath := filepath.Join(tempDir, "build-logs", "1.idx")
+	index, err := os.ReadFile(indexPath)
+	assert.NoError(t, err, "Failed to read log index").Fatal()
+	err = os.WriteFile(indexPath, index[:logIndexEntrySize], 0o600)
+	assert.NoError(t, err, "Failed to truncate log index").Fatal()
+	checkPages("partially indexed logs")
+
+	err = os.Remove(indexPath)
+	assert.NoError(t, err, "Failed to remove log index").Fatal()
+	checkPages("unindexed logs")
+
+	err = os.WriteFile(indexPath, index, 0o600)
+	assert.NoError(t, err, "Failed to restore log index").Fatal()
+
+	err = fs.CompressLogs(1)
+	assert.NoError(t, err, "Failed to compress logs").Fatal()
+	_, err = os.Stat(filepath.Join(tempDir, "build-logs", "1.jsonl"))
+	assert.ErrorIs(t, err, os.ErrNotExist, "Uncompressed logs were not removed")
+	checkPages("compressed logs")
+
+	var texts []string
+	err = fs.ReadLogs(1, func(entry LogEntry) error {
+		texts = append(texts, entry.Text)
+		return nil
+	})
+	assert.NoError(t, err, "Failed to read logs")
+	assert.DeepEqual(t, texts, []string{"one", "two", "three"}, "Incorrect read logs")
+
+	// Builds without logs are skipped
+	err = fs.CompressLogs(2)
+	assert.NoError(t, err, "Failed to compress missing logs")
+	logs, err := fs.GetLogs(context.Background(), 2, 0, 0)
+	assert.NoError(t, err, "Failed to get missing logs")
+	assert.Equal(t, len(logs), 0, "Incorrect missing logs")
+
+	err = fs.RemoveLogs(1)
+	assert.NoError(t, err, "Failed to remove logs")
+	logs, err = fs.GetLogs(context.Background(), 1, 0, 0)
+	assert.NoError(t, err, "Failed to get removed logs")
+	assert.Equal(t, len(logs), 0, "Compressed logs were not removed")
+}
+
+func TestWatchLogs(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "watch-logs-test")
+	assert.NoError(t, err, "Failed to create temp directory").Fatal()
+	defer os.RemoveAll(tempDir)
+
+	fs := FSStore{RootDir: tempDir}
+	err = fs.CreateRootDirs()
+	assert.NoError(t, err, "Failed to create root dirs").Fatal()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes, err := fs.WatchLogs(ctx, 1)
+	assert.NoError(t, err, "Failed to watch logs").Fatal()
+
+	waitForChange := func() bool {
+		select {
+		case <-changes:
+			return true
+		case <-time.After(100 * time.Millisecond):
+			return false
+		}
+	}
+
+	err = fs.AppendBuildLog(2, "other build")
+	assert.NoError(t, err, "Failed to append log").Fatal()
+	assert.Equal(t, waitForChange(), false, "Notified of logs of other build")
+
+	err = fs.AppendBuildLog(1, "one")
+	assert.NoError(t, err, "Failed to append log").Fatal()
+	assert.Equal(t, waitForChange(), true, "Not notified of appended log")
+
+	err = fs.CompressLogs(1)
+	assert.NoError(t, err, "Failed to compress logs").Fatal()
+	assert.Equal(t, waitForChange(), true, "Not notified of compressed logs")
+
+	cancel()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-changes:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("Changes were not closed after cancel")
+		}
+	}
+}
+
+func TestPlainLogText(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		want string
+	}{
+		{"plain text", "plain text"},
+		{"\x1b[1;31merror:\x1b[0m failed", "error: failed"},
+		{"\x1b]0;title\x07text", "text"},
+		{"\x1b]8;;https://example.com\x1b\\link\x1b]8;;\x1b\\", "link"},
+		{"10%\r50%\r100%\r", "100%"},
+		{"tab\tbell\a\x00", "tab\tbell"},
+		{"invalid \xff", "invalid \ufffd"},
+	} {
+		got := PlainLogText(tc.text)
+		assert.Equal(t, got, tc.want, fmt.Sprintf("Incorrect plain text of %q", tc.text))
+	}
+}
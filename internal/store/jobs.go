@@ -0,0 +1,119 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// JobName returns a human readable name of a job based on its env vars, e.g.
+// "GO_VERSION=1.24, OS=linux".
+func JobName(jobEnv map[string]string) string {
+	var parts []string
+	for _, name := range slices.Sorted(maps.Keys(jobEnv)) {
+		parts = append(parts, fmt.Sprintf("%s=%s", name, jobEnv[name]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// updateParentBuild updates the parent of a job to reflect the state of all of
+// its jobs. The parent starts with its first job and finishes with its last
+// job. Its result is the worst result of its jobs. Does nothing for builds
+// without parent.
+func updateParentBuild(ctx context.Context, tx pgx.Tx, buildID uint64) error {
+	_, err := tx.Exec(
+		ctx,
+		`UPDATE builds AS p
+		SET
+			started = j.started,
+			finished = CASE WHEN j.num_finished = p.job_count THEN j.finished END,
+			result = CASE WHEN j.num_finished = p.job_count THEN j.result END
+		FROM (
+			SELECT
+				parent_id,
+				MIN(started) AS started,
+				MAX(finished) AS finished,
+				COUNT(result) AS num_finished,
+				CASE
+					WHEN bool_or(result = 'error') THEN 'error'
+					WHEN bool_or(result = 'failure') THEN 'failure'
+					WHEN bool_or(result = 'timeout') THEN 'timeout'
+					WHEN bool_or(result = 'canceled') THEN 'canceled'
+					ELSE 'success'
+				END::build_result AS result
+			FROM builds
+			WHERE parent_id = (SELECT parent_id FROM builds WHERE id = $1)
+			GROUP BY parent_id
+		) AS j
+		WHERE p.id = j.parent_id`,
+		buildID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update parent build: %w", err)
+	}
+	return nil
+}
+
+// ListJobs returns the jobs of a parent build in order.
+func (db DBStore) ListJobs(ctx context.Context, parentID uint64) ([]Build, error) {
+	rows, err := db.pool.Query(
+		ctx,
+		`SELECT
+			b.id,
+			b.repo_id,
+			b.number,
+			b.link,
+			b.ref,
+			b.commit_sha,
+			b.message,
+			b.author,
+			b.created,
+			b.started,
+			b.finished,
+			b.result,
+			b.parent_id,
+			b.job_index,
+			b.job_count,
+			b.job_env,
+			r.owner,
+			r.name
+		FROM builds AS b
+		INNER JOIN repos AS r ON b.repo_id = r.id
+		WHERE b.parent_id = $1
+		ORDER BY b.job_index ASC`,
+		parentID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (Build, error) {
+		var b Build
+		err := rows.Scan(
+			&b.ID,
+			&b.RepoID,
+			&b.Number,
+			&b.Link,
+			&b.Ref,
+			&b.CommitSHA,
+			&b.Message,
+			&b.Author,
+			&b.Created,
+			&b.Started,
+			&b.Finished,
+			&b.Result,
+			&b.ParentID,
+			&b.JobIndex,
+			&b.JobCount,
+			&b.JobEnv,
+			&b.Repo.Owner,
+			&b.Repo.Name,
+		)
+		return b, err
+	})
+}
@@ -0,0 +1,176 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// LogLine is a line of the build logs that is indexed for search.
+type LogLine struct {
+	// Number of the line in the build logs
+	Number int
+	// Text of the line without escape sequences
+	Text string
+}
+
+// Escape sequences of terminals: CSI sequences like colors, OSC sequences like
+// window titles, and other sequences of ESC and a final byte
+var escapeSequenceRegexp = regexp.MustCompile(
+	`\x1b(\[[0-?]*[ -/]*[@-~]|\][^\x07\x1b]*(\x07|\x1b\\)?|[ -/]*[0-~])`,
+)
+
+// PlainLogText returns the text of a log line as shown in the logs, without
+// escape sequences and control characters. Of text that was overwritten after
+// a carriage return, only the final state is kept.
+func PlainLogText(text string) string {
+	text = escapeSequenceRegexp.ReplaceAllString(text, "")
+	if i := strings.LastIndexByte(strings.TrimRight(text, "\r"), '\r'); i >= 0 {
+		text = text[i+1:]
+	}
+	text = strings.Map(func(r rune) rune {
+		if r < ' ' && r != '\t' || r == '\x7f' {
+			return -1
+		}
+		return r
+	}, text)
+	return strings.ToValidUTF8(text, "�")
+}
+
+// InsertLogLines adds the log lines of a finished build to the search index.
+// This is not done when finishing the build, so that the transaction doesn't
+// wait for the lines to be read and copied.
+func (db DBStore) InsertLogLines(ctx context.Context, buildID uint64, lines []LogLine) error {
+	if len(lines) == 0 {
+		return nil
+	}
+
+	_, err := db.pool.CopyFrom(
+		ctx,
+		pgx.Identifier{"log_lines"},
+		[]string{"build_id", "line", "text"},
+		pgx.CopyFromSlice(len(lines), func(i int) ([]any, error) {
+			return []any{buildID, lines[i].Number, lines[i].Text}, nil
+		}),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert log lines: %w", err)
+	}
+	return nil
+}
+
+// DeleteLogLines removes the log lines of builds from the search index, e.g.
+// once their logs were removed.
+func (db DBStore) DeleteLogLines(ctx context.Context, buildIDs []uint64) error {
+	_, err := db.pool.Exec(
+		ctx,
+		`DELETE FROM log_lines WHERE build_id = ANY($1)`,
+		buildIDs,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to delete log lines: %w", err)
+	}
+	return nil
+}
+
+// LogSearch filters the log lines that SearchLogs finds. Zero values match all
+// builds.
+type LogSearch struct {
+	// Words that the lines must contain, in the syntax of web search engines:
+	// quoted phrases, "or" and "-" to exclude words are supported
+	Query  string
+	Repo   Repo
+	Result BuildResult
+	// Time range in which the builds were created
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+}
+
+// LogSearchHit is a log line that matches a search, with its build.
+type LogSearchHit struct {
+	BuildID  uint64
+	Repo     Repo
+	Number   uint64
+	JobIndex int
+	Ref      string
+	Created  time.Time
+	Result   BuildResult
+	Line     LogLine
+}
+
+// SearchLogs returns the indexed log lines that match a search, of the most
+// recent builds first. Only the first maxHitsPerBuild lines of each build are
+// returned, and at most maxHits lines in total.
+func (db DBStore) SearchLogs(
+	ctx context.Context, search LogSearch, maxHitsPerBuild, maxHits int,
+) ([]LogSearchHit, error) {
+	var createdAfter, createdBefore *time.Time
+	if !search.CreatedAfter.IsZero() {
+		createdAfter = &search.CreatedAfter
+	}
+	if !search.CreatedBefore.IsZero() {
+		createdBefore = &search.CreatedBefore
+	}
+
+	rows, err := db.pool.Query(
+		ctx,
+		`WITH hits AS (
+			SELECT
+				l.build_id,
+				l.line,
+				l.text,
+				ROW_NUMBER() OVER (PARTITION BY l.build_id ORDER BY l.line) AS rank
+			FROM log_lines AS l
+			INNER JOIN builds AS b ON l.build_id = b.id
+			INNER JOIN repos AS r ON b.repo_id = r.id
+			WHERE
+				l.text_search @@ websearch_to_tsquery('simple', $1)
+				AND ($2::text = '' OR (r.owner = $2 AND r.name = $3))
+				AND ($4::text = '' OR b.result = $4::text::build_result)
+				AND ($5::timestamptz IS NULL OR b.created >= $5)
+				AND ($6::timestamptz IS NULL OR b.created < $6)
+		)
+		SELECT b.id, r.owner, r.name, b.number, b.job_index, b.ref, b.created, b.result, h.line, h.text
+		FROM hits AS h
+		INNER JOIN builds AS b ON h.build_id = b.id
+		INNER JOIN repos AS r ON b.repo_id = r.id
+		WHERE h.rank <= $7
+		ORDER BY b.id DESC, h.line
+		LIMIT $8`,
+		search.Query,
+		search.Repo.Owner,
+		search.Repo.Name,
+		string(search.Result),
+		createdAfter,
+		createdBefore,
+		maxHitsPerBuild,
+		maxHits,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search logs: %w", err)
+	}
+	defer rows.Close()
+
+	return pgx.CollectRows(
+		rows,
+		func(row pgx.CollectableRow) (LogSearchHit, error) {
+			h := LogSearchHit{}
+			err := row.Scan(
+				&h.BuildID,
+				&h.Repo.Owner,
+				&h.Repo.Name,
+				&h.Number,
+				&h.JobIndex,
+				&h.Ref,
+				&h.Created,
+				&h.Result,
+				&h.Line.Number,
+				&h.Line.Text,
+			)
+			return h, err
+		})
+}
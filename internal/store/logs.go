@@ -1,13 +1,18 @@
 package store
 
 import (
+	"compress/gzip"
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path"
+	"slices"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -16,47 +21,386 @@ type LogStream string
 const (
 	LogStreamStdout LogStream = "out"
 	LogStreamStderr LogStream = "err"
+	// Lines written by the CI itself, e.g. to separate pipeline steps
+	LogStreamCI LogStream = "ci"
 )
 
 type LogEntry struct {
+	// Index of the build step that wrote the line, nil for lines written
+	// outside of steps
+	Step      *int      `json:"step,omitempty"`
 	Stream    LogStream `json:"stream"`
 	Timestamp time.Time `json:"timestamp"`
 	Text      string    `json:"text"`
 }
 
-func (fs *FSStore) GetLogs(ctx context.Context, buildID uint64, fromLine int) ([]LogEntry, error) {
-	LogFilePath := path.Join(fs.RootDir, "build-logs", fmt.Sprintf("%d.jsonl", buildID))
+// LogWriter appends entries to the build logs of a build, and their offsets to
+// the index of the logs.
+type LogWriter struct {
+	logFile   *os.File
+	indexFile *os.File
+	// Offset of the next entry in the log file
+	offset int64
+}
+
+// OpenBuildLogs opens the build logs of a running build for appending.
+func (fs *FSStore) OpenBuildLogs(buildID uint64) (*LogWriter, error) {
+	logPath := fs.buildLogPath(buildID)
+	// sec: Path is from a trusted user
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600) // #nosec G304
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := logFile.Stat()
+	if err != nil {
+		_ = logFile.Close()
+		return nil, err
+	}
+
+	indexPath := fs.buildLogIndexPath(buildID)
+	// sec: Path is from a trusted user
+	indexFile, err := os.OpenFile(indexPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600) // #nosec G304
+	if err != nil {
+		_ = logFile.Close()
+		return nil, err
+	}
+
+	return &LogWriter{logFile: logFile, indexFile: indexFile, offset: info.Size()}, nil
+}
+
+// WriteEntry appends an entry as one line of JSON to the logs. The offset is
+// indexed after the line is written, so that readers never seek to a line
+// that isn't there yet.
+func (w *LogWriter) WriteEntry(entry LogEntry) error {
+	line, err := json.Marshal(&entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode log entry: %w", err)
+	}
+	line = append(line, '\n')
+
+	if _, err := w.logFile.Write(line); err != nil {
+		return fmt.Errorf("failed to write log entry: %w", err)
+	}
+
+	var offset [logIndexEntrySize]byte
+	// sec: Offsets are positive
+	binary.LittleEndian.PutUint64(offset[:], uint64(w.offset)) // #nosec G115
+	if _, err := w.indexFile.Write(offset[:]); err != nil {
+		return fmt.Errorf("failed to write log index: %w", err)
+	}
+
+	w.offset += int64(len(line))
+	return nil
+}
+
+func (w *LogWriter) Close() error {
+	return errors.Join(w.logFile.Close(), w.indexFile.Close())
+}
+
+// AppendBuildLog appends a line written by the CI itself to the build logs.
+func (fs *FSStore) AppendBuildLog(buildID uint64, text string) error {
+	logWriter, err := fs.OpenBuildLogs(buildID)
+	if err != nil {
+		return fmt.Errorf("failed to open build logs: %w", err)
+	}
+	defer logWriter.Close()
+
+	return logWriter.WriteEntry(LogEntry{
+		Stream:    LogStreamCI,
+		Timestamp: time.Now(),
+		Text:      text,
+	})
+}
+
+func (fs *FSStore) buildLogPath(buildID uint64) string {
+	return path.Join(fs.RootDir, "build-logs", fmt.Sprintf("%d.jsonl", buildID))
+}
+
+// compressedBuildLogPath returns the path of the build logs once the build has
+// finished, see CompressLogs.
+func (fs *FSStore) compressedBuildLogPath(buildID uint64) string {
+	return fs.buildLogPath(buildID) + ".gz"
+}
 
+// CompressLogs compresses the build logs of a finished build with gzip. Logs
+// that don't exist, e.g. of builds with jobs, are skipped.
+func (fs *FSStore) CompressLogs(buildID uint64) error {
+	logPath := fs.buildLogPath(buildID)
 	// sec: Path is from a trusted user
-	logFile, err := os.Open(LogFilePath) // #nosec G304
+	logFile, err := os.Open(logPath) // #nosec G304
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to open log file '%s': %w", logPath, err)
+	}
+	defer logFile.Close()
+
+	// Write to a temporary file first, so that the logs are never read while
+	// they are partially compressed. It is not named after the build, so that
+	// it is not mistaken for the logs.
+	tmpFile, err := os.CreateTemp(path.Dir(logPath), ".compress-")
+	if err != nil {
+		return fmt.Errorf("failed to create compressed log file: %w", err)
+	}
+	defer func() { _ = os.Remove(tmpFile.Name()) }()
+	defer tmpFile.Close()
+
+	gz := gzip.NewWriter(tmpFile)
+	if _, err := io.Copy(gz, logFile); err != nil {
+		return fmt.Errorf("failed to compress log file '%s': %w", logPath, err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to compress log file '%s': %w", logPath, err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("failed to write compressed log file: %w", err)
+	}
+
+	// The compressed logs exist before the uncompressed ones are removed, so
+	// readers always find one of them
+	if err := os.Rename(tmpFile.Name(), fs.compressedBuildLogPath(buildID)); err != nil {
+		return fmt.Errorf("failed to write compressed log file: %w", err)
+	}
+	if err := os.Remove(logPath); err != nil {
+		return fmt.Errorf("failed to remove uncompressed log file: %w", err)
+	}
+	return nil
+}
+
+// gzipFile decompresses a file while it is read.
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (f *gzipFile) Close() error {
+	return errors.Join(f.Reader.Close(), f.file.Close())
+}
+
+// openLogs opens the build logs, which are compressed once the build has
+// finished. It returns nil if there are no logs.
+func (fs *FSStore) openLogs(buildID uint64) (io.ReadCloser, error) {
+	// Look for the uncompressed logs first, since the compressed logs are
+	// created before the uncompressed ones are removed
+	logPath := fs.buildLogPath(buildID)
+	// sec: Path is from a trusted user
+	logFile, err := os.Open(logPath) // #nosec G304
+	if err == nil {
+		return logFile, nil
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to open log file '%s': %w", logPath, err)
+	}
+
+	logPath = fs.compressedBuildLogPath(buildID)
+	// sec: Path is from a trusted user
+	logFile, err = os.Open(logPath) // #nosec G304
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open log file '%s': %w", logPath, err)
+	}
+
+	gz, err := gzip.NewReader(logFile)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, nil // Return no logs
+		_ = logFile.Close()
+		return nil, fmt.Errorf("failed to decompress log file '%s': %w", logPath, err)
+	}
+	return &gzipFile{Reader: gz, file: logFile}, nil
+}
+
+// ReadLogs calls fn for each line of the build logs in order, until fn
+// returns an error. A partially written last line is not read.
+func (fs *FSStore) ReadLogs(buildID uint64, fn func(entry LogEntry) error) error {
+	logFile, err := fs.openLogs(buildID)
+	if err != nil {
+		return err
+	}
+	if logFile == nil {
+		return nil // No logs
+	}
+	defer logFile.Close()
+
+	decoder := json.NewDecoder(logFile)
+	for {
+		var entry LogEntry
+		err := decoder.Decode(&entry)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to decode log entry of build %d: %w", buildID, err)
+		}
+
+		if err := fn(entry); err != nil {
+			return err
 		}
-		return nil, fmt.Errorf("failed to open log file '%s': %w", LogFilePath, err)
+	}
+}
+
+// Size of an entry of the log index, which is the offset of a line in the
+// uncompressed logs as little-endian uint64
+const logIndexEntrySize = 8
+
+func (fs *FSStore) buildLogIndexPath(buildID uint64) string {
+	return path.Join(fs.RootDir, "build-logs", fmt.Sprintf("%d.idx", buildID))
+}
+
+// lineOffset returns the offset in the uncompressed build logs to start
+// reading at to get to a line, and the number of lines to skip from there.
+// Lines that are not indexed, e.g. of logs written before there was an index,
+// are skipped from the last indexed line.
+func (fs *FSStore) lineOffset(buildID uint64, line int) (int64, int, error) {
+	indexPath := fs.buildLogIndexPath(buildID)
+	// sec: Path is from a trusted user
+	indexFile, err := os.Open(indexPath) // #nosec G304
+	if os.IsNotExist(err) {
+		return 0, line, nil
+	} else if err != nil {
+		return 0, 0, fmt.Errorf("failed to open log index '%s': %w", indexPath, err)
+	}
+	defer indexFile.Close()
+
+	info, err := indexFile.Stat()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open log index '%s': %w", indexPath, err)
+	}
+	numIndexed := int(info.Size() / logIndexEntrySize)
+	if numIndexed == 0 {
+		return 0, line, nil
+	}
+
+	indexedLine := min(line, numIndexed-1)
+	var offset [logIndexEntrySize]byte
+	if _, err := indexFile.ReadAt(offset[:], int64(indexedLine)*logIndexEntrySize); err != nil {
+		return 0, 0, fmt.Errorf("failed to read log index '%s': %w", indexPath, err)
+	}
+	// sec: Offsets are written from an int64
+	return int64(binary.LittleEndian.Uint64(offset[:])), line - indexedLine, nil // #nosec G115
+}
+
+// GetLogs returns up to maxLines lines of the build logs starting at fromLine,
+// or all lines from there if maxLines is 0. Reading starts at the line's
+// offset in the log index. Compressed logs are decompressed up to there.
+func (fs *FSStore) GetLogs(ctx context.Context, buildID uint64, fromLine, maxLines int) ([]LogEntry, error) {
+	offset, skipLines, err := fs.lineOffset(buildID, fromLine)
+	if err != nil {
+		return nil, err
+	}
+
+	logFile, err := fs.openLogs(buildID)
+	if err != nil {
+		return nil, err
+	}
+	if logFile == nil {
+		return nil, nil // Return no logs
 	}
 	defer logFile.Close()
 
+	if seeker, ok := logFile.(io.Seeker); ok {
+		_, err = seeker.Seek(offset, io.SeekStart)
+	} else {
+		_, err = io.CopyN(io.Discard, logFile, offset)
+	}
+	if errors.Is(err, io.EOF) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to seek in logs of build %d: %w", buildID, err)
+	}
+
 	decoder := json.NewDecoder(logFile)
 	var logs []LogEntry
 
-	currentLine := 0
-	for {
+	for maxLines == 0 || len(logs) < maxLines {
 		var entry LogEntry
 		err := decoder.Decode(&entry)
 
-		if errors.Is(err, io.EOF) {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			// The last line of a running build can be partially written, it is
+			// read once it is complete
 			break
 		} else if err != nil {
-			return nil, fmt.Errorf("failed to decode log entry from '%s': %w", LogFilePath, err)
+			return nil, fmt.Errorf("failed to decode log entry of build %d: %w", buildID, err)
 		}
 
-		// Skip lines until we reach fromLine - inefficient but good enough for now
-		if currentLine >= fromLine {
-			logs = append(logs, entry)
+		if skipLines > 0 {
+			skipLines--
+			continue
 		}
-		currentLine++
+		logs = append(logs, entry)
 	}
 
 	return logs, nil
 }
+
+// Size of the buffer for inotify events, which fits many events with file
+// names of build logs
+const logWatchBufferSize = 64 * (syscall.SizeofInotifyEvent + syscall.NAME_MAX + 1)
+
+// WatchLogs notifies on the returned channel when the build logs of a build
+// change, until ctx is done and the channel is closed. Changes are coalesced,
+// so one notification can stand for many writes.
+func (fs *FSStore) WatchLogs(ctx context.Context, buildID uint64) (<-chan struct{}, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init inotify: %w", err)
+	}
+	// Read the non-blocking fd through the runtime poller, so that closing it
+	// stops the read
+	watchFile := os.NewFile(uintptr(fd), "inotify")
+
+	// Watch the dir, since the log file is only created when the build
+	// starts, and is replaced once its logs are compressed
+	logDir := path.Join(fs.RootDir, "build-logs")
+	mask := uint32(syscall.IN_MODIFY | syscall.IN_CREATE | syscall.IN_MOVED_TO | syscall.IN_DELETE)
+	if _, err := syscall.InotifyAddWatch(fd, logDir, mask); err != nil {
+		_ = watchFile.Close()
+		return nil, fmt.Errorf("failed to watch log dir '%s': %w", logDir, err)
+	}
+
+	logNames := []string{
+		path.Base(fs.buildLogPath(buildID)),
+		path.Base(fs.compressedBuildLogPath(buildID)),
+	}
+	changes := make(chan struct{}, 1)
+
+	go func() {
+		<-ctx.Done()
+		_ = watchFile.Close()
+	}()
+
+	go func() {
+		defer close(changes)
+
+		buf := make([]byte, logWatchBufferSize)
+		for {
+			n, err := watchFile.Read(buf)
+			if err != nil {
+				return
+			}
+
+			changed := false
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+				// The event is followed by its file name, whose length is the
+				// last field of the event, padded with NULs
+				nameLen := int(binary.NativeEndian.Uint32(buf[offset+12:]))
+				nameStart := offset + syscall.SizeofInotifyEvent
+				name := strings.TrimRight(string(buf[nameStart:min(nameStart+nameLen, n)]), "\x00")
+				offset = nameStart + nameLen
+
+				if slices.Contains(logNames, name) {
+					changed = true
+				}
+			}
+
+			if changed {
+				select {
+				case changes <- struct{}{}:
+				default:
+					// A notification is already pending
+				}
+			}
+		}
+	}()
+
+	return changes, nil
+}
@@ -0,0 +1,158 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// PrunePolicy decides which builds PruneBuilds deletes. Builds that are kept
+// by any of the rules are not deleted, and neither are unfinished builds or
+// builds whose build dir is used as cache.
+type PrunePolicy struct {
+	// Number of most recent builds kept per repo
+	KeepBuilds int
+	// Builds created after this time are kept
+	KeepAfter time.Time
+	// Ref of the default branch of each repo, whose latest finished build is
+	// kept
+	DefaultRefs map[Repo]string
+	// If set, the builds are only returned, but not deleted
+	DryRun bool
+}
+
+// PruneBuilds deletes the builds that are not kept by the policy, together
+// with their jobs. The files of the builds are removed first with removeFiles,
+// which returns the IDs of the builds whose files were removed. Only these
+// builds are deleted, and a build matrix only if the files of all of its jobs
+// were removed. The other builds are pruned again by the next run. It returns
+// the IDs of the deleted builds and jobs.
+func (db DBStore) PruneBuilds(
+	ctx context.Context, policy PrunePolicy, removeFiles func(buildIDs []uint64) []uint64,
+) ([]uint64, error) {
+	tx, err := db.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var owners, names, refs []string
+	for repo, ref := range policy.DefaultRefs {
+		owners = append(owners, repo.Owner)
+		names = append(names, repo.Name)
+		refs = append(refs, ref)
+	}
+
+	rows, err := tx.Query(
+		ctx,
+		`WITH pruned AS (
+			SELECT b.id
+			FROM (
+				SELECT
+					id,
+					created,
+					finished,
+					ROW_NUMBER() OVER (PARTITION BY repo_id ORDER BY id DESC) AS rank
+				FROM builds
+				WHERE parent_id IS NULL
+			) AS b
+			WHERE
+				b.finished IS NOT NULL
+				AND b.rank > $1
+				AND b.created < $2
+				AND b.id NOT IN (
+					-- Latest finished build of the default branch of each repo
+					SELECT MAX(lb.id)
+					FROM builds AS lb
+					INNER JOIN repos AS r ON lb.repo_id = r.id
+					INNER JOIN UNNEST($3::text[], $4::text[], $5::text[]) AS d(owner, name, ref)
+						ON r.owner = d.owner AND r.name = d.name AND lb.ref = d.ref
+					WHERE lb.parent_id IS NULL AND lb.finished IS NOT NULL
+					GROUP BY lb.repo_id
+				)
+				AND NOT EXISTS (
+					-- Build dirs of the build or its jobs that are used as cache
+					SELECT 1
+					FROM builds AS j
+					WHERE
+						(j.id = b.id OR j.parent_id = b.id)
+						AND (
+							j.id IN (SELECT cache_id FROM repos WHERE cache_id IS NOT NULL)
+							OR j.id IN (SELECT cache_id FROM builders WHERE cache_id IS NOT NULL)
+						)
+				)
+		)
+		SELECT id, COALESCE(parent_id, id)
+		FROM builds
+		WHERE id IN (SELECT id FROM pruned) OR parent_id IN (SELECT id FROM pruned)
+		ORDER BY id`,
+		policy.KeepBuilds,
+		policy.KeepAfter,
+		owners,
+		names,
+		refs,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select builds to prune: %w", err)
+	}
+	type prunedBuild struct {
+		id uint64
+		// ID of the parent of a job, or of the build itself
+		rootID uint64
+	}
+	builds, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (prunedBuild, error) {
+		b := prunedBuild{}
+		err := row.Scan(&b.id, &b.rootID)
+		return b, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to select builds to prune: %w", err)
+	}
+
+	var buildIDs []uint64
+	for _, b := range builds {
+		buildIDs = append(buildIDs, b.id)
+	}
+	if policy.DryRun || len(buildIDs) == 0 {
+		return buildIDs, nil
+	}
+
+	// Keep the builds whose files were not removed, and the build matrix they
+	// belong to, since deleting it deletes its jobs
+	removedIDs := removeFiles(buildIDs)
+	keptRootIDs := make(map[uint64]bool)
+	for _, b := range builds {
+		if !slices.Contains(removedIDs, b.id) {
+			keptRootIDs[b.rootID] = true
+		}
+	}
+
+	var deletedIDs, deletedRootIDs []uint64
+	for _, b := range builds {
+		if keptRootIDs[b.rootID] {
+			continue
+		}
+		deletedIDs = append(deletedIDs, b.id)
+		if b.id == b.rootID {
+			deletedRootIDs = append(deletedRootIDs, b.id)
+		}
+	}
+	if len(deletedIDs) == 0 {
+		return nil, nil
+	}
+
+	// Steps, artifacts, test results and jobs are deleted along with their
+	// build
+	_, err = tx.Exec(ctx, `DELETE FROM builds WHERE id = ANY($1)`, deletedRootIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete builds: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return deletedIDs, nil
+}
@@ -0,0 +1,137 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// BuildStep is the state of a command run by the builder as part of a build.
+type BuildStep struct {
+	Index    int        `json:"index"`
+	Name     string     `json:"name"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	ExitCode *int       `json:"exit_code,omitempty"`
+	// The step did not run, because its condition did not match or a previous
+	// step failed
+	Skipped  bool `json:"skipped,omitempty"`
+	TimedOut bool `json:"timed_out,omitempty"`
+}
+
+// While a build is running, its steps are kept in a file written by the
+// builder. Once the build finishes, they are moved to the database.
+
+func (fs *FSStore) buildStepsPath(buildID uint64) string {
+	return path.Join(fs.RootDir, "build-steps", fmt.Sprintf("%d.json", buildID))
+}
+
+// WriteBuildSteps replaces the steps of a running build.
+func (fs *FSStore) WriteBuildSteps(buildID uint64, steps []BuildStep) error {
+	data, err := json.Marshal(steps)
+	if err != nil {
+		return fmt.Errorf("failed to marshal build steps: %w", err)
+	}
+
+	// Write to a temporary file first, so that readers never see partial data
+	stepsPath := fs.buildStepsPath(buildID)
+	tmpPath := stepsPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write build steps: %w", err)
+	}
+	if err := os.Rename(tmpPath, stepsPath); err != nil {
+		return fmt.Errorf("failed to replace build steps: %w", err)
+	}
+	return nil
+}
+
+// ReadBuildSteps returns the steps of a running build, or nil if the builder
+// has not written them yet.
+func (fs *FSStore) ReadBuildSteps(buildID uint64) ([]BuildStep, error) {
+	stepsPath := fs.buildStepsPath(buildID)
+	// sec: Path is from a trusted user
+	data, err := os.ReadFile(stepsPath) // #nosec G304
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read build steps: %w", err)
+	}
+
+	var steps []BuildStep
+	if err := json.Unmarshal(data, &steps); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal build steps: %w", err)
+	}
+	return steps, nil
+}
+
+// RemoveBuildSteps removes the steps file of a build once the steps are stored
+// in the database.
+func (fs *FSStore) RemoveBuildSteps(buildID uint64) error {
+	err := os.Remove(fs.buildStepsPath(buildID))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func insertBuildSteps(ctx context.Context, tx pgx.Tx, buildID uint64, steps []BuildStep) error {
+	for _, step := range steps {
+		_, err := tx.Exec(
+			ctx,
+			`INSERT INTO build_steps (
+				build_id, idx, name, started, finished, exit_code, skipped, timed_out
+			)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			buildID,
+			step.Index,
+			step.Name,
+			step.Started,
+			step.Finished,
+			step.ExitCode,
+			step.Skipped,
+			step.TimedOut,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to insert build step '%s': %w", step.Name, err)
+		}
+	}
+	return nil
+}
+
+// GetBuildSteps returns the steps of a finished build.
+func (db DBStore) GetBuildSteps(ctx context.Context, buildID uint64) ([]BuildStep, error) {
+	rows, err := db.pool.Query(
+		ctx,
+		`SELECT idx, name, started, finished, exit_code, skipped, timed_out
+		FROM build_steps
+		WHERE build_id = $1
+		ORDER BY idx`,
+		buildID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return pgx.CollectRows(
+		rows,
+		func(row pgx.CollectableRow) (BuildStep, error) {
+			s := BuildStep{}
+			err := row.Scan(
+				&s.Index,
+				&s.Name,
+				&s.Started,
+				&s.Finished,
+				&s.ExitCode,
+				&s.Skipped,
+				&s.TimedOut,
+			)
+			return s, err
+		})
+}
@@ -0,0 +1,256 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type TestStatus string
+
+const (
+	TestStatusPassed  TestStatus = "passed"
+	TestStatusFailed  TestStatus = "failed"
+	TestStatusSkipped TestStatus = "skipped"
+)
+
+// TestResult is the result of a test read from a test report of a build.
+type TestResult struct {
+	Suite    string        `json:"suite"`
+	Name     string        `json:"name"`
+	Status   TestStatus    `json:"status"`
+	Duration time.Duration `json:"duration"`
+	// Failure message and output, empty for tests that passed
+	Message string `json:"message,omitempty"`
+}
+
+// Maximum length in bytes of the suite and the name of a test case. Both are
+// in a unique index, whose rows can't be larger than about 2.7 KB.
+const maxTestNameLength = 1024
+
+// SanitizeTestResult returns a test result that can be stored. Postgres can't
+// store NUL bytes and invalid UTF-8, so they are removed, and the suite and
+// name are truncated to maxTestNameLength bytes.
+func SanitizeTestResult(result TestResult) TestResult {
+	result.Suite = truncateText(sanitizeText(result.Suite), maxTestNameLength)
+	result.Name = truncateText(sanitizeText(result.Name), maxTestNameLength)
+	result.Message = sanitizeText(result.Message)
+	return result
+}
+
+func sanitizeText(text string) string {
+	return strings.ToValidUTF8(strings.ReplaceAll(text, "\x00", ""), "�")
+}
+
+// truncateText truncates text to at most maxLength bytes, without cutting a
+// character in half.
+func truncateText(text string, maxLength int) string {
+	if len(text) <= maxLength {
+		return text
+	}
+	return strings.ToValidUTF8(text[:maxLength], "")
+}
+
+// While a build is running, the builder keeps the test results it read in a
+// file. Once the build finishes, they are moved to the database.
+
+func (fs *FSStore) testResultsPath(buildID uint64) string {
+	return path.Join(fs.RootDir, "test-results", fmt.Sprintf("%d.json", buildID))
+}
+
+// WriteTestResults replaces the test results of a running build.
+func (fs *FSStore) WriteTestResults(buildID uint64, results []TestResult) error {
+	data, err := json.Marshal(results)
+	if err != nil {
+		return fmt.Errorf("failed to marshal test results: %w", err)
+	}
+	if err := os.WriteFile(fs.testResultsPath(buildID), data, 0o600); err != nil {
+		return fmt.Errorf("failed to write test results: %w", err)
+	}
+	return nil
+}
+
+// ReadTestResults returns the test results of a build that have not been moved
+// to the database yet, or nil if there are none.
+func (fs *FSStore) ReadTestResults(buildID uint64) ([]TestResult, error) {
+	// sec: Path is from a trusted user
+	data, err := os.ReadFile(fs.testResultsPath(buildID)) // #nosec G304
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read test results: %w", err)
+	}
+
+	var results []TestResult
+	if err := json.Unmarshal(data, &results); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal test results: %w", err)
+	}
+	return results, nil
+}
+
+// RemoveTestResults removes the test results file of a build once the results
+// are stored in the database.
+func (fs *FSStore) RemoveTestResults(buildID uint64) error {
+	err := os.Remove(fs.testResultsPath(buildID))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func insertTestResults(ctx context.Context, tx pgx.Tx, buildID uint64, results []TestResult) error {
+	for _, result := range results {
+		// The parsers sanitize the results already, but a result that can't be
+		// stored would fail the build
+		result = SanitizeTestResult(result)
+
+		var testCaseID uint64
+		err := tx.QueryRow(
+			ctx,
+			// Update on conflict, so that the ID of existing test cases is returned
+			`INSERT INTO test_cases (repo_id, suite, name)
+			SELECT repo_id, $2, $3 FROM builds WHERE id = $1
+			ON CONFLICT (repo_id, suite, name) DO UPDATE SET name = EXCLUDED.name
+			RETURNING id`,
+			buildID,
+			result.Suite,
+			result.Name,
+		).Scan(&testCaseID)
+		if err != nil {
+			return fmt.Errorf("failed to insert test case '%s': %w", result.Name, err)
+		}
+
+		// A test that is reported more than once keeps the result of its first
+		// failure, or its first result otherwise
+		_, err = tx.Exec(
+			ctx,
+			`INSERT INTO test_results (build_id, test_case_id, status, duration_ms, message)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (build_id, test_case_id) DO UPDATE
+			SET status = EXCLUDED.status, duration_ms = EXCLUDED.duration_ms, message = EXCLUDED.message
+			WHERE test_results.status <> 'failed' AND EXCLUDED.status = 'failed'`,
+			buildID,
+			testCaseID,
+			result.Status,
+			result.Duration.Milliseconds(),
+			result.Message,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to insert test result '%s': %w", result.Name, err)
+		}
+	}
+	return nil
+}
+
+// GetTestResults returns the test results of a finished build, failed tests
+// first, followed by skipped and passed tests.
+func (db DBStore) GetTestResults(ctx context.Context, buildID uint64) ([]TestResult, error) {
+	rows, err := db.pool.Query(
+		ctx,
+		`SELECT tc.suite, tc.name, tr.status, tr.duration_ms, tr.message
+		FROM test_results AS tr
+		INNER JOIN test_cases AS tc ON tr.test_case_id = tc.id
+		WHERE tr.build_id = $1
+		ORDER BY
+			CASE tr.status WHEN 'failed' THEN 0 WHEN 'skipped' THEN 1 ELSE 2 END,
+			tc.suite,
+			tc.name`,
+		buildID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return pgx.CollectRows(
+		rows,
+		func(row pgx.CollectableRow) (TestResult, error) {
+			r := TestResult{}
+			var durationMS int64
+			err := row.Scan(&r.Suite, &r.Name, &r.Status, &durationMS, &r.Message)
+			r.Duration = time.Duration(durationMS) * time.Millisecond
+			return r, err
+		})
+}
+
+// flakyTestHistory is the number of recent builds of a ref whose test results
+// are compared to detect flaky tests.
+const flakyTestHistory = 100
+
+// FlakyTest is a test whose result changed without a related change, either
+// between builds of the same commit, or by failing in a single build in
+// between passing builds.
+type FlakyTest struct {
+	Suite string
+	Name  string
+	// Number of failures that were followed or preceded by a pass
+	Flips int
+	// Latest build in which the test failed and which was a flip
+	LastBuildID  uint64
+	LastFinished time.Time
+}
+
+// ListFlakyTests detects flaky tests in the recent builds of the given ref of a
+// repo, usually its default branch. Jobs of a build matrix are only compared
+// to the jobs with the same env vars. The most recently flipped test is first.
+func (db DBStore) ListFlakyTests(ctx context.Context, owner, name, ref string) ([]FlakyTest, error) {
+	rows, err := db.pool.Query(
+		ctx,
+		`WITH recent_builds AS (
+			SELECT b.id, b.commit_sha, COALESCE(b.job_env, '{}'::jsonb) AS job_env, b.finished
+			FROM builds AS b
+			INNER JOIN repos AS r ON b.repo_id = r.id
+			WHERE r.owner = $1 AND r.name = $2 AND b.ref = $3
+				AND b.job_count = 0 AND b.finished IS NOT NULL
+			ORDER BY b.id DESC
+			LIMIT $4
+		),
+		history AS (
+			SELECT
+				tr.test_case_id,
+				rb.id AS build_id,
+				rb.finished,
+				tr.status,
+				LAG(tr.status) OVER consecutive AS prev_status,
+				LEAD(tr.status) OVER consecutive AS next_status,
+				BOOL_OR(tr.status = 'passed') OVER same_commit AS passed_on_commit
+			FROM test_results AS tr
+			INNER JOIN recent_builds AS rb ON tr.build_id = rb.id
+			WHERE tr.status <> 'skipped'
+			WINDOW
+				consecutive AS (PARTITION BY tr.test_case_id, rb.job_env ORDER BY rb.id),
+				same_commit AS (PARTITION BY tr.test_case_id, rb.job_env, rb.commit_sha)
+		)
+		SELECT tc.suite, tc.name, COUNT(*), MAX(h.build_id), MAX(h.finished)
+		FROM history AS h
+		INNER JOIN test_cases AS tc ON h.test_case_id = tc.id
+		WHERE h.status = 'failed' AND (
+			h.passed_on_commit OR (h.prev_status = 'passed' AND h.next_status = 'passed')
+		)
+		GROUP BY tc.id, tc.suite, tc.name
+		ORDER BY MAX(h.build_id) DESC, tc.suite, tc.name`,
+		owner,
+		name,
+		ref,
+		flakyTestHistory,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return pgx.CollectRows(
+		rows,
+		func(row pgx.CollectableRow) (FlakyTest, error) {
+			t := FlakyTest{}
+			err := row.Scan(&t.Suite, &t.Name, &t.Flips, &t.LastBuildID, &t.LastFinished)
+			return t, err
+		})
+}
@@ -0,0 +1,287 @@
+package store
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// BuildFiles is the disk space used by the files of a build in bytes.
+type BuildFiles struct {
+	BuildID     uint64
+	BuildLogs   int64
+	BuilderLogs int64
+	BuildDir    int64
+	Artifacts   int64
+}
+
+func (f BuildFiles) Logs() int64 {
+	return f.BuildLogs + f.BuilderLogs
+}
+
+// MeasureBuildFiles returns the disk space used by the files of each build,
+// ordered by build ID. Files that are deleted while they are measured, e.g. by
+// a running build, are left out. If some files can't be measured, the others
+// are returned together with the error.
+func (fs *FSStore) MeasureBuildFiles() ([]BuildFiles, error) {
+	files := make(map[uint64]*BuildFiles)
+	get := func(buildID uint64) *BuildFiles {
+		f, ok := files[buildID]
+		if !ok {
+			f = &BuildFiles{BuildID: buildID}
+			files[buildID] = f
+		}
+		return f
+	}
+
+	errs := []error{
+		measureBuildDir(path.Join(fs.RootDir, "build-logs"), func(id uint64, size int64) {
+			get(id).BuildLogs += size
+		}),
+		measureBuildDir(path.Join(fs.RootDir, "builder-logs"), func(id uint64, size int64) {
+			get(id).BuilderLogs += size
+		}),
+		measureBuildDir(path.Join(fs.RootDir, "build"), func(id uint64, size int64) {
+			get(id).BuildDir += size
+		}),
+		measureBuildDir(path.Join(fs.RootDir, "artifacts"), func(id uint64, size int64) {
+			get(id).Artifacts += size
+		}),
+	}
+
+	var measured []BuildFiles
+	for _, f := range files {
+		measured = append(measured, *f)
+	}
+	slices.SortFunc(measured, func(a, b BuildFiles) int {
+		return cmp.Compare(a.BuildID, b.BuildID)
+	})
+	return measured, errors.Join(errs...)
+}
+
+// measureBuildDir measures the files and dirs in dir that are named after the
+// ID of their build, e.g. "12.jsonl" or "12".
+func measureBuildDir(dir string, add func(buildID uint64, size int64)) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to list '%s': %w", dir, err)
+	}
+
+	var errs []error
+	for _, entry := range entries {
+		idStr, _, _ := strings.Cut(entry.Name(), ".")
+		id, err := strconv.ParseUint(idStr, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		size, err := dirSize(path.Join(dir, entry.Name()))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		add(id, size)
+	}
+	return errors.Join(errs...)
+}
+
+// MeasureCaches returns the total size of the keyed cache entries of each repo.
+func (fs *FSStore) MeasureCaches() (map[Repo]int64, error) {
+	repoDirs, err := filepath.Glob(path.Join(fs.RootDir, "caches", "*", "*"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list cache dirs: %w", err)
+	}
+
+	sizes := make(map[Repo]int64)
+	var errs []error
+	for _, dir := range repoDirs {
+		entries, err := listCacheEntries(dir)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		repo := Repo{Owner: path.Base(path.Dir(dir)), Name: path.Base(dir)}
+		for _, e := range entries {
+			sizes[repo] += e.Size
+		}
+	}
+	return sizes, errors.Join(errs...)
+}
+
+// DiskSpace is the size and free space of the filesystem of the data dir in
+// bytes.
+type DiskSpace struct {
+	Size int64
+	Free int64
+}
+
+func (s DiskSpace) Used() int64 {
+	return s.Size - s.Free
+}
+
+func (fs *FSStore) DiskSpace() (DiskSpace, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(fs.RootDir, &stat); err != nil {
+		return DiskSpace{}, fmt.Errorf("failed to get disk space: %w", err)
+	}
+
+	// sec: Sizes of real filesystems fit into an int64
+	return DiskSpace{
+		Size: int64(stat.Blocks) * stat.Bsize, // #nosec G115
+		// Space reserved for root is not available to the server
+		Free: int64(stat.Bavail) * stat.Bsize, // #nosec G115
+	}, nil
+}
+
+// RemoveLogs removes the build and builder logs of a build.
+func (fs *FSStore) RemoveLogs(buildID uint64) error {
+	logPaths := []string{
+		fs.buildLogPath(buildID),
+		fs.compressedBuildLogPath(buildID),
+		fs.buildLogIndexPath(buildID),
+		fs.builderLogPath(buildID),
+	}
+
+	var errs []error
+	for _, p := range logPaths {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("failed to remove logs: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// BuildRepo is the repo of a build, and when it finished.
+type BuildRepo struct {
+	BuildID  uint64
+	Repo     Repo
+	Finished *time.Time
+}
+
+// ListBuildRepos returns the repos of the given builds, ordered by build ID.
+// Builds that don't exist are left out.
+func (db DBStore) ListBuildRepos(ctx context.Context, buildIDs []uint64) ([]BuildRepo, error) {
+	rows, err := db.pool.Query(
+		ctx,
+		`SELECT b.id, r.owner, r.name, b.finished
+		FROM builds AS b
+		INNER JOIN repos AS r ON b.repo_id = r.id
+		WHERE b.id = ANY($1)
+		ORDER BY b.id`,
+		buildIDs,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return pgx.CollectRows(
+		rows,
+		func(row pgx.CollectableRow) (BuildRepo, error) {
+			b := BuildRepo{}
+			err := row.Scan(&b.BuildID, &b.Repo.Owner, &b.Repo.Name, &b.Finished)
+			return b, err
+		})
+}
+
+// RepoCache is the build whose build dir a repo uses as cache.
+type RepoCache struct {
+	Repo    Repo
+	CacheID uint64
+}
+
+// ListRepoCaches returns the builds whose build dirs repos use as cache.
+func (db DBStore) ListRepoCaches(ctx context.Context) ([]RepoCache, error) {
+	rows, err := db.pool.Query(
+		ctx,
+		`SELECT owner, name, cache_id
+		FROM repos
+		WHERE cache_id IS NOT NULL
+		ORDER BY id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return pgx.CollectRows(
+		rows,
+		func(row pgx.CollectableRow) (RepoCache, error) {
+			c := RepoCache{}
+			err := row.Scan(&c.Repo.Owner, &c.Repo.Name, &c.CacheID)
+			return c, err
+		})
+}
+
+// DropRepoCache stops a repo from using the build dir of a build as cache, so
+// that it is removed once no builder uses it anymore. Nothing changes if the
+// repo uses another build dir as cache by now.
+func (db DBStore) DropRepoCache(ctx context.Context, repo Repo, cacheID uint64) error {
+	_, err := db.pool.Exec(
+		ctx,
+		`UPDATE repos
+		SET cache_id = NULL
+		WHERE owner = $1 AND name = $2 AND cache_id = $3`,
+		repo.Owner, repo.Name, cacheID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update repo: %w", err)
+	}
+	return nil
+}
+
+// DiskUsage is the disk space used by the data of a repo in bytes.
+type DiskUsage struct {
+	BuildLogs   int64
+	BuilderLogs int64
+	BuildDirs   int64
+	Artifacts   int64
+	Caches      int64
+}
+
+func (u DiskUsage) Logs() int64 {
+	return u.BuildLogs + u.BuilderLogs
+}
+
+func (u DiskUsage) Total() int64 {
+	return u.BuildLogs + u.BuilderLogs + u.BuildDirs + u.Artifacts + u.Caches
+}
+
+// RepoDiskUsage sums up the disk space used by the builds and caches of each
+// repo. Files of builds that are not in builds are counted towards the zero
+// Repo.
+func RepoDiskUsage(files []BuildFiles, builds []BuildRepo, caches map[Repo]int64) map[Repo]DiskUsage {
+	buildRepos := make(map[uint64]Repo)
+	for _, b := range builds {
+		buildRepos[b.BuildID] = b.Repo
+	}
+
+	usage := make(map[Repo]DiskUsage)
+	for _, f := range files {
+		repo := buildRepos[f.BuildID]
+		u := usage[repo]
+		u.BuildLogs += f.BuildLogs
+		u.BuilderLogs += f.BuilderLogs
+		u.BuildDirs += f.BuildDir
+		u.Artifacts += f.Artifacts
+		usage[repo] = u
+	}
+	for repo, size := range caches {
+		u := usage[repo]
+		u.Caches += size
+		usage[repo] = u
+	}
+	return usage
+}
@@ -137,3 +137,56 @@ func TestMiddleware(t *testing.T) {
 		})
 	}
 }
+
+func TestAdminMiddleware(t *testing.T) {
+	testCases := []struct {
+		desc         string
+		auth         *BasicAuth
+		wantHTTPCode int
+	}{
+		{
+			desc:         "no auth header",
+			auth:         nil,
+			wantHTTPCode: http.StatusUnauthorized,
+		},
+		{
+			desc:         "invalid credentials of admin",
+			auth:         &BasicAuth{User: "test1", Password: "wrong_password"},
+			wantHTTPCode: http.StatusUnauthorized,
+		},
+		{
+			desc:         "valid credentials of other user",
+			auth:         &BasicAuth{User: "test2", Password: "4321"},
+			wantHTTPCode: http.StatusForbidden,
+		},
+		{
+			desc:         "valid credentials of admin",
+			auth:         &BasicAuth{User: "test1", Password: "1234"},
+			wantHTTPCode: http.StatusOK,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			userAuth, err := FromHtpasswd(htpasswd)
+			if err != nil {
+				t.Error(err)
+			}
+			handler := userAuth.AdminMiddleware([]string{"test1"}, http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusOK)
+				},
+			))
+
+			req := httptest.NewRequest(http.MethodGet, "/admin/", nil)
+			if tc.auth != nil {
+				req.SetBasicAuth(tc.auth.User, tc.auth.Password)
+			}
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, rr.Code, tc.wantHTTPCode, "handler returned wrong status code")
+		})
+	}
+}
@@ -0,0 +1,332 @@
+package ui
+
+import (
+	"fmt"
+	"html/template"
+	"strconv"
+	"strings"
+)
+
+// ansiColor is a color set by an SGR sequence.
+type ansiColor struct {
+	set bool
+	// One of the 16 basic colors, which are styled by the theme, unless rgb is
+	// set
+	index int
+	// CSS color of the 256 and true colors
+	rgb string
+}
+
+// ansiStyle is the style of text set by SGR sequences.
+type ansiStyle struct {
+	fg, bg    ansiColor
+	bold      bool
+	faint     bool
+	italic    bool
+	underline bool
+	strike    bool
+	inverse   bool
+}
+
+// Levels of the red, green and blue components in the 6x6x6 color cube of the
+// 256 colors
+var ansiCubeLevels = [6]int{0, 95, 135, 175, 215, 255}
+
+// RenderANSI renders text with ANSI escape sequences as HTML. The colors and
+// text attributes of SGR sequences are rendered as styled spans, and all other
+// escape sequences are dropped. Text that is overwritten after a carriage
+// return, e.g. by a progress bar, is dropped as well, so that only its final
+// state is shown.
+func RenderANSI(text string) template.HTML {
+	var html strings.Builder
+	var style ansiStyle
+	spanOpen := false
+	overwrite := false
+
+	closeSpan := func() {
+		if spanOpen {
+			html.WriteString("</span>")
+			spanOpen = false
+		}
+	}
+	writeText := func(s string) {
+		if s == "" {
+			return
+		}
+		if overwrite {
+			html.Reset()
+			spanOpen = false
+			overwrite = false
+		}
+		if !spanOpen && style != (ansiStyle{}) {
+			html.WriteString(style.openSpan())
+			spanOpen = true
+		}
+		html.WriteString(template.HTMLEscapeString(s))
+	}
+
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == '\x1b':
+			seq, final, n := parseEscapeSequence(text[i:])
+			i += n
+			if final == 'm' {
+				newStyle := style.apply(seq)
+				if newStyle != style {
+					closeSpan()
+					style = newStyle
+				}
+			}
+		case c == '\r':
+			// Only overwrite if there is text after the carriage return
+			overwrite = true
+			i++
+		case c < ' ' && c != '\t' || c == '\x7f':
+			// Drop other control characters, e.g. bell and backspace
+			i++
+		default:
+			end := strings.IndexFunc(text[i:], func(r rune) bool {
+				return r < ' ' && r != '\t' || r == '\x7f'
+			})
+			if end < 0 {
+				end = len(text) - i
+			}
+			writeText(text[i : i+end])
+			i += end
+		}
+	}
+	closeSpan()
+
+	// sec: The text is escaped, and the spans only contain generated classes
+	// and colors
+	return template.HTML(html.String()) // #nosec G203
+}
+
+// parseEscapeSequence parses the escape sequence at the start of s. It returns
+// the parameters and final byte of CSI sequences, and the length of the
+// sequence. Incomplete sequences extend to the end of s.
+func parseEscapeSequence(s string) (string, byte, int) {
+	if len(s) < 2 {
+		return "", 0, len(s)
+	}
+
+	switch s[1] {
+	case '[':
+		// CSI: parameter and intermediate bytes, followed by the final byte
+		for i := 2; i < len(s); i++ {
+			if s[i] >= 0x40 && s[i] <= 0x7e {
+				return s[2:i], s[i], i + 1
+			}
+			if s[i] < 0x20 || s[i] > 0x3f {
+				// Not a valid sequence, drop it up to here
+				return "", 0, i
+			}
+		}
+		return "", 0, len(s)
+	case ']':
+		// OSC, e.g. window titles and hyperlinks: terminated by BEL or ST
+		for i := 2; i < len(s); i++ {
+			if s[i] == '\a' {
+				return "", 0, i + 1
+			}
+			if s[i] == '\x1b' && i+1 < len(s) && s[i+1] == '\\' {
+				return "", 0, i + 2
+			}
+		}
+		return "", 0, len(s)
+	default:
+		// Other sequences: intermediate bytes followed by the final byte
+		i := 1
+		for i < len(s) && s[i] >= 0x20 && s[i] <= 0x2f {
+			i++
+		}
+		return "", 0, min(i+1, len(s))
+	}
+}
+
+// apply returns the style after the SGR sequence with params.
+func (s ansiStyle) apply(params string) ansiStyle {
+	codes := strings.Split(params, ";")
+	for i := 0; i < len(codes); i++ {
+		// Sub-parameters are separated by colons, e.g. "38:2::255:0:0"
+		sub := strings.Split(codes[i], ":")
+		code, err := strconv.Atoi(sub[0])
+		if sub[0] == "" {
+			code, err = 0, nil
+		}
+		if err != nil {
+			continue
+		}
+
+		switch {
+		case code == 0:
+			s = ansiStyle{}
+		case code == 1:
+			s.bold = true
+		case code == 2:
+			s.faint = true
+		case code == 3:
+			s.italic = true
+		case code == 4:
+			// "4:0" turns underline off
+			s.underline = len(sub) < 2 || sub[1] != "0"
+		case code == 7:
+			s.inverse = true
+		case code == 9:
+			s.strike = true
+		case code == 21:
+			s.underline = true
+		case code == 22:
+			s.bold = false
+			s.faint = false
+		case code == 23:
+			s.italic = false
+		case code == 24:
+			s.underline = false
+		case code == 27:
+			s.inverse = false
+		case code == 29:
+			s.strike = false
+		case code >= 30 && code <= 37:
+			s.fg = ansiColor{set: true, index: code - 30}
+		case code == 38 || code == 48:
+			var color ansiColor
+			if len(sub) > 1 {
+				color = parseExtendedColor(sub[1:], true)
+			} else {
+				var n int
+				color, n = parseExtendedColorArgs(codes[i+1:])
+				i += n
+			}
+			if code == 38 {
+				s.fg = color
+			} else {
+				s.bg = color
+			}
+		case code == 39:
+			s.fg = ansiColor{}
+		case code >= 40 && code <= 47:
+			s.bg = ansiColor{set: true, index: code - 40}
+		case code == 49:
+			s.bg = ansiColor{}
+		case code >= 90 && code <= 97:
+			s.fg = ansiColor{set: true, index: code - 90 + 8}
+		case code >= 100 && code <= 107:
+			s.bg = ansiColor{set: true, index: code - 100 + 8}
+		}
+	}
+	return s
+}
+
+// parseExtendedColorArgs parses the arguments of an extended color, which
+// follow "38" or "48" as separate parameters. It returns the color and the
+// number of parameters it consumed.
+func parseExtendedColorArgs(args []string) (ansiColor, int) {
+	if len(args) == 0 {
+		return ansiColor{}, 0
+	}
+	switch args[0] {
+	case "5":
+		n := min(len(args), 2)
+		return parseExtendedColor(args[:n], false), n
+	case "2":
+		n := min(len(args), 4)
+		return parseExtendedColor(args[:n], false), n
+	}
+	return ansiColor{}, 1
+}
+
+// parseExtendedColor parses "5;<index>" for one of 256 colors and
+// "2;<r>;<g>;<b>" for true colors. In the colon-separated form, true colors
+// have a color space ID before their components.
+func parseExtendedColor(args []string, colons bool) ansiColor {
+	components := make([]int, 0, 3)
+	for _, arg := range args[1:] {
+		n, _ := strconv.Atoi(arg)
+		components = append(components, max(0, min(n, 255)))
+	}
+
+	switch args[0] {
+	case "5":
+		if len(components) < 1 {
+			return ansiColor{}
+		}
+		return color256(components[0])
+	case "2":
+		if colons && len(components) == 4 {
+			components = components[1:]
+		}
+		if len(components) < 3 {
+			return ansiColor{}
+		}
+		return ansiColor{
+			set: true,
+			rgb: fmt.Sprintf("#%02x%02x%02x", components[0], components[1], components[2]),
+		}
+	}
+	return ansiColor{}
+}
+
+// color256 returns one of the 256 colors: the 16 basic colors, followed by a
+// 6x6x6 color cube and 24 shades of gray.
+func color256(n int) ansiColor {
+	if n < 16 {
+		return ansiColor{set: true, index: n}
+	}
+	var r, g, b int
+	if n < 232 {
+		n -= 16
+		r, g, b = ansiCubeLevels[n/36], ansiCubeLevels[n/6%6], ansiCubeLevels[n%6]
+	} else {
+		r = 8 + 10*(n-232)
+		g, b = r, r
+	}
+	return ansiColor{set: true, rgb: fmt.Sprintf("#%02x%02x%02x", r, g, b)}
+}
+
+// openSpan returns the opening tag of a span with the style.
+func (s ansiStyle) openSpan() string {
+	fg, bg := s.fg, s.bg
+	var classes, styles []string
+	if s.inverse {
+		fg, bg = bg, fg
+		// Provides the colors that are not set
+		classes = append(classes, "ansi-inverse")
+	}
+
+	if fg.set && fg.rgb != "" {
+		styles = append(styles, "color: "+fg.rgb)
+	} else if fg.set {
+		classes = append(classes, fmt.Sprintf("ansi-fg-%d", fg.index))
+	}
+	if bg.set && bg.rgb != "" {
+		styles = append(styles, "background-color: "+bg.rgb)
+	} else if bg.set {
+		classes = append(classes, fmt.Sprintf("ansi-bg-%d", bg.index))
+	}
+
+	for _, attr := range []struct {
+		set   bool
+		class string
+	}{
+		{s.bold, "ansi-bold"},
+		{s.faint, "ansi-faint"},
+		{s.italic, "ansi-italic"},
+		{s.underline, "ansi-underline"},
+		{s.strike, "ansi-strike"},
+	} {
+		if attr.set {
+			classes = append(classes, attr.class)
+		}
+	}
+
+	tag := "<span"
+	if len(classes) > 0 {
+		tag += fmt.Sprintf(` class="%s"`, strings.Join(classes, " "))
+	}
+	if len(styles) > 0 {
+		tag += fmt.Sprintf(` style="%s"`, strings.Join(styles, "; "))
+	}
+	return tag + ">"
+}
@@ -0,0 +1,95 @@
+package ui
+
+import (
+	"fmt"
+	"html/template"
+	"testing"
+
+	"github.com/ctbur/ci-server/v2/internal/assert"
+)
+
+func TestRenderANSI(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		text string
+		want template.HTML
+	}{
+		// Escaping
+		{
+			"plain HTML",
+			`<script>alert("x" & 'y')</script>`,
+			`&lt;script&gt;alert(&#34;x&#34; &amp; &#39;y&#39;)&lt;/script&gt;`,
+		},
+		{
+			"HTML in span",
+			"\x1b[31m<script>alert(\"x\" & 'y')</script>\x1b[0m",
+			`<span class="ansi-fg-1">&lt;script&gt;alert(&#34;x&#34; &amp; &#39;y&#39;)&lt;/script&gt;</span>`,
+		},
+		{
+			"HTML around span",
+			"<b>\x1b[1m\"bold\"\x1b[22m</b>",
+			`&lt;b&gt;<span class="ansi-bold">&#34;bold&#34;</span>&lt;/b&gt;`,
+		},
+		{
+			"HTML in OSC is dropped",
+			"\x1b]0;<script>\x07text",
+			"text",
+		},
+
+		// Incomplete and invalid sequences
+		{"ESC at end", "a\x1b", "a"},
+		{"CSI at end", "a\x1b[", "a"},
+		{"CSI without final byte", "a\x1b[31", "a"},
+		{"CSI with invalid byte", "a\x1b[3\x01b", "ab"},
+		{"OSC without terminator", "a\x1b]0;title", "a"},
+		{"OSC with incomplete ST", "a\x1b]0;title\x1b", "a"},
+		{"OSC with ST", "\x1b]8;;https://example.com\x1b\\link\x1b]8;;\x1b\\", "link"},
+		{"non-SGR CSI", "a\x1b[2Kb\x1b[1Ac", "abc"},
+		{"invalid SGR parameter", "\x1b[=;1mbold", `<span class="ansi-bold">bold</span>`},
+
+		// Colors
+		{"basic color", "\x1b[32mgreen", `<span class="ansi-fg-2">green</span>`},
+		{"bright background", "\x1b[101mred", `<span class="ansi-bg-9">red</span>`},
+		{"256 basic color", "\x1b[38;5;3mthree", `<span class="ansi-fg-3">three</span>`},
+		{"256 cube color", "\x1b[38;5;196mred", `<span style="color: #ff0000">red</span>`},
+		{"256 gray", "\x1b[48;5;244mgray", `<span style="background-color: #808080">gray</span>`},
+		{"256 color with colons", "\x1b[38:5:196mred", `<span style="color: #ff0000">red</span>`},
+		{"true color", "\x1b[38;2;1;2;3mrgb", `<span style="color: #010203">rgb</span>`},
+		{"true color background", "\x1b[48;2;255;0;0mbg", `<span style="background-color: #ff0000">bg</span>`},
+		{"true color with colons", "\x1b[38:2:1:2:3mrgb", `<span style="color: #010203">rgb</span>`},
+		{"true color with color space", "\x1b[38:2::1:2:3mrgb", `<span style="color: #010203">rgb</span>`},
+		{"true color out of range", "\x1b[38;2;300;-1;0mrgb", `<span style="color: #ff0000">rgb</span>`},
+		{"incomplete true color", "\x1b[38;2;1mtext", "text"},
+		{"color after extended color", "\x1b[38;5;196;42mx", `<span class="ansi-bg-2" style="color: #ff0000">x</span>`},
+		{"default color", "\x1b[31mred\x1b[39mdefault", `<span class="ansi-fg-1">red</span>default`},
+
+		// Attributes
+		{
+			"nested attributes",
+			"\x1b[1mbold\x1b[3mboth\x1b[22mitalic\x1b[0mplain",
+			`<span class="ansi-bold">bold</span><span class="ansi-bold ansi-italic">both</span>` +
+				`<span class="ansi-italic">italic</span>plain`,
+		},
+		{
+			"combined attributes and empty reset",
+			"\x1b[1;4;31mx\x1b[mplain",
+			`<span class="ansi-fg-1 ansi-bold ansi-underline">x</span>plain`,
+		},
+		{"reset in parameters", "\x1b[1;0;3mx", `<span class="ansi-italic">x</span>`},
+		{"underline off with colon", "\x1b[4mu\x1b[4:0mx", `<span class="ansi-underline">u</span>x`},
+		{"inverse", "\x1b[7;31minv", `<span class="ansi-inverse ansi-bg-1">inv</span>`},
+		{"unchanged style", "\x1b[1ma\x1b[1mb", `<span class="ansi-bold">ab</span>`},
+		{"style without text", "\x1b[31m\x1b[0m", ""},
+
+		// Carriage returns and control characters
+		{"progress bar", "10%\r50%\r100%", "100%"},
+		{"CRLF", "done\r\n", "done"},
+		{"trailing CR", "done\r", "done"},
+		{"overwrite styled text", "\x1b[31mred\rblue", `<span class="ansi-fg-1">blue</span>`},
+		{"overwrite with new style", "a\x1b[31m\rb", `<span class="ansi-fg-1">b</span>`},
+		{"control characters", "tab\tbell\a\x00\x7f", "tab\tbell"},
+	} {
+		got := RenderANSI(tc.text)
+		assert.Equal(t, got, tc.want, fmt.Sprintf("Incorrect HTML for %s (%q)", tc.name, tc.text))
+	}
+}
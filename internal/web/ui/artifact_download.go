@@ -0,0 +1,96 @@
+package ui
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ctbur/ci-server/v2/internal/ctxlog"
+	"github.com/ctbur/ci-server/v2/internal/store"
+)
+
+// artifactURL returns the download URL of an artifact. Names are paths, so each
+// of their segments is escaped separately.
+func artifactURL(buildID uint64, name string) string {
+	segments := strings.Split(name, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return fmt.Sprintf("/builds/%d/artifacts/%s", buildID, strings.Join(segments, "/"))
+}
+
+// disableWriteTimeout clears the write deadline of a response, so that large
+// downloads are not cut off after the server's write timeout.
+func disableWriteTimeout(ctx context.Context, w http.ResponseWriter) {
+	err := http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		ctxlog.FromContext(ctx).WarnContext(ctx, "Failed to clear write deadline", slog.Any("error", err))
+	}
+}
+
+func HandleArtifactDownload(db *store.DBStore, fs *store.FSStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		log := ctxlog.FromContext(ctx)
+
+		buildID, err := strconv.ParseUint(r.PathValue("build_id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid build ID", http.StatusNotFound)
+			return
+		}
+		name := r.PathValue("name")
+
+		// Only serve artifacts that are recorded, which also rejects names
+		// outside of the artifacts of the build
+		artifact, err := db.GetArtifact(ctx, buildID, name)
+		if errors.Is(err, store.ErrNoArtifact) {
+			http.Error(w, "Artifact not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to fetch artifact", http.StatusInternalServerError)
+			log.ErrorContext(ctx, "Failed to fetch artifact", slog.Any("error", err))
+			return
+		}
+		if artifact.Expires != nil && artifact.Expires.Before(time.Now()) {
+			http.Error(w, "Artifact has expired", http.StatusGone)
+			return
+		}
+
+		f, err := fs.OpenArtifact(buildID, artifact.Name)
+		if errors.Is(err, store.ErrNoArtifact) {
+			http.Error(w, "Artifact not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to open artifact", http.StatusInternalServerError)
+			log.ErrorContext(ctx, "Failed to open artifact", slog.Any("error", err))
+			return
+		}
+		defer f.Close()
+
+		info, err := f.Stat()
+		if err != nil {
+			http.Error(w, "Failed to open artifact", http.StatusInternalServerError)
+			log.ErrorContext(ctx, "Failed to stat artifact", slog.Any("error", err))
+			return
+		}
+
+		disableWriteTimeout(ctx, w)
+
+		w.Header().Set("Content-Disposition", mime.FormatMediaType(
+			"attachment", map[string]string{"filename": path.Base(artifact.Name)},
+		))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		// ServeContent sets the content type based on the name, which must not
+		// let browsers render uploaded HTML in the context of the UI
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, artifact.Name, info.ModTime(), f)
+	}
+}
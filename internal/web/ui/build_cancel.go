@@ -0,0 +1,58 @@
+package ui
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ctbur/ci-server/v2/internal/ctxlog"
+	"github.com/ctbur/ci-server/v2/internal/store"
+)
+
+// canceledStatusCreator updates the commit statuses of builds that were
+// canceled before they started, see build.Processor.
+type canceledStatusCreator interface {
+	CreateCanceledCommitStatuses(ctx context.Context, buildIDs []uint64)
+}
+
+func HandleCancelBuild(db *store.DBStore, statuses canceledStatusCreator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		log := ctxlog.FromContext(ctx)
+
+		// Browsers attach basic auth credentials to cross-site form posts, so
+		// only accept requests from our own pages or from non-browser clients
+		if site := r.Header.Get("Sec-Fetch-Site"); site != "" && site != "same-origin" {
+			http.Error(w, "Cross-site request rejected", http.StatusForbidden)
+			return
+		}
+
+		buildID, err := strconv.ParseUint(r.PathValue("build_id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid build ID", http.StatusNotFound)
+			return
+		}
+
+		canceledIDs, err := db.CancelBuild(ctx, buildID, time.Now())
+		if errors.Is(err, store.ErrNoBuild) {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		} else if errors.Is(err, store.ErrBuildFinished) {
+			http.Error(w, "Build has already finished", http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to cancel build", http.StatusInternalServerError)
+			log.ErrorContext(ctx, "Failed to cancel build", slog.Any("error", err))
+			return
+		}
+
+		statuses.CreateCanceledCommitStatuses(ctx, canceledIDs)
+
+		log.InfoContext(ctx, "Build cancel requested", slog.Uint64("id", buildID))
+		http.Redirect(w, r, fmt.Sprintf("/builds/%d", buildID), http.StatusSeeOther)
+	}
+}
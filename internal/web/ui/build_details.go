@@ -2,20 +2,85 @@ package ui
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"html/template"
 	"log/slog"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/ctbur/ci-server/v2/internal/config"
 	"github.com/ctbur/ci-server/v2/internal/ctxlog"
 	"github.com/ctbur/ci-server/v2/internal/store"
 )
 
 type LogLine struct {
 	Number         uint
+	Stream         store.LogStream
 	Text           string
 	TimeSinceStart time.Duration
+	// Set for lines marked with "::error::"
+	Error bool
+}
+
+type StepSection struct {
+	Index    int
+	Name     string
+	Status   string
+	Duration *time.Duration
+	Blocks   []LogBlock
+
+	// Set if the section contains the line the page links to
+	hasTarget bool
+}
+
+// Open reports whether the section of the step is expanded initially.
+func (s StepSection) Open() bool {
+	return s.hasTarget || s.Status != "success" && s.Status != "skipped" && s.Status != "pending"
+}
+
+type JobCard struct {
+	ID       uint64
+	Index    int
+	Name     string
+	Status   string
+	Duration *time.Duration
+}
+
+type ArtifactLink struct {
+	Name    string
+	URL     string
+	Size    int64
+	SHA256  string
+	Expires *time.Time
+}
+
+type TestRow struct {
+	Suite    string
+	Name     string
+	Status   string
+	Duration time.Duration
+	Message  string
+	// Set for failures of tests that are known to be flaky
+	Flaky bool
+}
+
+type TestSummary struct {
+	Passed  int
+	Failed  int
+	Skipped int
+	// Number of failed tests that are known to be flaky
+	FlakyFailed int
+	// Link to the flaky tests of the repo
+	FlakyTestsURL string
+	// Failed tests, which are shown expanded
+	FailedTests []TestRow
+	// Passed and skipped tests
+	OtherTests []TestRow
 }
 
 type BuildDetailsPage struct {
@@ -23,26 +88,113 @@ type BuildDetailsPage struct {
 	RepoOwner     string
 	RepoName      string
 	Status        string
+	QueuePosition uint64
 	Message       string
 	Number        uint64
 	Started       *time.Time
 	Duration      *time.Duration
-	LogLines      []LogLine
-	LastLogLineNr int
+	// Set for a job of a build matrix
+	ParentID *uint64
+	JobIndex int
+	JobName  string
+	// Set for a build matrix, which has no logs of its own
+	Jobs      []JobCard
+	Artifacts []ArtifactLink
+	Tests     *TestSummary
+	Steps     []StepSection
+	// Log lines that were written outside of steps
+	LogLines []LogLine
+	// Number of the first log line that is rendered, which is not 0 for links
+	// to a later line
+	FirstLogLineNr int
+	LastLogLineNr  int
+	// Group that is still open at the end of the logs, which the next update
+	// continues
+	OpenGroup *LogGroup
+	// Set if there are more log lines than were rendered, which are loaded
+	// right away
+	MoreLogs bool
+	// Re-render all logs, because the steps known to the client changed
+	FullLogs bool
+}
+
+// LogPosition returns where the next update of the page continues the logs,
+// see parseLogPosition.
+func (p *BuildDetailsPage) LogPosition() string {
+	if p.OpenGroup != nil {
+		return fmt.Sprintf("%d:%d", p.LastLogLineNr, p.OpenGroup.Line)
+	}
+	return strconv.Itoa(p.LastLogLineNr)
+}
+
+// logPosition is where an update of the page continues the logs.
+type logPosition struct {
+	// Next line of the logs
+	line int
+	// Line that started the group that is still open, or -1 if there is none
+	group int
+}
+
+// parseLogPosition parses "<line>" or "<line>:<group>".
+func parseLogPosition(s string) (logPosition, error) {
+	lineStr, groupStr, hasGroup := strings.Cut(s, ":")
+	line, err := strconv.ParseInt(lineStr, 10, 32)
+	if err != nil || line < 0 {
+		return logPosition{}, fmt.Errorf("invalid line '%s'", lineStr)
+	}
+	pos := logPosition{line: int(line), group: -1}
+
+	if hasGroup {
+		group, err := strconv.ParseInt(groupStr, 10, 32)
+		if err != nil || group < 0 || group >= line {
+			return logPosition{}, fmt.Errorf("invalid group '%s'", groupStr)
+		}
+		pos.group = int(group)
+	}
+	return pos, nil
 }
 
-func HandleBuildDetails(db *store.DBStore, fs *store.FSStore, tmpl *template.Template) http.HandlerFunc {
+// Maximum number of log lines rendered at once. Longer logs are loaded in
+// pages by the update stream.
+const logPageSize = 2000
+
+func HandleBuildDetails(cfg *config.Config, db *store.DBStore, fs *store.FSStore, tmpl *template.Template) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 		log := ctxlog.FromContext(ctx)
 
-		params, ok := getBuildDetailsParams(db, fs, w, r)
-		if !ok {
+		buildID, err := strconv.ParseUint(r.PathValue("build_id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid build ID", http.StatusNotFound)
+			return
+		}
+
+		// Links to a line of the logs, e.g. from the log search, start the logs
+		// at the page of that line and expand it
+		from := logPosition{group: -1}
+		target := -1
+		if lineStr := r.URL.Query().Get("line"); lineStr != "" {
+			line, err := strconv.ParseInt(lineStr, 10, 32)
+			if err != nil || line < 0 {
+				http.Error(w, "Invalid line parameter", http.StatusBadRequest)
+				return
+			}
+			target = int(line)
+			from.line = target - target%logPageSize
+		}
+
+		params, err := loadBuildDetails(ctx, cfg, db, fs, buildID, from, target, 0, false, false)
+		if errors.Is(err, store.ErrNoBuild) {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to fetch build", http.StatusInternalServerError)
+			log.ErrorContext(ctx, "Failed to fetch build", slog.Any("error", err))
 			return
 		}
 
 		var b bytes.Buffer
-		err := tmpl.ExecuteTemplate(&b, "page_build_details", params)
+		err = tmpl.ExecuteTemplate(&b, "page_build_details", params)
 		if err != nil {
 			http.Error(w, "Failed to render template", http.StatusInternalServerError)
 			log.ErrorContext(ctx, "Failed to render template", slog.Any("error", err))
@@ -54,91 +206,260 @@ func HandleBuildDetails(db *store.DBStore, fs *store.FSStore, tmpl *template.Tem
 	}
 }
 
-func HandleBuildDetailsFragment(db *store.DBStore, fs *store.FSStore, tmpl *template.Template) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
-		log := ctxlog.FromContext(ctx)
+// loadBuildDetails loads the details page of a build with a page of the logs
+// from position from. The step and group of line target are expanded, unless
+// it is -1. For updates of the page, knownSteps is the number of steps the page
+// has sections for, and all logs are loaded if that changed. Test results are
+// only loaded if the page doesn't show them yet, i.e. knownTests is false.
+func loadBuildDetails(
+	ctx context.Context,
+	cfg *config.Config,
+	db *store.DBStore,
+	fs *store.FSStore,
+	buildID uint64,
+	from logPosition,
+	target int,
+	knownSteps int,
+	knownTests bool,
+	update bool,
+) (*BuildDetailsPage, error) {
+	build, err := db.GetBuild(ctx, buildID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch build: %w", err)
+	}
 
-		params, ok := getBuildDetailsParams(db, fs, w, r)
-		if !ok {
-			return
+	if build == nil {
+		return nil, store.ErrNoBuild
+	}
+
+	status := buildStatus(*build)
+
+	// Parents of a build matrix don't run, so they are not in the queue
+	var queuePosition uint64
+	if status == "pending" && build.JobCount == 0 {
+		queuePosition, err = db.GetQueuePosition(ctx, build.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch queue position: %w", err)
 		}
+	}
 
-		var b bytes.Buffer
-		err := tmpl.ExecuteTemplate(&b, "resp_build_details_update", params)
+	var jobs []JobCard
+	if build.JobCount > 0 {
+		jobBuilds, err := db.ListJobs(ctx, build.ID)
 		if err != nil {
-			http.Error(w, "Failed to render template", http.StatusInternalServerError)
-			log.ErrorContext(ctx, "Failed to render template", slog.Any("error", err))
-			return
+			return nil, fmt.Errorf("failed to fetch jobs: %w", err)
+		}
+		for _, job := range jobBuilds {
+			jobs = append(jobs, JobCard{
+				ID:       job.ID,
+				Index:    job.JobIndex,
+				Name:     store.JobName(job.JobEnv),
+				Status:   buildStatus(job),
+				Duration: durationSinceBuildStart(job),
+			})
 		}
+	}
 
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		_, _ = b.WriteTo(w)
+	// Artifacts are collected at the end of the build
+	var artifacts []ArtifactLink
+	if build.Finished != nil {
+		buildArtifacts, err := db.GetArtifacts(ctx, build.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch artifacts: %w", err)
+		}
+		for _, a := range buildArtifacts {
+			artifacts = append(artifacts, ArtifactLink{
+				Name:    a.Name,
+				URL:     artifactURL(build.ID, a.Name),
+				Size:    a.Size,
+				SHA256:  a.SHA256,
+				Expires: a.Expires,
+			})
+		}
 	}
-}
 
-func getBuildDetailsParams(db *store.DBStore, fs *store.FSStore, w http.ResponseWriter, r *http.Request) (*BuildDetailsPage, bool) {
-	ctx := r.Context()
-	log := ctxlog.FromContext(ctx)
+	// Test results are read at the end of the build, so they don't change
+	// anymore once the page shows them
+	var tests *TestSummary
+	if build.Finished != nil && !(update && knownTests) {
+		testResults, err := db.GetTestResults(ctx, build.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch test results: %w", err)
+		}
+		tests = testSummary(testResults)
+	}
 
-	buildID, err := strconv.ParseUint(r.PathValue("build_id"), 10, 64)
-	if err != nil {
-		http.Error(w, "Invalid build ID", http.StatusNotFound)
-		return nil, false
+	// Point out failures of flaky tests, to avoid that they are investigated
+	// or re-run blindly
+	repo := cfg.Repos.Get(build.Repo.Owner, build.Repo.Name)
+	if tests != nil && tests.Failed > 0 && repo != nil {
+		flakyTests, err := db.ListFlakyTests(ctx, repo.Owner, repo.Name, defaultBranchRef(*repo))
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch flaky tests: %w", err)
+		}
+		markFlakyTests(tests, flakyTests)
+		tests.FlakyTestsURL = flakyTestsURL(repo.Owner, repo.Name)
 	}
 
-	fromLine := 0
-	if fromLineStr := r.URL.Query().Get("fromLine"); fromLineStr != "" {
-		id, err := strconv.ParseInt(fromLineStr, 10, 32)
-		if err != nil || id < 0 {
-			http.Error(w, "Invalid fromLine parameter", http.StatusBadRequest)
-			return nil, false
+	var buildSteps []store.BuildStep
+	if build.Started != nil && build.JobCount == 0 {
+		buildSteps, err = getBuildSteps(ctx, db, fs, *build)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch build steps: %w", err)
 		}
-		fromLine = int(id)
 	}
 
-	build, err := db.GetBuild(ctx, buildID)
-	if err != nil {
-		http.Error(w, "Failed to fetch build", http.StatusInternalServerError)
-		log.ErrorContext(ctx, "Failed to fetch build", slog.Any("error", err))
-		return nil, false
+	fullLogs := update && knownSteps != len(buildSteps)
+	if fullLogs {
+		from = logPosition{group: -1}
 	}
+	fromLine := from.line
 
-	if build == nil {
-		http.Error(w, "Build not found", http.StatusNotFound)
-		return nil, false
+	steps := make([]StepSection, len(buildSteps))
+	for i, step := range buildSteps {
+		steps[i] = StepSection{
+			Index:    step.Index,
+			Name:     step.Name,
+			Status:   stepStatus(step, *build),
+			Duration: stepDuration(step, *build),
+		}
 	}
 
-	var logLines []LogLine
-	if build.Started != nil {
-		logs, err := fs.GetLogs(ctx, build.ID, fromLine)
+	logs := logSorter{steps: steps, target: target}
+	numLogLines := 0
+	moreLogs := false
+	var openGroup *LogGroup
+	if build.Started != nil && build.JobCount == 0 {
+		if from.group >= 0 {
+			group, err := getContinuedLogGroup(ctx, fs, build.ID, from)
+			if err != nil {
+				return nil, err
+			}
+			if group != nil && group.step < len(steps) {
+				logs.open = group
+				steps[group.step].Blocks = []LogBlock{{Group: group}}
+			}
+		}
+
+		entries, err := fs.GetLogs(ctx, build.ID, fromLine, logPageSize)
 		if err != nil {
-			http.Error(w, "Failed to fetch logs", http.StatusInternalServerError)
-			log.ErrorContext(ctx, "Failed to fetch logs", slog.Any("error", err))
-			return nil, false
+			return nil, fmt.Errorf("failed to fetch logs: %w", err)
 		}
+		numLogLines = len(entries)
+		moreLogs = numLogLines == logPageSize
 
-		logLines = make([]LogLine, len(logs))
-		for i, log := range logs {
-			logLines[i] = LogLine{
+		for i, entry := range entries {
+			logs.add(LogLine{
 				// sec: Overflow not practical
 				Number:         uint(fromLine + i), // #nosec G115
-				Text:           log.Text,
-				TimeSinceStart: log.Timestamp.Sub(*build.Started),
-			}
+				Stream:         entry.Stream,
+				Text:           entry.Text,
+				TimeSinceStart: entry.Timestamp.Sub(*build.Started),
+			}, entry)
 		}
+		openGroup = logs.finish(moreLogs)
 	}
 
 	return &BuildDetailsPage{
-		ID:            build.ID,
-		RepoOwner:     build.Repo.Owner,
-		RepoName:      build.Repo.Name,
-		Status:        buildStatus(*build),
-		Message:       shortCommitMessage(build.Message),
-		Number:        build.Number,
-		Started:       build.Started,
-		Duration:      durationSinceBuildStart(*build),
-		LogLines:      logLines,
-		LastLogLineNr: fromLine + len(logLines),
-	}, true
+		ID:             build.ID,
+		RepoOwner:      build.Repo.Owner,
+		RepoName:       build.Repo.Name,
+		Status:         status,
+		QueuePosition:  queuePosition,
+		Message:        shortCommitMessage(build.Message),
+		Number:         build.Number,
+		Started:        build.Started,
+		Duration:       durationSinceBuildStart(*build),
+		ParentID:       build.ParentID,
+		JobIndex:       build.JobIndex,
+		JobName:        store.JobName(build.JobEnv),
+		Jobs:           jobs,
+		Artifacts:      artifacts,
+		Tests:          tests,
+		Steps:          steps,
+		LogLines:       logs.lines,
+		FirstLogLineNr: fromLine,
+		LastLogLineNr:  fromLine + numLogLines,
+		OpenGroup:      openGroup,
+		MoreLogs:       moreLogs,
+		FullLogs:       fullLogs,
+	}, nil
+}
+
+// testSummary counts the test results by status, or returns nil if there are
+// none. The results are expected to be ordered with failed tests first.
+func testSummary(results []store.TestResult) *TestSummary {
+	if len(results) == 0 {
+		return nil
+	}
+
+	summary := &TestSummary{}
+	for _, r := range results {
+		row := TestRow{
+			Suite:    r.Suite,
+			Name:     r.Name,
+			Duration: r.Duration,
+			Message:  r.Message,
+		}
+		switch r.Status {
+		case store.TestStatusFailed:
+			summary.Failed++
+			row.Status = "failure"
+			summary.FailedTests = append(summary.FailedTests, row)
+		case store.TestStatusSkipped:
+			summary.Skipped++
+			row.Status = "skipped"
+			summary.OtherTests = append(summary.OtherTests, row)
+		default:
+			summary.Passed++
+			row.Status = "success"
+			summary.OtherTests = append(summary.OtherTests, row)
+		}
+	}
+	return summary
+}
+
+// markFlakyTests marks the failed tests of the summary that are flaky.
+func markFlakyTests(summary *TestSummary, flakyTests []store.FlakyTest) {
+	for i := range summary.FailedTests {
+		row := &summary.FailedTests[i]
+		row.Flaky = slices.ContainsFunc(flakyTests, func(t store.FlakyTest) bool {
+			return t.Suite == row.Suite && t.Name == row.Name
+		})
+		if row.Flaky {
+			summary.FlakyFailed++
+		}
+	}
+}
+
+// getContinuedLogGroup returns the group that is open at the log position, or
+// nil if the logs don't start a group there.
+func getContinuedLogGroup(ctx context.Context, fs *store.FSStore, buildID uint64, from logPosition) (*LogGroup, error) {
+	start, err := fs.GetLogs(ctx, buildID, from.group, 1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch log group: %w", err)
+	}
+	last, err := fs.GetLogs(ctx, buildID, from.line-1, 1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch log group: %w", err)
+	}
+	if len(start) == 0 || len(last) == 0 {
+		return nil, nil
+	}
+	// sec: Lines are not negative
+	return continuedLogGroup(start[0], uint(from.group), last[0]), nil // #nosec G115
+}
+
+// getBuildSteps returns the steps of a build from the builder while it runs,
+// and from the database once it finished.
+func getBuildSteps(ctx context.Context, db *store.DBStore, fs *store.FSStore, build store.Build) ([]store.BuildStep, error) {
+	if build.Finished == nil {
+		steps, err := fs.ReadBuildSteps(build.ID)
+		if err != nil || steps != nil {
+			return steps, err
+		}
+		// The steps file is removed once the build finished, so the build
+		// could have finished since it was fetched
+	}
+	return db.GetBuildSteps(ctx, build.ID)
 }
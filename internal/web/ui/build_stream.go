@@ -0,0 +1,138 @@
+package ui
+
+import (
+	"bytes"
+	"errors"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ctbur/ci-server/v2/internal/config"
+	"github.com/ctbur/ci-server/v2/internal/ctxlog"
+	"github.com/ctbur/ci-server/v2/internal/store"
+)
+
+const (
+	// Period to check for status changes of a build, which don't change its
+	// logs
+	buildStreamPollPeriod = time.Second
+	// Minimum time between updates, so that builds with a lot of output don't
+	// cause an update for every line
+	buildStreamMinUpdatePeriod = 200 * time.Millisecond
+)
+
+// HandleBuildStream streams updates of the build details page as server-sent
+// events, until the build finished. Each update has the position where the
+// logs continue as ID, so that a reconnecting client continues from there.
+func HandleBuildStream(cfg *config.Config, db *store.DBStore, fs *store.FSStore, tmpl *template.Template) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		log := ctxlog.FromContext(ctx)
+
+		buildID, err := strconv.ParseUint(r.PathValue("build_id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid build ID", http.StatusNotFound)
+			return
+		}
+
+		positionStr := r.URL.Query().Get("from")
+		if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+			positionStr = lastEventID
+		}
+		position := logPosition{group: -1}
+		if positionStr != "" {
+			position, err = parseLogPosition(positionStr)
+			if err != nil {
+				http.Error(w, "Invalid log position", http.StatusBadRequest)
+				return
+			}
+		}
+
+		// Number of steps the client has sections for
+		knownSteps := 0
+		if stepsStr := r.URL.Query().Get("steps"); stepsStr != "" {
+			n, err := strconv.ParseInt(stepsStr, 10, 32)
+			if err != nil || n < 0 {
+				http.Error(w, "Invalid steps parameter", http.StatusBadRequest)
+				return
+			}
+			knownSteps = int(n)
+		}
+
+		// Fall back to polling the logs if they can't be watched
+		logChanges, err := fs.WatchLogs(ctx, buildID)
+		if err != nil {
+			log.WarnContext(ctx, "Failed to watch build logs", slog.Any("error", err))
+		}
+
+		sse := beginSSE(w)
+		poll := time.NewTicker(buildStreamPollPeriod)
+		defer poll.Stop()
+
+		// Whether an update showed the test results of the finished build
+		knownTests := false
+		var lastUpdate string
+		for {
+			params, err := loadBuildDetails(ctx, cfg, db, fs, buildID, position, -1, knownSteps, knownTests, true)
+			if errors.Is(err, store.ErrNoBuild) {
+				_ = sse.sendEvent("", "done", "done")
+				return
+			} else if err != nil {
+				// The client reconnects and resumes from the last update
+				log.ErrorContext(ctx, "Failed to fetch build", slog.Any("error", err))
+				return
+			}
+
+			var b bytes.Buffer
+			err = tmpl.ExecuteTemplate(&b, "resp_build_details_update", params)
+			if err != nil {
+				log.ErrorContext(ctx, "Failed to render template", slog.Any("error", err))
+				return
+			}
+			// A carriage return would end the line of the event, so it is sent
+			// as character reference
+			update := strings.ReplaceAll(b.String(), "\r", "&#13;")
+
+			if update != lastUpdate {
+				if err := sse.sendEvent(params.LogPosition(), "update", update); err != nil {
+					log.InfoContext(ctx, "Build stream closed", slog.Any("error", err))
+					return
+				}
+				lastUpdate = update
+			}
+			position = logPosition{line: params.LastLogLineNr, group: -1}
+			if params.OpenGroup != nil {
+				// sec: Overflow not practical
+				position.group = int(params.OpenGroup.Line) // #nosec G115
+			}
+			knownSteps = len(params.Steps)
+			knownTests = params.Status != "pending" && params.Status != "running"
+
+			if params.MoreLogs {
+				continue
+			}
+			if params.Status != "pending" && params.Status != "running" {
+				_ = sse.sendEvent("", "done", "done")
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(buildStreamMinUpdatePeriod):
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-logChanges:
+				if !ok {
+					return
+				}
+			case <-poll.C:
+			}
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package ui
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/ctbur/ci-server/v2/internal/config"
+	"github.com/ctbur/ci-server/v2/internal/ctxlog"
+	"github.com/ctbur/ci-server/v2/internal/store"
+)
+
+type DiskUsageRow struct {
+	// Empty for files of builds that no longer exist
+	Repo  string
+	Usage store.DiskUsage
+	// Nil for repos that are no longer configured
+	Quota *config.QuotaConfig
+}
+
+func (r DiskUsageRow) LogsOverQuota() bool {
+	return r.Quota != nil && r.Quota.MaxLogSize > 0 && r.Usage.Logs() > r.Quota.MaxLogSize
+}
+
+func (r DiskUsageRow) CachesOverQuota() bool {
+	return r.Quota != nil && r.Quota.MaxCacheSize > 0 && r.Usage.Caches > r.Quota.MaxCacheSize
+}
+
+type DiskUsagePage struct {
+	DiskSpace   store.DiskSpace
+	UsedPercent int64
+	Rows        []DiskUsageRow
+	Total       store.DiskUsage
+	// Set if some files could not be measured
+	Incomplete bool
+}
+
+// HandleDiskUsage shows the disk space used by the data of each repo.
+func HandleDiskUsage(
+	cfg *config.Config, db *store.DBStore, fs *store.FSStore, tmpl *template.Template,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		log := ctxlog.FromContext(ctx)
+
+		params := DiskUsagePage{}
+
+		diskSpace, err := fs.DiskSpace()
+		if err != nil {
+			http.Error(w, "Failed to get disk space", http.StatusInternalServerError)
+			log.ErrorContext(ctx, "Failed to get disk space", slog.Any("error", err))
+			return
+		}
+		params.DiskSpace = diskSpace
+		if diskSpace.Size > 0 {
+			params.UsedPercent = diskSpace.Used() * 100 / diskSpace.Size
+		}
+
+		// Show what could be measured, files of running builds may change
+		files, err := fs.MeasureBuildFiles()
+		if err != nil {
+			params.Incomplete = true
+			log.WarnContext(ctx, "Failed to measure build files", slog.Any("error", err))
+		}
+		caches, err := fs.MeasureCaches()
+		if err != nil {
+			params.Incomplete = true
+			log.WarnContext(ctx, "Failed to measure caches", slog.Any("error", err))
+		}
+
+		buildIDs := make([]uint64, len(files))
+		for i, f := range files {
+			buildIDs[i] = f.BuildID
+		}
+		builds, err := db.ListBuildRepos(ctx, buildIDs)
+		if err != nil {
+			http.Error(w, "Failed to fetch builds", http.StatusInternalServerError)
+			log.ErrorContext(ctx, "Failed to fetch builds", slog.Any("error", err))
+			return
+		}
+
+		usage := store.RepoDiskUsage(files, builds, caches)
+		// Show configured repos even if they don't use any space yet
+		for _, repo := range cfg.Repos {
+			key := store.Repo{Owner: repo.Owner, Name: repo.Name}
+			usage[key] = usage[key]
+		}
+
+		for repo, u := range usage {
+			row := DiskUsageRow{Usage: u}
+			if repo != (store.Repo{}) {
+				row.Repo = fmt.Sprintf("%s/%s", repo.Owner, repo.Name)
+			}
+			if repoCfg := cfg.Repos.Get(repo.Owner, repo.Name); repoCfg != nil {
+				row.Quota = &repoCfg.Quota
+			}
+			params.Rows = append(params.Rows, row)
+
+			params.Total.BuildLogs += u.BuildLogs
+			params.Total.BuilderLogs += u.BuilderLogs
+			params.Total.BuildDirs += u.BuildDirs
+			params.Total.Artifacts += u.Artifacts
+			params.Total.Caches += u.Caches
+		}
+		slices.SortFunc(params.Rows, func(a, b DiskUsageRow) int {
+			if c := cmp.Compare(b.Usage.Total(), a.Usage.Total()); c != 0 {
+				return c
+			}
+			return cmp.Compare(a.Repo, b.Repo)
+		})
+
+		var b bytes.Buffer
+		err = tmpl.ExecuteTemplate(&b, "page_disk_usage", params)
+		if err != nil {
+			http.Error(w, "Failed to render template", http.StatusInternalServerError)
+			log.ErrorContext(ctx, "Failed to render template", slog.Any("error", err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = b.WriteTo(w)
+	}
+}
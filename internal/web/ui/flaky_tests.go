@@ -0,0 +1,86 @@
+package ui
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ctbur/ci-server/v2/internal/config"
+	"github.com/ctbur/ci-server/v2/internal/ctxlog"
+	"github.com/ctbur/ci-server/v2/internal/store"
+)
+
+type FlakyTestRow struct {
+	Suite        string
+	Name         string
+	Flips        int
+	LastBuildID  uint64
+	LastFinished *time.Time
+}
+
+type FlakyTestsPage struct {
+	RepoOwner     string
+	RepoName      string
+	DefaultBranch string
+	FlakyTests    []FlakyTestRow
+}
+
+func flakyTestsURL(owner, name string) string {
+	return fmt.Sprintf("/repos/%s/%s/flaky-tests", url.PathEscape(owner), url.PathEscape(name))
+}
+
+func defaultBranchRef(repo config.RepoConfig) string {
+	return fmt.Sprintf("refs/heads/%s", repo.DefaultBranch)
+}
+
+// HandleFlakyTests lists the tests of a repo that are flaky on its default
+// branch.
+func HandleFlakyTests(cfg *config.Config, db *store.DBStore, tmpl *template.Template) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		log := ctxlog.FromContext(ctx)
+
+		repo := cfg.Repos.Get(r.PathValue("owner"), r.PathValue("name"))
+		if repo == nil {
+			http.Error(w, "Repo not found", http.StatusNotFound)
+			return
+		}
+
+		flakyTests, err := db.ListFlakyTests(ctx, repo.Owner, repo.Name, defaultBranchRef(*repo))
+		if err != nil {
+			http.Error(w, "Failed to fetch flaky tests", http.StatusInternalServerError)
+			log.ErrorContext(ctx, "Failed to fetch flaky tests", slog.Any("error", err))
+			return
+		}
+
+		params := FlakyTestsPage{
+			RepoOwner:     repo.Owner,
+			RepoName:      repo.Name,
+			DefaultBranch: repo.DefaultBranch,
+		}
+		for _, t := range flakyTests {
+			params.FlakyTests = append(params.FlakyTests, FlakyTestRow{
+				Suite:        t.Suite,
+				Name:         t.Name,
+				Flips:        t.Flips,
+				LastBuildID:  t.LastBuildID,
+				LastFinished: &t.LastFinished,
+			})
+		}
+
+		var b bytes.Buffer
+		err = tmpl.ExecuteTemplate(&b, "page_flaky_tests", params)
+		if err != nil {
+			http.Error(w, "Failed to render template", http.StatusInternalServerError)
+			log.ErrorContext(ctx, "Failed to render template", slog.Any("error", err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = b.WriteTo(w)
+	}
+}
@@ -30,6 +30,45 @@ func buildStatus(b store.Build) string {
 	return "pending"
 }
 
+func stepStatus(s store.BuildStep, b store.Build) string {
+	switch {
+	case s.Skipped:
+		return "skipped"
+	case s.TimedOut:
+		return "timeout"
+	case s.ExitCode != nil && *s.ExitCode == 0:
+		return "success"
+	case s.ExitCode != nil:
+		return "failure"
+	case b.Result != nil && s.Started == nil:
+		return "skipped"
+	case b.Result != nil:
+		// The builder stopped while the step was running, e.g. because the
+		// build was canceled
+		return string(*b.Result)
+	case s.Started != nil:
+		return "running"
+	}
+	return "pending"
+}
+
+func stepDuration(s store.BuildStep, b store.Build) *time.Duration {
+	if s.Started == nil {
+		return nil
+	}
+
+	var duration time.Duration
+	if s.Finished != nil {
+		duration = s.Finished.Sub(*s.Started)
+	} else if b.Finished != nil {
+		// The builder stopped while the step was running
+		duration = b.Finished.Sub(*s.Started)
+	} else {
+		duration = time.Since(*s.Started)
+	}
+	return &duration
+}
+
 func shortCommitMessage(msg string) string {
 	trimmed := strings.TrimSpace(msg)
 	return strings.SplitN(trimmed, "\n", 2)[0]
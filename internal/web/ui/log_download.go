@@ -0,0 +1,161 @@
+package ui
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/ctbur/ci-server/v2/internal/ctxlog"
+	"github.com/ctbur/ci-server/v2/internal/store"
+)
+
+// Format of the timestamps in plain text logs
+const logTimestampFormat = "2006-01-02T15:04:05.000Z07:00"
+
+type buildGetter interface {
+	GetBuild(ctx context.Context, buildID uint64) (*store.Build, error)
+}
+
+// HandleLogText serves the build logs as plain text. With "timestamps=true",
+// each line starts with the time it was written, and with "streams=true",
+// with the stream it was written to.
+func HandleLogText(db buildGetter, fs *store.FSStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		timestamps, err := parseBoolParam(r, "timestamps")
+		if err != nil {
+			http.Error(w, "Invalid timestamps parameter", http.StatusBadRequest)
+			return
+		}
+		streams, err := parseBoolParam(r, "streams")
+		if err != nil {
+			http.Error(w, "Invalid streams parameter", http.StatusBadRequest)
+			return
+		}
+
+		serveLogs(w, r, db, fs, "text/plain; charset=utf-8", "txt", func(bw *bufio.Writer, entry store.LogEntry) error {
+			if timestamps {
+				_, _ = bw.WriteString(entry.Timestamp.UTC().Format(logTimestampFormat))
+				_ = bw.WriteByte(' ')
+			}
+			if streams {
+				_, _ = fmt.Fprintf(bw, "[%s] ", entry.Stream)
+			}
+			_, _ = bw.WriteString(entry.Text)
+			return bw.WriteByte('\n')
+		})
+	}
+}
+
+// HandleLogJSONL serves the build logs with one JSON object per line.
+func HandleLogJSONL(db buildGetter, fs *store.FSStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serveLogs(w, r, db, fs, "application/jsonl; charset=utf-8", "jsonl", func(bw *bufio.Writer, entry store.LogEntry) error {
+			return json.NewEncoder(bw).Encode(&entry)
+		})
+	}
+}
+
+// serveLogs streams the build logs of the build in the request, writing each
+// line with writeEntry.
+func serveLogs(
+	w http.ResponseWriter,
+	r *http.Request,
+	db buildGetter,
+	fs *store.FSStore,
+	contentType, extension string,
+	writeEntry func(bw *bufio.Writer, entry store.LogEntry) error,
+) {
+	ctx := r.Context()
+	log := ctxlog.FromContext(ctx)
+
+	buildID, err := strconv.ParseUint(r.PathValue("build_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid build ID", http.StatusNotFound)
+		return
+	}
+
+	_, err = db.GetBuild(ctx, buildID)
+	if errors.Is(err, store.ErrNoBuild) {
+		http.Error(w, "Build not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch build", http.StatusInternalServerError)
+		log.ErrorContext(ctx, "Failed to fetch build", slog.Any("error", err))
+		return
+	}
+
+	disableWriteTimeout(ctx, w)
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(
+		"inline", map[string]string{"filename": fmt.Sprintf("build-%d.%s", buildID, extension)},
+	))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	bw := bufio.NewWriter(w)
+	err = fs.ReadLogs(buildID, func(entry store.LogEntry) error {
+		return writeEntry(bw, entry)
+	})
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		// The response has already started, so the client sees a truncated
+		// download
+		log.ErrorContext(ctx, "Failed to serve logs", slog.Uint64("build_id", buildID), slog.Any("error", err))
+	}
+}
+
+// HandleBuilderLog serves the logs of the builder of a build, which show what
+// the CI did to run it.
+func HandleBuilderLog(fs *store.FSStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		log := ctxlog.FromContext(ctx)
+
+		buildID, err := strconv.ParseUint(r.PathValue("build_id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid build ID", http.StatusNotFound)
+			return
+		}
+
+		f, err := fs.ReadBuilderLogs(buildID)
+		if err != nil {
+			http.Error(w, "Failed to open builder logs", http.StatusInternalServerError)
+			log.ErrorContext(ctx, "Failed to open builder logs", slog.Any("error", err))
+			return
+		}
+		if f == nil {
+			http.Error(w, "Builder logs not found", http.StatusNotFound)
+			return
+		}
+		defer f.Close()
+
+		info, err := f.Stat()
+		if err != nil {
+			http.Error(w, "Failed to open builder logs", http.StatusInternalServerError)
+			log.ErrorContext(ctx, "Failed to stat builder logs", slog.Any("error", err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+	}
+}
+
+// parseBoolParam parses an optional boolean query parameter, which is false if
+// it is not set.
+func parseBoolParam(r *http.Request, name string) (bool, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
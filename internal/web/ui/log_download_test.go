@@ -0,0 +1,156 @@
+package ui
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ctbur/ci-server/v2/internal/assert"
+	"github.com/ctbur/ci-server/v2/internal/store"
+)
+
+type MockBuildGetter struct {
+	Builds map[uint64]store.Build
+}
+
+func (g *MockBuildGetter) GetBuild(ctx context.Context, buildID uint64) (*store.Build, error) {
+	build, ok := g.Builds[buildID]
+	if !ok {
+		return nil, store.ErrNoBuild
+	}
+	return &build, nil
+}
+
+func TestLogDownload(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "log-download-test")
+	assert.NoError(t, err, "Failed to create temp directory").Fatal()
+	defer os.RemoveAll(tempDir)
+
+	fs := &store.FSStore{RootDir: tempDir}
+	err = fs.CreateRootDirs()
+	assert.NoError(t, err, "Failed to create root dirs").Fatal()
+
+	logs, err := fs.OpenBuildLogs(1)
+	assert.NoError(t, err, "Failed to open logs").Fatal()
+	step := 0
+	for _, entry := range []store.LogEntry{
+		{Stream: store.LogStreamCI, Timestamp: time.UnixMilli(1000).UTC(), Text: "Step 1"},
+		{Step: &step, Stream: store.LogStreamStdout, Timestamp: time.UnixMilli(1500).UTC(), Text: "<out>"},
+		{Step: &step, Stream: store.LogStreamStderr, Timestamp: time.UnixMilli(2250).UTC(), Text: "err"},
+	} {
+		err := logs.WriteEntry(entry)
+		assert.NoError(t, err, "Failed to write log entry").Fatal()
+	}
+	assert.NoError(t, logs.Close(), "Failed to close logs").Fatal()
+
+	db := &MockBuildGetter{Builds: map[uint64]store.Build{1: {ID: 1}, 2: {ID: 2}}}
+
+	for _, tc := range []struct {
+		name        string
+		handler     http.HandlerFunc
+		buildID     string
+		query       string
+		status      int
+		contentType string
+		body        string
+	}{
+		{
+			name:        "text",
+			handler:     HandleLogText(db, fs),
+			buildID:     "1",
+			status:      http.StatusOK,
+			contentType: "text/plain; charset=utf-8",
+			body:        "Step 1\n<out>\nerr\n",
+		},
+		{
+			name:        "text with timestamps",
+			handler:     HandleLogText(db, fs),
+			buildID:     "1",
+			query:       "timestamps=true",
+			status:      http.StatusOK,
+			contentType: "text/plain; charset=utf-8",
+			body: "1970-01-01T00:00:01.000Z Step 1\n" +
+				"1970-01-01T00:00:01.500Z <out>\n" +
+				"1970-01-01T00:00:02.250Z err\n",
+		},
+		{
+			name:        "text with streams",
+			handler:     HandleLogText(db, fs),
+			buildID:     "1",
+			query:       "streams=1",
+			status:      http.StatusOK,
+			contentType: "text/plain; charset=utf-8",
+			body:        "[ci] Step 1\n[out] <out>\n[err] err\n",
+		},
+		{
+			name:        "text with timestamps and streams",
+			handler:     HandleLogText(db, fs),
+			buildID:     "1",
+			query:       "timestamps=true&streams=true",
+			status:      http.StatusOK,
+			contentType: "text/plain; charset=utf-8",
+			body: "1970-01-01T00:00:01.000Z [ci] Step 1\n" +
+				"1970-01-01T00:00:01.500Z [out] <out>\n" +
+				"1970-01-01T00:00:02.250Z [err] err\n",
+		},
+		{
+			name:        "JSON lines",
+			handler:     HandleLogJSONL(db, fs),
+			buildID:     "1",
+			status:      http.StatusOK,
+			contentType: "application/jsonl; charset=utf-8",
+			body: `{"stream":"ci","timestamp":"1970-01-01T00:00:01Z","text":"Step 1"}` + "\n" +
+				`{"step":0,"stream":"out","timestamp":"1970-01-01T00:00:01.5Z","text":"\u003cout\u003e"}` + "\n" +
+				`{"step":0,"stream":"err","timestamp":"1970-01-01T00:00:02.25Z","text":"err"}` + "\n",
+		},
+		{
+			name:        "build without logs",
+			handler:     HandleLogText(db, fs),
+			buildID:     "2",
+			status:      http.StatusOK,
+			contentType: "text/plain; charset=utf-8",
+			body:        "",
+		},
+		{
+			name:    "invalid parameter",
+			handler: HandleLogText(db, fs),
+			buildID: "1",
+			query:   "timestamps=maybe",
+			status:  http.StatusBadRequest,
+		},
+		{
+			name:    "unknown build as text",
+			handler: HandleLogText(db, fs),
+			buildID: "3",
+			status:  http.StatusNotFound,
+		},
+		{
+			name:    "unknown build as JSON lines",
+			handler: HandleLogJSONL(db, fs),
+			buildID: "3",
+			status:  http.StatusNotFound,
+		},
+		{
+			name:    "invalid build ID",
+			handler: HandleLogJSONL(db, fs),
+			buildID: "abc",
+			status:  http.StatusNotFound,
+		},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/builds/"+tc.buildID+"/log?"+tc.query, nil)
+		r.SetPathValue("build_id", tc.buildID)
+		w := httptest.NewRecorder()
+		tc.handler(w, r)
+
+		assert.Equal(t, w.Code, tc.status, fmt.Sprintf("Incorrect status for %s", tc.name))
+		if tc.status != http.StatusOK {
+			continue
+		}
+		assert.Equal(t, w.Header().Get("Content-Type"), tc.contentType, fmt.Sprintf("Incorrect content type for %s", tc.name))
+		assert.Equal(t, w.Body.String(), tc.body, fmt.Sprintf("Incorrect body for %s", tc.name))
+	}
+}
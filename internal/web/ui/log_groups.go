@@ -0,0 +1,207 @@
+package ui
+
+import (
+	"strings"
+	"time"
+
+	"github.com/ctbur/ci-server/v2/internal/store"
+)
+
+// Markers that build scripts print to group their logs and to point out
+// errors, in the syntax of GitHub Actions workflow commands
+const (
+	logGroupMarker    = "::group::"
+	logEndGroupMarker = "::endgroup::"
+	logErrorMarker    = "::error"
+)
+
+// LogGroup is a collapsible section of the logs of a step, which starts at a
+// "::group::<name>" line and ends at the next "::endgroup::" line, the next
+// group, or the end of the step.
+type LogGroup struct {
+	// Number of the line that started the group, which identifies it
+	Line     uint
+	Name     string
+	Duration *time.Duration
+	// Expanded initially, because the group contains errors, is the last
+	// group of a failed step, or still runs
+	Open bool
+	// Set if the group was started in an earlier update of the page
+	Continued bool
+
+	step    int
+	started time.Time
+	// Time of the last line of the group
+	lastLine time.Time
+}
+
+// LogBlock is a group of log lines, or lines outside of groups if Group is
+// nil.
+type LogBlock struct {
+	Group *LogGroup
+	Lines []LogLine
+}
+
+// ContinuedBlock returns the block of the group that was started in an earlier
+// update of the page, if the logs continue it.
+func (s StepSection) ContinuedBlock() *LogBlock {
+	if len(s.Blocks) > 0 && s.Blocks[0].Group != nil && s.Blocks[0].Group.Continued {
+		return &s.Blocks[0]
+	}
+	return nil
+}
+
+// NewBlocks returns the blocks that are not continued from an earlier update
+// of the page.
+func (s StepSection) NewBlocks() []LogBlock {
+	if s.ContinuedBlock() != nil {
+		return s.Blocks[1:]
+	}
+	return s.Blocks
+}
+
+// parseLogMarker returns the kind of marker a log line starts with, and the
+// text after it.
+func parseLogMarker(text string) (string, string) {
+	if name, ok := strings.CutPrefix(text, logGroupMarker); ok {
+		return logGroupMarker, name
+	}
+	if text == logEndGroupMarker {
+		return logEndGroupMarker, ""
+	}
+	if rest, ok := strings.CutPrefix(text, logErrorMarker); ok {
+		// Errors can have parameters, e.g. "::error file=main.go,line=1::msg"
+		if rest == "" || rest[0] == ' ' || rest[0] == ':' {
+			if _, msg, ok := strings.Cut(rest, "::"); ok {
+				return logErrorMarker, msg
+			}
+		}
+	}
+	return "", text
+}
+
+// continuedLogGroup returns the group that starts at line, if the logs there
+// start a group. It is used to continue a group that is still open at the end
+// of an earlier update of the page, whose last line was lastLine.
+func continuedLogGroup(start store.LogEntry, line uint, lastLine store.LogEntry) *LogGroup {
+	marker, name := parseLogMarker(start.Text)
+	if marker != logGroupMarker || start.Step == nil {
+		return nil
+	}
+	return &LogGroup{
+		Line:      line,
+		Name:      name,
+		Continued: true,
+		step:      *start.Step,
+		started:   start.Timestamp,
+		lastLine:  lastLine.Timestamp,
+	}
+}
+
+// logSorter sorts log lines into the steps they were written by and the
+// groups within them.
+type logSorter struct {
+	steps []StepSection
+	// Lines that were written outside of steps, e.g. by the CI
+	lines []LogLine
+	// Group that was not ended yet
+	open *LogGroup
+	// Line whose step and group are expanded, or -1 if there is none
+	target int
+}
+
+// add adds a line of the logs.
+func (s *logSorter) add(line LogLine, entry store.LogEntry) {
+	if entry.Step == nil || *entry.Step < 0 || *entry.Step >= len(s.steps) {
+		s.lines = append(s.lines, line)
+		return
+	}
+	step := &s.steps[*entry.Step]
+	// sec: target is not negative
+	isTarget := s.target >= 0 && line.Number == uint(s.target) // #nosec G115
+	step.hasTarget = step.hasTarget || isTarget
+
+	// Groups end with the step they are in
+	if s.open != nil && s.open.step != *entry.Step {
+		s.closeGroup(s.open.lastLine)
+	}
+
+	marker, text := parseLogMarker(entry.Text)
+	switch marker {
+	case logGroupMarker:
+		if s.open != nil {
+			s.closeGroup(entry.Timestamp)
+		}
+		s.open = &LogGroup{
+			Line:     line.Number,
+			Name:     text,
+			step:     *entry.Step,
+			started:  entry.Timestamp,
+			lastLine: entry.Timestamp,
+		}
+		step.Blocks = append(step.Blocks, LogBlock{Group: s.open})
+		return
+	case logEndGroupMarker:
+		if s.open != nil {
+			s.closeGroup(entry.Timestamp)
+		}
+		return
+	case logErrorMarker:
+		line.Text = text
+		line.Error = true
+	}
+
+	if s.open != nil {
+		s.open.lastLine = entry.Timestamp
+		s.open.Open = s.open.Open || line.Error || isTarget
+	} else if n := len(step.Blocks); n == 0 || step.Blocks[n-1].Group != nil {
+		step.Blocks = append(step.Blocks, LogBlock{})
+	}
+	block := &step.Blocks[len(step.Blocks)-1]
+	block.Lines = append(block.Lines, line)
+}
+
+// closeGroup ends the open group at time end.
+func (s *logSorter) closeGroup(end time.Time) {
+	duration := end.Sub(s.open.started)
+	s.open.Duration = &duration
+	s.open = nil
+}
+
+// finish ends the open group if its step finished, unless there are more logs
+// to come, and expands the last group of failed steps. It returns the group
+// that is still open.
+func (s *logSorter) finish(moreLogs bool) *LogGroup {
+	if s.open != nil && !moreLogs {
+		status := s.steps[s.open.step].Status
+		if status == "running" || status == "pending" {
+			// Show the output of the running group
+			s.open.Open = true
+		} else {
+			s.closeGroup(s.open.lastLine)
+		}
+	}
+
+	for i := range s.steps {
+		step := &s.steps[i]
+		if !stepFailed(step.Status) {
+			continue
+		}
+		for j := len(step.Blocks) - 1; j >= 0; j-- {
+			if step.Blocks[j].Group != nil {
+				step.Blocks[j].Group.Open = true
+				break
+			}
+		}
+	}
+
+	return s.open
+}
+
+func stepFailed(status string) bool {
+	switch status {
+	case "success", "skipped", "running", "pending":
+		return false
+	}
+	return true
+}
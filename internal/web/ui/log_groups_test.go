@@ -0,0 +1,342 @@
+package ui
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ctbur/ci-server/v2/internal/assert"
+	"github.com/ctbur/ci-server/v2/internal/store"
+)
+
+// testLogEntry is a line of the logs that is written by step, or outside of
+// steps if step is -1. Lines are written one second apart.
+type testLogEntry struct {
+	step int
+	text string
+}
+
+var testLogStart = time.Unix(1000, 0)
+
+func testLogEntries(entries []testLogEntry) []store.LogEntry {
+	var logEntries []store.LogEntry
+	for i, e := range entries {
+		entry := store.LogEntry{
+			Text:      e.text,
+			Timestamp: testLogStart.Add(time.Duration(i) * time.Second),
+		}
+		if e.step >= 0 {
+			entry.Step = &e.step
+		}
+		logEntries = append(logEntries, entry)
+	}
+	return logEntries
+}
+
+func testStepSections(statuses []string) []StepSection {
+	steps := make([]StepSection, len(statuses))
+	for i, status := range statuses {
+		steps[i] = StepSection{Index: i, Status: status}
+	}
+	return steps
+}
+
+// describeBlocks describes the blocks of the steps as
+// "<step>: [group <name> [<duration>|running] [open] [continued]:] <lines>",
+// where lines with errors are marked with "!".
+func describeBlocks(steps []StepSection) []string {
+	var blocks []string
+	for _, step := range steps {
+		for _, block := range step.Blocks {
+			var b strings.Builder
+			fmt.Fprintf(&b, "%d: ", step.Index)
+			if g := block.Group; g != nil {
+				fmt.Fprintf(&b, "group %s", g.Name)
+				if g.Duration != nil {
+					fmt.Fprintf(&b, " %s", *g.Duration)
+				} else {
+					b.WriteString(" running")
+				}
+				if g.Open {
+					b.WriteString(" open")
+				}
+				if g.Continued {
+					b.WriteString(" continued")
+				}
+				b.WriteString(": ")
+			}
+			var lines []string
+			for _, line := range block.Lines {
+				if line.Error {
+					lines = append(lines, "!"+line.Text)
+				} else {
+					lines = append(lines, line.Text)
+				}
+			}
+			b.WriteString(strings.Join(lines, ", "))
+			blocks = append(blocks, b.String())
+		}
+	}
+	return blocks
+}
+
+func TestLogSorter(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		statuses []string
+		entries  []testLogEntry
+		target   int
+		moreLogs bool
+		want     []string
+		// Name of the group that is still open, if any
+		wantOpen string
+	}{
+		{
+			name:     "group",
+			statuses: []string{"success"},
+			entries: []testLogEntry{
+				{0, "before"},
+				{0, "::group::Install"},
+				{0, "a"},
+				{0, "::endgroup::"},
+				{0, "after"},
+			},
+			target: -1,
+			want:   []string{"0: before", "0: group Install 2s: a", "0: after"},
+		},
+		{
+			name:     "lines outside of steps",
+			statuses: []string{"success"},
+			entries: []testLogEntry{
+				{-1, "::group::Not a group"},
+				{0, "a"},
+				{-1, "cloning"},
+			},
+			target: -1,
+			want:   []string{"0: a"},
+		},
+		{
+			name:     "nested group without endgroup",
+			statuses: []string{"success"},
+			entries: []testLogEntry{
+				{0, "::group::Outer"},
+				{0, "a"},
+				{0, "::group::Inner"},
+				{0, "b"},
+				{0, "::endgroup::"},
+				{0, "::endgroup::"},
+				{0, "c"},
+			},
+			target: -1,
+			// Groups don't nest, a group ends where the next one starts
+			want: []string{"0: group Outer 2s: a", "0: group Inner 2s: b", "0: c"},
+		},
+		{
+			name:     "unterminated group of finished step",
+			statuses: []string{"success"},
+			entries: []testLogEntry{
+				{0, "::group::Test"},
+				{0, "a"},
+				{0, "b"},
+			},
+			target: -1,
+			want:   []string{"0: group Test 2s: a, b"},
+		},
+		{
+			name:     "unterminated group of running step",
+			statuses: []string{"running"},
+			entries: []testLogEntry{
+				{0, "::group::Test"},
+				{0, "a"},
+			},
+			target:   -1,
+			want:     []string{"0: group Test running open: a"},
+			wantOpen: "Test",
+		},
+		{
+			name:     "group ends with its step",
+			statuses: []string{"success", "success"},
+			entries: []testLogEntry{
+				{0, "::group::Build"},
+				{0, "a"},
+				{1, "b"},
+			},
+			target: -1,
+			want:   []string{"0: group Build 1s: a", "1: b"},
+		},
+		{
+			name:     "last group of failed step is expanded",
+			statuses: []string{"success", "failed"},
+			entries: []testLogEntry{
+				{0, "::group::Install"},
+				{0, "a"},
+				{0, "::endgroup::"},
+				{1, "::group::Lint"},
+				{1, "b"},
+				{1, "::endgroup::"},
+				{1, "::group::Test"},
+				{1, "c"},
+				{1, "::endgroup::"},
+				{1, "FAIL"},
+			},
+			target: -1,
+			want: []string{
+				"0: group Install 2s: a",
+				"1: group Lint 2s: b",
+				"1: group Test 2s open: c",
+				"1: FAIL",
+			},
+		},
+		{
+			name:     "unterminated group of timed out step is expanded",
+			statuses: []string{"timeout"},
+			entries: []testLogEntry{
+				{0, "::group::Test"},
+				{0, "a"},
+			},
+			target: -1,
+			want:   []string{"0: group Test 1s open: a"},
+		},
+		{
+			name:     "group with error is expanded",
+			statuses: []string{"success"},
+			entries: []testLogEntry{
+				{0, "::group::Lint"},
+				{0, "::error file=main.go,line=1::unused variable"},
+				{0, "::endgroup::"},
+				{0, "::group::Test"},
+				{0, "ok"},
+				{0, "::endgroup::"},
+			},
+			target: -1,
+			want:   []string{"0: group Lint 2s open: !unused variable", "0: group Test 2s: ok"},
+		},
+		{
+			name:     "group with target line is expanded",
+			statuses: []string{"success"},
+			entries: []testLogEntry{
+				{0, "::group::Install"},
+				{0, "a"},
+				{0, "::endgroup::"},
+				{0, "::group::Test"},
+				{0, "b"},
+				{0, "::endgroup::"},
+			},
+			target: 4,
+			want:   []string{"0: group Install 2s: a", "0: group Test 2s open: b"},
+		},
+		{
+			name:     "group at end of page stays open",
+			statuses: []string{"success"},
+			entries: []testLogEntry{
+				{0, "::group::Test"},
+				{0, "a"},
+			},
+			target:   -1,
+			moreLogs: true,
+			want:     []string{"0: group Test running: a"},
+			wantOpen: "Test",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := logSorter{steps: testStepSections(tc.statuses), target: tc.target}
+			for i, entry := range testLogEntries(tc.entries) {
+				// #nosec G115
+				s.add(LogLine{Number: uint(i), Text: entry.Text}, entry)
+			}
+			open := s.finish(tc.moreLogs)
+
+			assert.DeepEqual(t, describeBlocks(s.steps), tc.want, "Incorrect blocks")
+			openName := ""
+			if open != nil {
+				openName = open.Name
+			}
+			assert.Equal(t, openName, tc.wantOpen, "Incorrect open group")
+		})
+	}
+}
+
+func TestLogSorterTargetExpandsStep(t *testing.T) {
+	s := logSorter{steps: testStepSections([]string{"success", "success"}), target: 1}
+	for i, entry := range testLogEntries([]testLogEntry{{0, "a"}, {1, "b"}}) {
+		// #nosec G115
+		s.add(LogLine{Number: uint(i), Text: entry.Text}, entry)
+	}
+	s.finish(false)
+
+	assert.Equal(t, s.steps[0].Open(), false, "Step without target is expanded")
+	assert.Equal(t, s.steps[1].Open(), true, "Step with target is not expanded")
+}
+
+func TestLogSorterContinuesGroup(t *testing.T) {
+	entries := testLogEntries([]testLogEntry{
+		{0, "a"},
+		{0, "::group::Test"},
+		{0, "b"},
+		// Page boundary
+		{0, "c"},
+		{0, "::endgroup::"},
+		{0, "d"},
+	})
+	const pageSize = 3
+
+	// First page, which ends within the group
+	first := logSorter{steps: testStepSections([]string{"success"}), target: -1}
+	for i, entry := range entries[:pageSize] {
+		// #nosec G115
+		first.add(LogLine{Number: uint(i), Text: entry.Text}, entry)
+	}
+	page := BuildDetailsPage{LastLogLineNr: pageSize, OpenGroup: first.finish(true)}
+	assert.DeepEqual(t, describeBlocks(first.steps), []string{"0: a", "0: group Test running: b"}, "Incorrect blocks of first page")
+	assert.Equal(t, page.LogPosition(), "3:1", "Incorrect log position")
+
+	// The update continues the group from the position of the page
+	from, err := parseLogPosition(page.LogPosition())
+	assert.NoError(t, err, "Failed to parse log position").Fatal()
+	group := continuedLogGroup(entries[from.group], uint(from.group), entries[from.line-1]) // #nosec G115
+	assert.Equal(t, group != nil, true, "Group is not continued").Fatal()
+
+	second := logSorter{steps: testStepSections([]string{"success"}), target: -1, open: group}
+	second.steps[group.step].Blocks = []LogBlock{{Group: group}}
+	for i, entry := range entries[from.line:] {
+		// #nosec G115
+		second.add(LogLine{Number: uint(from.line + i), Text: entry.Text}, entry)
+	}
+	open := second.finish(false)
+
+	assert.Equal(t, open, nil, "Group is still open")
+	assert.DeepEqual(t, describeBlocks(second.steps), []string{"0: group Test 3s continued: c", "0: d"}, "Incorrect blocks of update")
+	continued := second.steps[0].ContinuedBlock()
+	assert.Equal(t, continued != nil, true, "No continued block").Fatal()
+	assert.Equal(t, continued.Group.Line, uint(1), "Incorrect line of continued group")
+	assert.Equal(t, len(second.steps[0].NewBlocks()), 1, "Incorrect number of new blocks")
+}
+
+func TestContinuedLogGroupWithoutGroup(t *testing.T) {
+	entries := testLogEntries([]testLogEntry{{0, "not a group"}, {-1, "::group::Outside of steps"}})
+
+	assert.Equal(t, continuedLogGroup(entries[0], 0, entries[0]), nil, "Line without marker continues group")
+	assert.Equal(t, continuedLogGroup(entries[1], 1, entries[1]), nil, "Line outside of steps continues group")
+}
+
+func TestParseLogPosition(t *testing.T) {
+	for _, tc := range []struct {
+		s       string
+		want    logPosition
+		wantErr bool
+	}{
+		{"0", logPosition{line: 0, group: -1}, false},
+		{"2000", logPosition{line: 2000, group: -1}, false},
+		{"2000:1500", logPosition{line: 2000, group: 1500}, false},
+		{"-1", logPosition{}, true},
+		{"x", logPosition{}, true},
+		{"10:10", logPosition{}, true},
+		{"10:-1", logPosition{}, true},
+		{"10:", logPosition{}, true},
+	} {
+		pos, err := parseLogPosition(tc.s)
+		assert.Equal(t, err != nil, tc.wantErr, fmt.Sprintf("Incorrect error for %q", tc.s))
+		assert.Equal(t, pos, tc.want, fmt.Sprintf("Incorrect position for %q", tc.s))
+	}
+}
@@ -0,0 +1,211 @@
+package ui
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ctbur/ci-server/v2/internal/config"
+	"github.com/ctbur/ci-server/v2/internal/ctxlog"
+	"github.com/ctbur/ci-server/v2/internal/store"
+)
+
+// Limits of the log lines shown for a search, which keep builds that hit an
+// error in every test from crowding out the other builds
+const (
+	maxLogSearchHitsPerBuild = 5
+	maxLogSearchHits         = 200
+)
+
+type LogSearchLine struct {
+	Number int
+	// Text of the line with the search terms highlighted
+	Text template.HTML
+	URL  string
+}
+
+type LogSearchBuild struct {
+	ID       uint64
+	Repo     string
+	Number   uint64
+	JobIndex int
+	Ref      string
+	Status   string
+	Created  *time.Time
+	Lines    []LogSearchLine
+}
+
+type LogSearchPage struct {
+	Query  string
+	Repo   string
+	Result string
+	From   string
+	To     string
+	// Options of the filters
+	Repos   []string
+	Results []store.BuildResult
+	// Set once a search ran
+	Searched bool
+	Builds   []LogSearchBuild
+	// Set if there are more matching lines than were returned
+	Truncated bool
+}
+
+// HandleLogSearch searches the logs of finished builds for lines that contain
+// all words of the query, optionally filtered by repo, build result and the
+// date range in which the builds were created.
+func HandleLogSearch(cfg *config.Config, db *store.DBStore, tmpl *template.Template) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		log := ctxlog.FromContext(ctx)
+
+		query := r.URL.Query()
+		params := LogSearchPage{
+			Query:  strings.TrimSpace(query.Get("q")),
+			Repo:   query.Get("repo"),
+			Result: query.Get("result"),
+			From:   query.Get("from"),
+			To:     query.Get("to"),
+			Results: []store.BuildResult{
+				store.BuildResultSuccess,
+				store.BuildResultFailed,
+				store.BuildResultCanceled,
+				store.BuildResultTimeout,
+				store.BuildResultError,
+			},
+		}
+		for _, repo := range cfg.Repos {
+			params.Repos = append(params.Repos, repo.Owner+"/"+repo.Name)
+		}
+
+		search := store.LogSearch{Query: params.Query}
+		if params.Repo != "" {
+			owner, name, ok := strings.Cut(params.Repo, "/")
+			if !ok {
+				http.Error(w, "Invalid repo parameter", http.StatusBadRequest)
+				return
+			}
+			search.Repo = store.Repo{Owner: owner, Name: name}
+		}
+		if params.Result != "" {
+			result := store.BuildResult(params.Result)
+			if !slices.Contains(params.Results, result) {
+				http.Error(w, "Invalid result parameter", http.StatusBadRequest)
+				return
+			}
+			search.Result = result
+		}
+		if params.From != "" {
+			from, err := time.ParseInLocation(time.DateOnly, params.From, time.Local)
+			if err != nil {
+				http.Error(w, "Invalid from parameter", http.StatusBadRequest)
+				return
+			}
+			search.CreatedAfter = from
+		}
+		if params.To != "" {
+			to, err := time.ParseInLocation(time.DateOnly, params.To, time.Local)
+			if err != nil {
+				http.Error(w, "Invalid to parameter", http.StatusBadRequest)
+				return
+			}
+			// The date range includes the last day
+			search.CreatedBefore = to.AddDate(0, 0, 1)
+		}
+
+		if params.Query != "" {
+			hits, err := db.SearchLogs(ctx, search, maxLogSearchHitsPerBuild, maxLogSearchHits)
+			if err != nil {
+				http.Error(w, "Failed to search logs", http.StatusInternalServerError)
+				log.ErrorContext(ctx, "Failed to search logs", slog.Any("error", err))
+				return
+			}
+
+			params.Searched = true
+			params.Builds = groupLogSearchHits(hits, searchTerms(params.Query))
+			params.Truncated = len(hits) == maxLogSearchHits
+		}
+
+		var b bytes.Buffer
+		err := tmpl.ExecuteTemplate(&b, "page_log_search", params)
+		if err != nil {
+			http.Error(w, "Failed to render template", http.StatusInternalServerError)
+			log.ErrorContext(ctx, "Failed to render template", slog.Any("error", err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = b.WriteTo(w)
+	}
+}
+
+// groupLogSearchHits groups the hits, which are ordered by build, into the
+// builds they are in.
+func groupLogSearchHits(hits []store.LogSearchHit, terms *regexp.Regexp) []LogSearchBuild {
+	var builds []LogSearchBuild
+	for _, hit := range hits {
+		if n := len(builds); n == 0 || builds[n-1].ID != hit.BuildID {
+			builds = append(builds, LogSearchBuild{
+				ID:       hit.BuildID,
+				Repo:     hit.Repo.Owner + "/" + hit.Repo.Name,
+				Number:   hit.Number,
+				JobIndex: hit.JobIndex,
+				Ref:      hit.Ref,
+				Status:   string(hit.Result),
+				Created:  &hit.Created,
+			})
+		}
+		build := &builds[len(builds)-1]
+		build.Lines = append(build.Lines, LogSearchLine{
+			Number: hit.Line.Number,
+			Text:   highlightTerms(hit.Line.Text, terms),
+			URL:    fmt.Sprintf("/builds/%d?line=%d#L%d", hit.BuildID, hit.Line.Number, hit.Line.Number),
+		})
+	}
+	return builds
+}
+
+// Characters that separate the words of a query
+var searchTermSeparators = regexp.MustCompile(`[^\pL\pN]+`)
+
+// searchTerms returns a pattern that matches the words of a query, or nil if
+// it has none. Words that the query excludes are matched as well, which is
+// harmless as the lines don't contain them.
+func searchTerms(query string) *regexp.Regexp {
+	var terms []string
+	for _, word := range searchTermSeparators.Split(query, -1) {
+		// "or" is an operator of the query
+		if word != "" && !strings.EqualFold(word, "or") {
+			terms = append(terms, regexp.QuoteMeta(word))
+		}
+	}
+	if len(terms) == 0 {
+		return nil
+	}
+	return regexp.MustCompile(`(?i)\b(` + strings.Join(terms, "|") + `)\b`)
+}
+
+// highlightTerms renders text as HTML with the search terms marked.
+func highlightTerms(text string, terms *regexp.Regexp) template.HTML {
+	var html strings.Builder
+	last := 0
+	if terms != nil {
+		for _, m := range terms.FindAllStringIndex(text, -1) {
+			html.WriteString(template.HTMLEscapeString(text[last:m[0]]))
+			html.WriteString("<mark>")
+			html.WriteString(template.HTMLEscapeString(text[m[0]:m[1]]))
+			html.WriteString("</mark>")
+			last = m[1]
+		}
+	}
+	html.WriteString(template.HTMLEscapeString(text[last:]))
+
+	// sec: The text is escaped, and only the marks are added
+	return template.HTML(html.String()) // #nosec G203
+}
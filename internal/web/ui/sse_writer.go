@@ -4,8 +4,13 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 )
 
+// Time to write an event before the stream is closed. It replaces the write
+// timeout of the server, which would end the stream.
+const sseWriteTimeout = 5 * time.Second
+
 type SSEWriter struct {
 	w  http.ResponseWriter
 	rc *http.ResponseController
@@ -23,6 +28,10 @@ func beginSSE(w http.ResponseWriter) *SSEWriter {
 }
 
 func (w *SSEWriter) sendEvent(id, event, data string) error {
+	if err := w.rc.SetWriteDeadline(time.Now().Add(sseWriteTimeout)); err != nil {
+		return fmt.Errorf("failed to set write deadline: %w", err)
+	}
+
 	if id != "" {
 		fmt.Fprintf(w.w, "id: %s\n", id)
 	}
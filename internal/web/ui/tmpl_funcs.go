@@ -10,8 +10,10 @@ import (
 var TemplateFuncMap = template.FuncMap{
 	"add":            Add,
 	"formatDuration": FormatDuration,
+	"formatSize":     FormatSize,
 	"formatTime":     FormatTime,
 	"icon":           IncludeIcon,
+	"renderANSI":     RenderANSI,
 }
 
 func Add(a, b int) int {
@@ -48,6 +50,22 @@ func FormatDuration(d time.Duration) string {
 	return strings.TrimSpace(s)
 }
 
+func FormatSize(size int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%d %s", size, units[unit])
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
 func FormatTime(time *time.Time, format string) string {
 	if time == nil {
 		return "N/A"
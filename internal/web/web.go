@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/ctbur/ci-server/v2/internal/build"
 	"github.com/ctbur/ci-server/v2/internal/config"
 	"github.com/ctbur/ci-server/v2/internal/ctxlog"
 	"github.com/ctbur/ci-server/v2/internal/store"
@@ -21,6 +22,7 @@ func Handler(
 	userAuth auth.UserAuth,
 	db *store.DBStore,
 	fs *store.FSStore,
+	processor *build.Processor,
 	tmpl *template.Template,
 	staticFileDir string,
 ) http.Handler {
@@ -35,10 +37,23 @@ func Handler(
 	uiMux := http.NewServeMux()
 	uiMux.Handle("GET /{$}", ui.HandleBuildList(db, tmpl))
 	uiMux.Handle("GET /hx/builds", ui.HandleBuildListFragment(db, tmpl))
-	uiMux.Handle("GET /builds/{build_id}", ui.HandleBuildDetails(db, fs, tmpl))
-	uiMux.Handle("GET /hx/builds/{build_id}", ui.HandleBuildDetailsFragment(db, fs, tmpl))
+	uiMux.Handle("GET /builds/{build_id}", ui.HandleBuildDetails(cfg, db, fs, tmpl))
+	uiMux.Handle("GET /sse/builds/{build_id}", ui.HandleBuildStream(cfg, db, fs, tmpl))
+	uiMux.Handle("POST /builds/{build_id}/cancel", ui.HandleCancelBuild(db, processor))
+	uiMux.Handle("GET /builds/{build_id}/artifacts/{name...}", ui.HandleArtifactDownload(db, fs))
+	uiMux.Handle("GET /builds/{build_id}/log.txt", ui.HandleLogText(db, fs))
+	uiMux.Handle("GET /builds/{build_id}/log.jsonl", ui.HandleLogJSONL(db, fs))
+	uiMux.Handle("GET /repos/{owner}/{name}/flaky-tests", ui.HandleFlakyTests(cfg, db, tmpl))
+	uiMux.Handle("GET /search", ui.HandleLogSearch(cfg, db, tmpl))
 	mux.Handle("/", userAuth.Middleware(uiMux))
 
+	// Admin pages show details of the server, e.g. its disk usage and the
+	// paths and env in the builder logs
+	adminMux := http.NewServeMux()
+	adminMux.Handle("GET /admin/disk-usage", ui.HandleDiskUsage(cfg, db, fs, tmpl))
+	adminMux.Handle("GET /admin/builds/{build_id}/builder-log.txt", ui.HandleBuilderLog(fs))
+	mux.Handle("/admin/", userAuth.AdminMiddleware(cfg.Admins, adminMux))
+
 	return ctxlog.Middleware(mux)
 }
 
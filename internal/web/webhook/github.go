@@ -107,7 +107,7 @@ func HandleGitHub(b BuildCreator, cfg *config.Config) http.HandlerFunc {
 			return
 		}
 
-		buildID, err := b.CreateBuild(ctx, owner, name, build, time.Now())
+		buildID, err := b.CreateBuild(ctx, owner, name, build, repoCfg.Matrix.Expand(), time.Now())
 		if err != nil {
 			http.Error(w, "Failed to create build", http.StatusInternalServerError)
 			log.ErrorContext(ctx, "Failed to create build", slog.Any("error", err))
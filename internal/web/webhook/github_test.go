@@ -64,11 +64,12 @@ type MockBuildCreator struct {
 type MockBuild struct {
 	RepoOwner, RepoName string
 	BuildMeta           store.BuildMeta
+	Jobs                []map[string]string
 	TS                  time.Time
 }
 
 func (c *MockBuildCreator) CreateBuild(
-	ctx context.Context, repoOwner, repoName string, build store.BuildMeta, ts time.Time,
+	ctx context.Context, repoOwner, repoName string, build store.BuildMeta, jobs []map[string]string, ts time.Time,
 ) (uint64, error) {
 	if c.Build != nil {
 		panic("Can only create one build per MockBuildCreator")
@@ -78,6 +79,7 @@ func (c *MockBuildCreator) CreateBuild(
 		RepoOwner: repoOwner,
 		RepoName:  repoName,
 		BuildMeta: build,
+		Jobs:      jobs,
 		TS:        ts,
 	}
 
@@ -57,7 +57,7 @@ func HandleManual(b BuildCreator, cfg *config.Config) http.HandlerFunc {
 			return
 		}
 
-		buildID, err := b.CreateBuild(ctx, payload.Owner, payload.Name, build, time.Now())
+		buildID, err := b.CreateBuild(ctx, payload.Owner, payload.Name, build, repoCfg.Matrix.Expand(), time.Now())
 		if err != nil {
 			http.Error(w, "Failed to create build", http.StatusInternalServerError)
 			log.ErrorContext(ctx, "Failed to create build", slog.Any("error", err))
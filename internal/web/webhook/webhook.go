@@ -14,7 +14,9 @@ import (
 )
 
 type BuildCreator interface {
-	CreateBuild(ctx context.Context, repoOwner, repoName string, build store.BuildMeta, ts time.Time) (uint64, error)
+	CreateBuild(
+		ctx context.Context, repoOwner, repoName string, build store.BuildMeta, jobs []map[string]string, ts time.Time,
+	) (uint64, error)
 }
 
 func decodeJSON[T any](body io.Reader) (*T, error) {
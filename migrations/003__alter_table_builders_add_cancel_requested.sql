@@ -0,0 +1,2 @@
+ALTER TABLE builders
+    ADD COLUMN cancel_requested BOOLEAN NOT NULL DEFAULT FALSE;
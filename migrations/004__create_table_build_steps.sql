@@ -0,0 +1,18 @@
+CREATE TABLE build_steps (
+    build_id BIGINT NOT NULL,
+    idx INT NOT NULL,
+
+    name VARCHAR(255) NOT NULL,
+    started TIMESTAMP WITH TIME ZONE,
+    finished TIMESTAMP WITH TIME ZONE,
+    exit_code INT,
+    skipped BOOLEAN NOT NULL DEFAULT FALSE,
+    timed_out BOOLEAN NOT NULL DEFAULT FALSE,
+
+    PRIMARY KEY (build_id, idx),
+
+    CONSTRAINT fk_build
+        FOREIGN KEY (build_id)
+        REFERENCES builds (id)
+        ON DELETE CASCADE
+);
@@ -0,0 +1,14 @@
+ALTER TABLE builds
+    ADD COLUMN parent_id BIGINT DEFAULT NULL,
+    ADD COLUMN job_index INT NOT NULL DEFAULT 0,
+    ADD COLUMN job_count INT NOT NULL DEFAULT 0,
+    ADD COLUMN job_env JSONB DEFAULT NULL,
+    ADD CONSTRAINT fk_parent
+        FOREIGN KEY (parent_id)
+        REFERENCES builds (id)
+        ON DELETE CASCADE,
+    DROP CONSTRAINT builds_repo_id_number_key,
+    ADD CONSTRAINT builds_repo_id_number_job_index_key
+        UNIQUE (repo_id, number, job_index);
+
+CREATE INDEX builds_parent_id_idx ON builds (parent_id);
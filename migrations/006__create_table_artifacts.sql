@@ -0,0 +1,17 @@
+CREATE TABLE artifacts (
+    build_id BIGINT NOT NULL,
+    name VARCHAR(1024) NOT NULL,
+
+    size BIGINT NOT NULL,
+    sha256 CHAR(64) NOT NULL,
+    expires TIMESTAMP WITH TIME ZONE,
+
+    PRIMARY KEY (build_id, name),
+
+    CONSTRAINT fk_build
+        FOREIGN KEY (build_id)
+        REFERENCES builds (id)
+        ON DELETE CASCADE
+);
+
+CREATE INDEX artifacts_expires_idx ON artifacts (expires);
@@ -0,0 +1,44 @@
+CREATE TYPE test_status AS ENUM (
+    'passed',
+    'failed',
+    'skipped'
+);
+
+-- Tests are kept per repo, to follow the results of a test across builds
+CREATE TABLE test_cases (
+    id BIGSERIAL PRIMARY KEY,
+
+    repo_id BIGINT NOT NULL,
+    suite VARCHAR(1024) NOT NULL,
+    name VARCHAR(1024) NOT NULL,
+
+    CONSTRAINT fk_repo
+        FOREIGN KEY (repo_id)
+        REFERENCES repos (id)
+        ON DELETE CASCADE,
+
+    UNIQUE (repo_id, suite, name)
+);
+
+CREATE TABLE test_results (
+    build_id BIGINT NOT NULL,
+    test_case_id BIGINT NOT NULL,
+
+    status test_status NOT NULL,
+    duration_ms BIGINT NOT NULL,
+    message TEXT NOT NULL,
+
+    PRIMARY KEY (build_id, test_case_id),
+
+    CONSTRAINT fk_build
+        FOREIGN KEY (build_id)
+        REFERENCES builds (id)
+        ON DELETE CASCADE,
+
+    CONSTRAINT fk_test_case
+        FOREIGN KEY (test_case_id)
+        REFERENCES test_cases (id)
+        ON DELETE CASCADE
+);
+
+CREATE INDEX test_results_test_case_id_idx ON test_results (test_case_id);
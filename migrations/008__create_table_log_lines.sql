@@ -0,0 +1,19 @@
+-- Lines of the build logs, which are indexed for full-text search once their
+-- build finished
+CREATE TABLE log_lines (
+    build_id BIGINT NOT NULL,
+    line INT NOT NULL,
+    text TEXT NOT NULL,
+    -- The simple config doesn't stem words or drop stop words, so that error
+    -- messages match as they were written
+    text_search TSVECTOR GENERATED ALWAYS AS (to_tsvector('simple', text)) STORED,
+
+    PRIMARY KEY (build_id, line),
+
+    CONSTRAINT fk_build
+        FOREIGN KEY (build_id)
+        REFERENCES builds (id)
+        ON DELETE CASCADE
+);
+
+CREATE INDEX log_lines_text_search_idx ON log_lines USING GIN (text_search);
@@ -0,0 +1,19 @@
+// Streams updates of a page as server-sent events from the URL in the
+// data-stream attribute of #update-stream. The elements of an "update" event
+// are swapped into the page by their hx-swap-oob attribute, and "done" ends the
+// stream. A dropped connection is resumed by EventSource, which sends the ID of
+// the last update it received.
+document.addEventListener("DOMContentLoaded", () => {
+    const stream = document.getElementById("update-stream");
+    if (!stream) {
+        return;
+    }
+
+    const source = new EventSource(stream.dataset.stream);
+    source.addEventListener("update", (event) => {
+        htmx.swap(stream, event.data, { swapStyle: "none" });
+    });
+    source.addEventListener("done", () => {
+        source.close();
+    });
+});